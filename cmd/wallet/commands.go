@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+	"github.com/shFarrukh/wallet/pkg/wallet"
+)
+
+// command is one subcommand of the tool. run returns the value to print, or
+// nil if there is nothing to print.
+type command struct {
+	name    string
+	args    string
+	help    string
+	minArgs int
+	maxArgs int
+	run     func(svc *wallet.Service, args []string) (interface{}, error)
+}
+
+var commands = []command{
+	{
+		name: "account register", args: "<phone> [currency]", help: "register an account",
+		minArgs: 1, maxArgs: 2,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			currency := wallet.DefaultCurrency
+			if len(args) > 1 {
+				currency = types.Currency(args[1])
+			}
+			return svc.RegisterAccountIn(types.Phone(args[0]), currency)
+		},
+	},
+	{
+		name: "account show", args: "<account-id>", help: "show an account",
+		minArgs: 1, maxArgs: 1,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			accountID, err := parseAccountID(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return svc.FindAccountByID(accountID)
+		},
+	},
+	{
+		name: "deposit", args: "<account-id> <amount>", help: "deposit money to an account",
+		minArgs: 2, maxArgs: 2,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			accountID, err := parseAccountID(args[0])
+			if err != nil {
+				return nil, err
+			}
+			amount, err := parseAmount(args[1])
+			if err != nil {
+				return nil, err
+			}
+			if err := svc.Deposit(accountID, amount); err != nil {
+				return nil, err
+			}
+			return svc.FindAccountByID(accountID)
+		},
+	},
+	{
+		name: "pay", args: "<account-id> <amount> <category>", help: "pay from an account",
+		minArgs: 3, maxArgs: 3,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			accountID, err := parseAccountID(args[0])
+			if err != nil {
+				return nil, err
+			}
+			amount, err := parseAmount(args[1])
+			if err != nil {
+				return nil, err
+			}
+			return svc.Pay(accountID, amount, types.PaymentCategory(args[2]))
+		},
+	},
+	{
+		name: "reject", args: "<payment-id>", help: "reject a payment and refund it",
+		minArgs: 1, maxArgs: 1,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			if err := svc.Reject(args[0]); err != nil {
+				return nil, err
+			}
+			return svc.FindPaymentByID(args[0])
+		},
+	},
+	{
+		name: "repeat", args: "<payment-id>", help: "make a payment once more",
+		minArgs: 1, maxArgs: 1,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			return svc.Repeat(args[0])
+		},
+	},
+	{
+		name: "favorite add", args: "<payment-id> <name>", help: "save a payment as a favorite",
+		minArgs: 2, maxArgs: 2,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			return svc.FavoritePayment(args[0], args[1])
+		},
+	},
+	{
+		name: "favorite pay", args: "<favorite-id>", help: "pay from a favorite",
+		minArgs: 1, maxArgs: 1,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			return svc.PayFromFavorite(args[0])
+		},
+	},
+	{
+		name: "history", args: "<account-id>", help: "list the payments of an account",
+		minArgs: 1, maxArgs: 1,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			accountID, err := parseAccountID(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if _, err := svc.FindAccountByID(accountID); err != nil {
+				return nil, err
+			}
+			// an account without payments has an empty history
+			payments, err := svc.ExportAccountHistory(accountID)
+			if err != nil && err != wallet.ErrAccountNotFound {
+				return nil, err
+			}
+			if payments == nil {
+				payments = []types.Payment{}
+			}
+			return payments, nil
+		},
+	},
+	{
+		name: "export", args: "<dir>", help: "export the wallet to a directory",
+		minArgs: 1, maxArgs: 1,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			return nil, svc.Export(args[0])
+		},
+	},
+	{
+		name: "import", args: "<dir> [merge|replace]", help: "import a wallet exported to a directory",
+		minArgs: 1, maxArgs: 2,
+		run: func(svc *wallet.Service, args []string) (interface{}, error) {
+			mode := wallet.ImportMerge
+			if len(args) > 1 {
+				var ok bool
+				mode, ok = importModes[args[1]]
+				if !ok {
+					return nil, fmt.Errorf("%w: import mode %q", errUsage, args[1])
+				}
+			}
+			return nil, svc.ImportWithMode(args[0], mode)
+		},
+	},
+}
+
+var importModes = map[string]wallet.ImportMode{
+	"merge":   wallet.ImportMerge,
+	"replace": wallet.ImportReplace,
+}
+
+func parseAccountID(value string) (int64, error) {
+	accountID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: account ID %q", errUsage, value)
+	}
+	return accountID, nil
+}
+
+func parseAmount(value string) (types.Money, error) {
+	amount, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: amount %q", errUsage, value)
+	}
+	return types.Money(amount), nil
+}
@@ -0,0 +1,111 @@
+// Command wallet inspects and changes a wallet kept in a data directory in
+// the dump format written by Service.Export.
+//
+// Usage:
+//
+//	wallet [-data dir] [-o table|json] <command> [arguments]
+//
+// Run wallet without a command for the list of commands.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/shFarrukh/wallet/pkg/wallet"
+)
+
+var errUsage = errors.New("invalid argument")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line and returns the exit code.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("wallet", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("data", defaultDataDir(), "directory of the dump files")
+	format := flags.String("o", "table", "output format: table or json")
+	flags.Usage = func() { usage(flags, stderr) }
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	printer, err := newPrinter(*format, stdout)
+	if err != nil {
+		fmt.Fprintln(stderr, "wallet:", err)
+		return 2
+	}
+	cmd, cmdArgs := findCommand(flags.Args())
+	if cmd == nil {
+		usage(flags, stderr)
+		return 2
+	}
+	if len(cmdArgs) < cmd.minArgs || len(cmdArgs) > cmd.maxArgs {
+		fmt.Fprintf(stderr, "usage: wallet %s %s\n", cmd.name, cmd.args)
+		return 2
+	}
+
+	repo, err := wallet.NewFileRepository(*dir)
+	if err != nil {
+		fmt.Fprintln(stderr, "wallet:", err)
+		return 1
+	}
+	result, err := cmd.run(wallet.NewService(repo), cmdArgs)
+	if errors.Is(err, errUsage) {
+		fmt.Fprintf(stderr, "wallet %s: %v\nusage: wallet %s %s\n", cmd.name, err, cmd.name, cmd.args)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "wallet %s: %v\n", cmd.name, err)
+		return 1
+	}
+	if result == nil {
+		return 0
+	}
+	if err := printer.print(result); err != nil {
+		fmt.Fprintln(stderr, "wallet:", err)
+		return 1
+	}
+	return 0
+}
+
+func defaultDataDir() string {
+	if dir := os.Getenv("WALLET_DATA"); dir != "" {
+		return dir
+	}
+	return "."
+}
+
+// findCommand returns the command named by the first one or two arguments
+// and the rest of the arguments.
+func findCommand(args []string) (*command, []string) {
+	for i := range commands {
+		cmd := &commands[i]
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+func usage(flags *flag.FlagSet, w io.Writer) {
+	fmt.Fprintln(w, "usage: wallet [-data dir] [-o table|json] <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-40s %s\n", cmd.name+" "+cmd.args, cmd.help)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "flags:")
+	flags.PrintDefaults()
+}
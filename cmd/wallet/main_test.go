@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runWallet runs the tool on dir and returns its exit code and output.
+func runWallet(t *testing.T, dir string, args ...string) (int, string, string) {
+	t.Helper()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := run(append([]string{"-data", dir}, args...), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// walletJSON runs the tool with JSON output and decodes it into result.
+func walletJSON(t *testing.T, dir string, result interface{}, args ...string) {
+	t.Helper()
+	code, stdout, stderr := runWallet(t, dir, append([]string{"-o", "json"}, args...)...)
+	if code != 0 {
+		t.Fatalf("%v: exit code %v, stderr => %v", args, code, stderr)
+	}
+	if err := json.Unmarshal([]byte(stdout), result); err != nil {
+		t.Fatalf("%v: %v, output => %v", args, err, stdout)
+	}
+}
+
+func TestRun_paymentFlow(t *testing.T) {
+	dir := t.TempDir()
+
+	var account accountRecord
+	walletJSON(t, dir, &account, "account", "register", "+992000000001")
+	walletJSON(t, dir, &account, "deposit", "1", "100")
+	if account.Balance != 100 {
+		t.Errorf("wrong balance => %v", account.Balance)
+	}
+	var payment paymentRecord
+	walletJSON(t, dir, &payment, "pay", "1", "30", "auto")
+	var favorite favoriteRecord
+	walletJSON(t, dir, &favorite, "favorite", "add", payment.ID, "car")
+	var fromFavorite paymentRecord
+	walletJSON(t, dir, &fromFavorite, "favorite", "pay", favorite.ID)
+	var repeated paymentRecord
+	walletJSON(t, dir, &repeated, "repeat", payment.ID)
+	var rejected paymentRecord
+	walletJSON(t, dir, &rejected, "reject", payment.ID)
+	if rejected.Status != "FAIL" {
+		t.Errorf("wrong status => %v", rejected.Status)
+	}
+
+	// every command reopens the data directory, so the state is on disk
+	if _, err := os.Stat(filepath.Join(dir, "CURRENT")); err != nil {
+		t.Error(err)
+	}
+	var history []paymentRecord
+	walletJSON(t, dir, &history, "history", "1")
+	if len(history) != 3 {
+		t.Errorf("wrong history => %v", history)
+	}
+	walletJSON(t, dir, &account, "account", "show", "1")
+	if account.Balance != 40 {
+		t.Errorf("wrong balance\ngot > %v \nwant > %v", account.Balance, 40)
+	}
+}
+
+func TestRun_table(t *testing.T) {
+	dir := t.TempDir()
+
+	code, stdout, _ := runWallet(t, dir, "account", "register", "+992000000001", "USD")
+	if code != 0 {
+		t.Fatalf("exit code %v", code)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "USD") {
+		t.Errorf("wrong table => %q", stdout)
+	}
+
+	code, stdout, _ = runWallet(t, dir, "history", "1")
+	if code != 0 || strings.TrimSpace(stdout) != "ID  ACCOUNT  AMOUNT  CATEGORY  STATUS  CREATED" {
+		t.Errorf("wrong empty history => %q, exit code %v", stdout, code)
+	}
+}
+
+func TestRun_exportImport(t *testing.T) {
+	dir := t.TempDir()
+	exported := t.TempDir()
+
+	var account accountRecord
+	walletJSON(t, dir, &account, "account", "register", "+992000000001")
+	walletJSON(t, dir, &account, "deposit", "1", "100")
+	if code, _, stderr := runWallet(t, dir, "export", exported); code != 0 {
+		t.Fatalf("exit code %v, stderr => %v", code, stderr)
+	}
+
+	other := t.TempDir()
+	if code, _, stderr := runWallet(t, other, "import", exported); code != 0 {
+		t.Fatalf("exit code %v, stderr => %v", code, stderr)
+	}
+	walletJSON(t, other, &account, "account", "show", "1")
+	if account.Balance != 100 {
+		t.Errorf("\ngot > %v \nwant > %v", account.Balance, 100)
+	}
+
+	// an export is a data directory too
+	walletJSON(t, exported, &account, "account", "show", "1")
+	if account.Balance != 100 {
+		t.Errorf("\ngot > %v \nwant > %v", account.Balance, 100)
+	}
+
+	walletJSON(t, other, &account, "account", "register", "+992000000002")
+	if code, _, stderr := runWallet(t, other, "import", exported, "replace"); code != 0 {
+		t.Fatalf("exit code %v, stderr => %v", code, stderr)
+	}
+	if code, _, _ := runWallet(t, other, "account", "show", "2"); code == 0 {
+		t.Error("account not in the export survived a replacing import")
+	}
+	if code, _, _ := runWallet(t, other, "import", exported, "append"); code != 2 {
+		t.Errorf("wrong exit code for a bad import mode => %v", code)
+	}
+}
+
+func TestRun_errors(t *testing.T) {
+	dir := t.TempDir()
+	runWallet(t, dir, "account", "register", "+992000000001")
+
+	tests := []struct {
+		args []string
+		code int
+		err  string
+	}{
+		{[]string{}, 2, "usage"},
+		{[]string{"nope"}, 2, "usage"},
+		{[]string{"deposit", "1"}, 2, "usage: wallet deposit"},
+		{[]string{"deposit", "x", "10"}, 2, "invalid argument"},
+		{[]string{"deposit", "1", "0"}, 1, "amount must be greater than zero"},
+		{[]string{"pay", "1", "10", "auto"}, 1, "not enough balance"},
+		{[]string{"account", "show", "42"}, 1, "account not found"},
+		{[]string{"reject", "nope"}, 1, "payment not found"},
+		{[]string{"-o", "xml", "history", "1"}, 2, "unknown output format"},
+	}
+	for _, test := range tests {
+		code, _, stderr := runWallet(t, dir, test.args...)
+		if code != test.code || !strings.Contains(stderr, test.err) {
+			t.Errorf("%v => exit code %v, stderr %q want => %v, %q", test.args, code, stderr, test.code, test.err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// printer writes the results of the commands either as aligned tables or as
+// JSON documents.
+type printer struct {
+	json bool
+	w    io.Writer
+}
+
+func newPrinter(format string, w io.Writer) (*printer, error) {
+	switch format {
+	case "table":
+		return &printer{w: w}, nil
+	case "json":
+		return &printer{json: true, w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+type accountRecord struct {
+	ID       int64          `json:"id"`
+	Phone    types.Phone    `json:"phone"`
+	Balance  types.Money    `json:"balance"`
+	Currency types.Currency `json:"currency"`
+}
+
+type paymentRecord struct {
+	ID              string                `json:"id"`
+	AccountID       int64                 `json:"accountId"`
+	Amount          types.Money           `json:"amount"`
+	Category        types.PaymentCategory `json:"category"`
+	Status          types.PaymentStatus   `json:"status"`
+	LinkedPaymentID string                `json:"linkedPaymentId,omitempty"`
+	CreatedAt       string                `json:"createdAt,omitempty"`
+}
+
+type favoriteRecord struct {
+	ID        string                `json:"id"`
+	AccountID int64                 `json:"accountId"`
+	Name      string                `json:"name"`
+	Amount    types.Money           `json:"amount"`
+	Category  types.PaymentCategory `json:"category"`
+}
+
+func (p *printer) print(value interface{}) error {
+	var header []string
+	var rows [][]string
+	var document interface{}
+
+	switch value := value.(type) {
+	case *types.Account:
+		record := accountRecord{value.ID, value.Phone, value.Balance, value.Currency}
+		header = []string{"ID", "PHONE", "BALANCE", "CURRENCY"}
+		rows = [][]string{{
+			strconv.FormatInt(record.ID, 10),
+			string(record.Phone),
+			strconv.FormatInt(int64(record.Balance), 10),
+			string(record.Currency),
+		}}
+		document = record
+	case *types.Payment:
+		record := newPaymentRecord(value)
+		header, rows = paymentTable([]paymentRecord{record})
+		document = record
+	case []types.Payment:
+		records := make([]paymentRecord, len(value))
+		for i := range value {
+			records[i] = newPaymentRecord(&value[i])
+		}
+		header, rows = paymentTable(records)
+		document = records
+	case *types.Favorite:
+		record := favoriteRecord{value.ID, value.AccountID, value.Name, value.Amount, value.Category}
+		header = []string{"ID", "ACCOUNT", "NAME", "AMOUNT", "CATEGORY"}
+		rows = [][]string{{
+			record.ID,
+			strconv.FormatInt(record.AccountID, 10),
+			record.Name,
+			strconv.FormatInt(int64(record.Amount), 10),
+			string(record.Category),
+		}}
+		document = record
+	default:
+		return fmt.Errorf("can't print %T", value)
+	}
+
+	if p.json {
+		encoder := json.NewEncoder(p.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(document)
+	}
+	return writeTable(p.w, header, rows)
+}
+
+func newPaymentRecord(payment *types.Payment) paymentRecord {
+	record := paymentRecord{
+		ID:              payment.ID,
+		AccountID:       payment.AccountID,
+		Amount:          payment.Amount,
+		Category:        payment.Category,
+		Status:          payment.Status,
+		LinkedPaymentID: payment.LinkedPaymentID,
+	}
+	if !payment.CreatedAt.IsZero() {
+		record.CreatedAt = payment.CreatedAt.Format(time.RFC3339)
+	}
+	return record
+}
+
+func paymentTable(records []paymentRecord) ([]string, [][]string) {
+	header := []string{"ID", "ACCOUNT", "AMOUNT", "CATEGORY", "STATUS", "CREATED"}
+	rows := make([][]string, len(records))
+	for i, record := range records {
+		rows[i] = []string{
+			record.ID,
+			strconv.FormatInt(record.AccountID, 10),
+			strconv.FormatInt(int64(record.Amount), 10),
+			string(record.Category),
+			string(record.Status),
+			record.CreatedAt,
+		}
+	}
+	return header, rows
+}
+
+func writeTable(w io.Writer, header []string, rows [][]string) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(table, "\t")
+			}
+			fmt.Fprint(table, cell)
+		}
+		fmt.Fprintln(table)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+	"github.com/shFarrukh/wallet/pkg/wallet"
+)
+
+// maxBodySize limits the size of a request body.
+const maxBodySize = 1 << 20
+
+var errBadRequest = errors.New("bad request")
+
+// errorStatuses maps the errors of the wallet package to HTTP statuses.
+// Errors not listed here are internal errors.
+var errorStatuses = []struct {
+	err    error
+	status int
+}{
+	{wallet.ErrAccountNotFound, http.StatusNotFound},
+	{wallet.ErrPaymentNotFound, http.StatusNotFound},
+	{wallet.ErrFavoriteNotFound, http.StatusNotFound},
+	{wallet.ErrPhoneRegistered, http.StatusConflict},
+	{wallet.ErrIdempotencyConflict, http.StatusConflict},
+	{wallet.ErrIllegalTransition, http.StatusConflict},
+	{wallet.ErrRepeatIncoming, http.StatusConflict},
+	{wallet.ErrNotEnoughBalance, http.StatusUnprocessableEntity},
+	{wallet.ErrCurrencyMismatch, http.StatusUnprocessableEntity},
+	{wallet.ErrAmountMustBePositive, http.StatusBadRequest},
+	{wallet.ErrUnknownCurrency, http.StatusBadRequest},
+	{errBadRequest, http.StatusBadRequest},
+}
+
+func errorStatus(err error) int {
+	for _, known := range errorStatuses {
+		if errors.Is(err, known.err) {
+			return known.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+type accountDTO struct {
+	ID       int64          `json:"id"`
+	Phone    types.Phone    `json:"phone"`
+	Balance  types.Money    `json:"balance"`
+	Currency types.Currency `json:"currency"`
+}
+
+type paymentDTO struct {
+	ID              string                `json:"id"`
+	AccountID       int64                 `json:"accountId"`
+	Amount          types.Money           `json:"amount"`
+	Category        types.PaymentCategory `json:"category"`
+	Status          types.PaymentStatus   `json:"status"`
+	LinkedPaymentID string                `json:"linkedPaymentId,omitempty"`
+	CreatedAt       *time.Time            `json:"createdAt,omitempty"`
+	UpdatedAt       *time.Time            `json:"updatedAt,omitempty"`
+}
+
+type favoriteDTO struct {
+	ID        string                `json:"id"`
+	AccountID int64                 `json:"accountId"`
+	Name      string                `json:"name"`
+	Amount    types.Money           `json:"amount"`
+	Category  types.PaymentCategory `json:"category"`
+}
+
+type errorDTO struct {
+	Error string `json:"error"`
+}
+
+func newAccountDTO(account *types.Account) accountDTO {
+	return accountDTO{
+		ID:       account.ID,
+		Phone:    account.Phone,
+		Balance:  account.Balance,
+		Currency: account.Currency,
+	}
+}
+
+func newPaymentDTO(payment *types.Payment) paymentDTO {
+	dto := paymentDTO{
+		ID:              payment.ID,
+		AccountID:       payment.AccountID,
+		Amount:          payment.Amount,
+		Category:        payment.Category,
+		Status:          payment.Status,
+		LinkedPaymentID: payment.LinkedPaymentID,
+	}
+	if !payment.CreatedAt.IsZero() {
+		dto.CreatedAt = &payment.CreatedAt
+	}
+	if !payment.UpdatedAt.IsZero() {
+		dto.UpdatedAt = &payment.UpdatedAt
+	}
+	return dto
+}
+
+func newFavoriteDTO(favorite *types.Favorite) favoriteDTO {
+	return favoriteDTO{
+		ID:        favorite.ID,
+		AccountID: favorite.AccountID,
+		Name:      favorite.Name,
+		Amount:    favorite.Amount,
+		Category:  favorite.Category,
+	}
+}
+
+// handler serves the JSON API of a wallet.Service:
+//
+//	POST /accounts                      register an account
+//	GET  /accounts/{id}                 get an account
+//	POST /accounts/{id}/deposits        deposit money
+//	POST /accounts/{id}/payments        pay
+//	GET  /accounts/{id}/payments        payment history
+//	GET  /payments/{id}                 get a payment
+//	POST /payments/{id}/reject          reject a payment
+//	POST /payments/{id}/repeat          repeat a payment
+//	POST /payments/{id}/favorites       save a payment as a favorite
+//	POST /favorites/{id}/payments       pay from a favorite
+//
+// Deposits and payments honour the Idempotency-Key header.
+type handler struct {
+	svc *wallet.Service
+}
+
+func newHandler(svc *wallet.Service) http.Handler {
+	return &handler{svc: svc}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	// allowed collects the methods of the routes matching the path
+	var allowed []string
+	route := func(method string, pattern ...string) bool {
+		if len(path) != len(pattern) {
+			return false
+		}
+		for i, part := range pattern {
+			if part != "*" && part != path[i] {
+				return false
+			}
+		}
+		if r.Method != method {
+			allowed = append(allowed, method)
+			return false
+		}
+		return true
+	}
+
+	switch {
+	case route(http.MethodPost, "accounts"):
+		h.registerAccount(w, r)
+	case route(http.MethodGet, "accounts", "*"):
+		h.account(w, r, path[1])
+	case route(http.MethodPost, "accounts", "*", "deposits"):
+		h.deposit(w, r, path[1])
+	case route(http.MethodPost, "accounts", "*", "payments"):
+		h.pay(w, r, path[1])
+	case route(http.MethodGet, "accounts", "*", "payments"):
+		h.history(w, r, path[1])
+	case route(http.MethodGet, "payments", "*"):
+		h.payment(w, r, path[1])
+	case route(http.MethodPost, "payments", "*", "reject"):
+		h.reject(w, r, path[1])
+	case route(http.MethodPost, "payments", "*", "repeat"):
+		h.repeat(w, r, path[1])
+	case route(http.MethodPost, "payments", "*", "favorites"):
+		h.favoritePayment(w, r, path[1])
+	case route(http.MethodPost, "favorites", "*", "payments"):
+		h.payFromFavorite(w, r, path[1])
+	case len(allowed) > 0:
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSON(w, http.StatusMethodNotAllowed, errorDTO{Error: "method not allowed"})
+	default:
+		writeJSON(w, http.StatusNotFound, errorDTO{Error: "not found"})
+	}
+}
+
+func (h *handler) registerAccount(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Phone    types.Phone    `json:"phone"`
+		Currency types.Currency `json:"currency"`
+	}
+	if err := readJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.Currency == "" {
+		request.Currency = wallet.DefaultCurrency
+	}
+
+	account, err := h.svc.RegisterAccountIn(request.Phone, request.Currency)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAccountDTO(account))
+}
+
+func (h *handler) account(w http.ResponseWriter, r *http.Request, id string) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	account, err := h.svc.FindAccountByID(accountID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAccountDTO(account))
+}
+
+func (h *handler) deposit(w http.ResponseWriter, r *http.Request, id string) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var request struct {
+		Amount types.Money `json:"amount"`
+	}
+	if err := readJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = h.svc.DepositWithKey(idempotencyKey(r), accountID, request.Amount)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	account, err := h.svc.FindAccountByID(accountID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAccountDTO(account))
+}
+
+func (h *handler) pay(w http.ResponseWriter, r *http.Request, id string) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var request struct {
+		Amount   types.Money           `json:"amount"`
+		Category types.PaymentCategory `json:"category"`
+	}
+	if err := readJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	payment, err := h.svc.PayWithKey(idempotencyKey(r), accountID, request.Amount, request.Category)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newPaymentDTO(payment))
+}
+
+func (h *handler) history(w http.ResponseWriter, r *http.Request, id string) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	_, err = h.svc.FindAccountByID(accountID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// ExportAccountHistory reports an account without payments as not
+	// found, the account was found above
+	payments, err := h.svc.ExportAccountHistory(accountID)
+	if err != nil && err != wallet.ErrAccountNotFound {
+		writeError(w, err)
+		return
+	}
+	result := make([]paymentDTO, len(payments))
+	for i := range payments {
+		result[i] = newPaymentDTO(&payments[i])
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *handler) payment(w http.ResponseWriter, r *http.Request, id string) {
+	payment, err := h.svc.FindPaymentByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPaymentDTO(payment))
+}
+
+func (h *handler) reject(w http.ResponseWriter, r *http.Request, id string) {
+	err := h.svc.Reject(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.payment(w, r, id)
+}
+
+func (h *handler) repeat(w http.ResponseWriter, r *http.Request, id string) {
+	payment, err := h.svc.RepeatWithKey(idempotencyKey(r), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newPaymentDTO(payment))
+}
+
+func (h *handler) favoritePayment(w http.ResponseWriter, r *http.Request, id string) {
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	favorite, err := h.svc.FavoritePayment(id, request.Name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newFavoriteDTO(favorite))
+}
+
+func (h *handler) payFromFavorite(w http.ResponseWriter, r *http.Request, id string) {
+	payment, err := h.svc.PayFromFavoriteWithKey(idempotencyKey(r), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newPaymentDTO(payment))
+}
+
+func idempotencyKey(r *http.Request) string {
+	return r.Header.Get("Idempotency-Key")
+}
+
+func parseAccountID(id string) (int64, error) {
+	accountID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		// no account can have such an ID
+		return 0, wallet.ErrAccountNotFound
+	}
+	return accountID, nil
+}
+
+// readJSON decodes the body of the request into value. Unknown fields and
+// trailing data are errors.
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("%w: unexpected data after the JSON value", errBadRequest)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Print(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Print(err)
+		writeJSON(w, status, errorDTO{Error: http.StatusText(status)})
+		return
+	}
+	writeJSON(w, status, errorDTO{Error: err.Error()})
+}
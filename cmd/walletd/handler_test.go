@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/shFarrukh/wallet/pkg/wallet"
+)
+
+// client sends JSON requests to a test server.
+type client struct {
+	t      *testing.T
+	server *httptest.Server
+}
+
+func newClient(t *testing.T) *client {
+	server := httptest.NewServer(newHandler(&wallet.Service{}))
+	t.Cleanup(server.Close)
+	return &client{t: t, server: server}
+}
+
+// do sends body, if any, as JSON and decodes the response into result, if
+// any. It returns the status of the response.
+func (c *client) do(method string, path string, key string, body interface{}, result interface{}) int {
+	c.t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	request, err := http.NewRequest(method, c.server.URL+path, bytes.NewReader(data))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if key != "" {
+		request.Header.Set("Idempotency-Key", key)
+	}
+	response, err := c.server.Client().Do(request)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.Header.Get("Content-Type") != "application/json" {
+		c.t.Errorf("wrong content type => %v", response.Header.Get("Content-Type"))
+	}
+	if result != nil {
+		if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return response.StatusCode
+}
+
+func (c *client) expect(want int, method string, path string, body interface{}, result interface{}) {
+	c.t.Helper()
+	if got := c.do(method, path, "", body, result); got != want {
+		c.t.Fatalf("%s %s\ngot > %v \nwant > %v", method, path, got, want)
+	}
+}
+
+func accountPath(account accountDTO, suffix string) string {
+	return "/accounts/" + strconv.FormatInt(account.ID, 10) + suffix
+}
+
+func TestHandler_paymentFlow(t *testing.T) {
+	c := newClient(t)
+
+	var account accountDTO
+	c.expect(http.StatusCreated, http.MethodPost, "/accounts", map[string]string{"phone": "+992000000001"}, &account)
+	if account.ID != 1 || account.Currency != wallet.DefaultCurrency {
+		t.Errorf("wrong account => %v", account)
+	}
+	c.expect(http.StatusOK, http.MethodPost, accountPath(account, "/deposits"), map[string]int{"amount": 100}, &account)
+	if account.Balance != 100 {
+		t.Errorf("wrong balance => %v", account.Balance)
+	}
+
+	var payment paymentDTO
+	c.expect(http.StatusCreated, http.MethodPost, accountPath(account, "/payments"), map[string]interface{}{"amount": 30, "category": "auto"}, &payment)
+	if payment.Amount != 30 || payment.Status != "INPROGRESS" || payment.CreatedAt == nil {
+		t.Errorf("wrong payment => %v", payment)
+	}
+
+	var favorite favoriteDTO
+	c.expect(http.StatusCreated, http.MethodPost, "/payments/"+payment.ID+"/favorites", map[string]string{"name": "car"}, &favorite)
+	if favorite.Name != "car" || favorite.Amount != 30 {
+		t.Errorf("wrong favorite => %v", favorite)
+	}
+	var fromFavorite paymentDTO
+	c.expect(http.StatusCreated, http.MethodPost, "/favorites/"+favorite.ID+"/payments", nil, &fromFavorite)
+	var repeated paymentDTO
+	c.expect(http.StatusCreated, http.MethodPost, "/payments/"+payment.ID+"/repeat", nil, &repeated)
+
+	var rejected paymentDTO
+	c.expect(http.StatusOK, http.MethodPost, "/payments/"+payment.ID+"/reject", nil, &rejected)
+	if rejected.Status != "FAIL" {
+		t.Errorf("wrong status => %v", rejected.Status)
+	}
+
+	var history []paymentDTO
+	c.expect(http.StatusOK, http.MethodGet, accountPath(account, "/payments"), nil, &history)
+	if len(history) != 3 {
+		t.Fatalf("wrong history => %v", history)
+	}
+	c.expect(http.StatusOK, http.MethodGet, accountPath(account, ""), nil, &account)
+	if account.Balance != 40 {
+		t.Errorf("wrong balance\ngot > %v \nwant > %v", account.Balance, 40)
+	}
+}
+
+func TestHandler_errors(t *testing.T) {
+	c := newClient(t)
+
+	var account accountDTO
+	c.expect(http.StatusCreated, http.MethodPost, "/accounts", map[string]string{"phone": "+992000000001"}, &account)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		want   int
+	}{
+		{"phone registered", http.MethodPost, "/accounts", map[string]string{"phone": "+992000000001"}, http.StatusConflict},
+		{"unknown currency", http.MethodPost, "/accounts", map[string]string{"phone": "+992000000002", "currency": "EUR"}, http.StatusBadRequest},
+		{"unknown field", http.MethodPost, "/accounts", map[string]string{"phone": "+992000000002", "name": "x"}, http.StatusBadRequest},
+		{"account not found", http.MethodGet, "/accounts/42", nil, http.StatusNotFound},
+		{"bad account ID", http.MethodGet, "/accounts/abc", nil, http.StatusNotFound},
+		{"amount not positive", http.MethodPost, accountPath(account, "/deposits"), map[string]int{"amount": 0}, http.StatusBadRequest},
+		{"not enough balance", http.MethodPost, accountPath(account, "/payments"), map[string]interface{}{"amount": 10, "category": "auto"}, http.StatusUnprocessableEntity},
+		{"payment not found", http.MethodPost, "/payments/nope/reject", nil, http.StatusNotFound},
+		{"favorite not found", http.MethodPost, "/favorites/nope/payments", nil, http.StatusNotFound},
+		{"unknown route", http.MethodGet, "/nope", nil, http.StatusNotFound},
+		{"wrong method", http.MethodDelete, "/accounts", nil, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var result errorDTO
+			got := c.do(test.method, test.path, "", test.body, &result)
+			if got != test.want {
+				t.Errorf("\ngot > %v \nwant > %v", got, test.want)
+			}
+			if result.Error == "" {
+				t.Error("no error message")
+			}
+		})
+	}
+}
+
+func TestHandler_rejectTwice(t *testing.T) {
+	c := newClient(t)
+
+	var account accountDTO
+	c.expect(http.StatusCreated, http.MethodPost, "/accounts", map[string]string{"phone": "+992000000001"}, &account)
+	c.expect(http.StatusOK, http.MethodPost, accountPath(account, "/deposits"), map[string]int{"amount": 100}, nil)
+	var payment paymentDTO
+	c.expect(http.StatusCreated, http.MethodPost, accountPath(account, "/payments"), map[string]interface{}{"amount": 30, "category": "auto"}, &payment)
+
+	c.expect(http.StatusOK, http.MethodPost, "/payments/"+payment.ID+"/reject", nil, nil)
+	c.expect(http.StatusConflict, http.MethodPost, "/payments/"+payment.ID+"/reject", nil, nil)
+}
+
+func TestHandler_idempotencyKey(t *testing.T) {
+	c := newClient(t)
+
+	var account accountDTO
+	c.expect(http.StatusCreated, http.MethodPost, "/accounts", map[string]string{"phone": "+992000000001"}, &account)
+	for i := 0; i < 2; i++ {
+		if got := c.do(http.MethodPost, accountPath(account, "/deposits"), "deposit-1", map[string]int{"amount": 100}, nil); got != http.StatusOK {
+			t.Fatalf("\ngot > %v \nwant > %v", got, http.StatusOK)
+		}
+	}
+
+	var first, second paymentDTO
+	c.do(http.MethodPost, accountPath(account, "/payments"), "pay-1", map[string]interface{}{"amount": 30, "category": "auto"}, &first)
+	c.do(http.MethodPost, accountPath(account, "/payments"), "pay-1", map[string]interface{}{"amount": 30, "category": "auto"}, &second)
+	if first.ID != second.ID {
+		t.Errorf("replay made a new payment\ngot > %v \nwant > %v", second.ID, first.ID)
+	}
+	got := c.do(http.MethodPost, accountPath(account, "/payments"), "pay-1", map[string]interface{}{"amount": 40, "category": "auto"}, nil)
+	if got != http.StatusConflict {
+		t.Errorf("\ngot > %v \nwant > %v", got, http.StatusConflict)
+	}
+
+	c.expect(http.StatusOK, http.MethodGet, accountPath(account, ""), nil, &account)
+	if account.Balance != 70 {
+		t.Errorf("wrong balance\ngot > %v \nwant > %v", account.Balance, 70)
+	}
+}
+
+func TestHandler_emptyHistory(t *testing.T) {
+	c := newClient(t)
+
+	var account accountDTO
+	c.expect(http.StatusCreated, http.MethodPost, "/accounts", map[string]string{"phone": "+992000000001"}, &account)
+	var history []paymentDTO
+	c.expect(http.StatusOK, http.MethodGet, accountPath(account, "/payments"), nil, &history)
+	if len(history) != 0 {
+		t.Errorf("got => %v", history)
+	}
+	c.expect(http.StatusNotFound, http.MethodGet, "/accounts/42/payments", nil, nil)
+}
@@ -0,0 +1,95 @@
+// Command walletd serves a wallet over an HTTP JSON API and, with
+// -grpc-addr, over gRPC.
+//
+// Without -data the wallet lives in memory and is lost on exit. With -data
+// it is kept in that directory by a write-ahead log and snapshots.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/wallet"
+	"github.com/shFarrukh/wallet/pkg/walletgrpc"
+	"github.com/shFarrukh/wallet/pkg/walletpb"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	grpcAddr := flag.String("grpc-addr", "", "address to serve gRPC on; no gRPC if empty")
+	dir := flag.String("data", "", "directory keeping the wallet; in memory if empty")
+	snapshotEvery := flag.Int("snapshot-every", 1000, "records of the log between snapshots")
+	flag.Parse()
+
+	if err := run(*addr, *grpcAddr, *dir, *snapshotEvery); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(addr string, grpcAddr string, dir string, snapshotEvery int) error {
+	svc := &wallet.Service{}
+	if dir != "" {
+		var err error
+		svc, err = wallet.OpenService(dir, snapshotEvery)
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err := svc.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newHandler(svc),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 2)
+	go func() {
+		log.Printf("listening on %s", addr)
+		errs <- server.ListenAndServe()
+	}()
+
+	if grpcAddr != "" {
+		listener, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			return err
+		}
+		grpcServer := grpc.NewServer()
+		walletpb.RegisterWalletServer(grpcServer, walletgrpc.NewServer(svc))
+		defer grpcServer.GracefulStop()
+		go func() {
+			log.Printf("serving gRPC on %s", grpcAddr)
+			errs <- grpcServer.Serve(listener)
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
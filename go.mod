@@ -2,4 +2,10 @@ module github.com/shFarrukh/wallet
 
 go 1.16
 
-require github.com/google/uuid v1.2.0
+require (
+	github.com/google/uuid v1.2.0
+	github.com/klauspost/compress v1.15.9
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.43.0
+	google.golang.org/protobuf v1.27.1
+)
@@ -1,6 +1,6 @@
 package types
 
-
+import "time"
 
 type Money int64
 
@@ -10,24 +10,65 @@ type PaymentStatus string
 
 type Phone string
 
+// Currency is the ISO 4217 code of a currency.
+type Currency string
+
+const (
+	CurrencyTJS Currency = "TJS"
+	CurrencyUSD Currency = "USD"
+	CurrencyRUB Currency = "RUB"
+)
+
+// Amount is a sum of money in minor units together with its currency.
+type Amount struct {
+	Value    Money
+	Currency Currency
+}
+
 const (
 	PaymentStatusOk         PaymentStatus = "OK"
 	PaymentStatusFail       PaymentStatus = "FAIL"
 	PaymentStatusInProgress PaymentStatus = "INPROGRESS"
+	PaymentStatusCancelled  PaymentStatus = "CANCELLED"
+	PaymentStatusExpired    PaymentStatus = "EXPIRED"
 )
 
 type Account struct {
 	ID      int64
 	Phone   Phone
 	Balance Money
+	// Currency is the currency the balance and all payments of the account
+	// are denominated in.
+	Currency Currency
 }
 
+// Categories of the two payments created by a transfer between accounts.
+const (
+	PaymentCategoryTransferOut PaymentCategory = "transfer-out"
+	PaymentCategoryTransferIn  PaymentCategory = "transfer-in"
+)
+
 type Payment struct {
 	ID        string
 	AccountID int64
 	Amount    Money
 	Category  PaymentCategory
 	Status    PaymentStatus
+	// LinkedPaymentID is set on both payments of a transfer and points to
+	// the other one.
+	LinkedPaymentID string
+	// FavoriteID is set on the payments made from a favorite.
+	FavoriteID string
+	// Transitions lists the status changes of the payment, oldest first.
+	Transitions []PaymentTransition
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// PaymentTransition records when a payment moved to Status.
+type PaymentTransition struct {
+	Status PaymentStatus
+	At     time.Time
 }
 type Favorite struct {
 	ID        string
@@ -35,5 +76,42 @@ type Favorite struct {
 	Name      string
 	Amount    Money
 	Category  PaymentCategory
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+
+// LedgerAccount names an account of the double-entry ledger: either a
+// wallet account or a system account such as the cash-in account.
+type LedgerAccount string
+
+type EntrySide string
+
+const (
+	EntrySideDebit  EntrySide = "DEBIT"
+	EntrySideCredit EntrySide = "CREDIT"
+)
+
+// Entry is one side of a ledger transaction. The entries sharing a
+// TransactionID always have equal debit and credit totals.
+type Entry struct {
+	ID            string
+	TransactionID string
+	Account       LedgerAccount
+	Side          EntrySide
+	Amount        Money
+	PaymentID     string
+	// CreatedAt is when the transaction was posted; for a deposit it is the
+	// time of the deposit.
+	CreatedAt time.Time
 }
 
+// IdempotencyRecord remembers the result of a request made with an
+// idempotency key. Key and Request are hashes, so that the stored record
+// does not depend on what the client sends.
+type IdempotencyRecord struct {
+	Key       string
+	Request   string
+	PaymentID string
+	CreatedAt time.Time
+}
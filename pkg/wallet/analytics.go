@@ -0,0 +1,309 @@
+package wallet
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// GroupBy tells how PaymentAnalytics groups the payments.
+type GroupBy int
+
+const (
+	GroupByAccount GroupBy = iota
+	GroupByCategory
+	GroupByStatus
+	// GroupByDay, GroupByWeek and GroupByMonth group the payments by the
+	// period they were created in. Weeks start on Monday.
+	GroupByDay
+	GroupByWeek
+	GroupByMonth
+)
+
+var groupByNames = map[GroupBy]string{
+	GroupByAccount:  "account",
+	GroupByCategory: "category",
+	GroupByStatus:   "status",
+	GroupByDay:      "day",
+	GroupByWeek:     "week",
+	GroupByMonth:    "month",
+}
+
+func (g GroupBy) String() string {
+	if name, ok := groupByNames[g]; ok {
+		return name
+	}
+	return "GroupBy(" + strconv.Itoa(int(g)) + ")"
+}
+
+// AnalyticsOptions tells which payments PaymentAnalytics summarizes and
+// how.
+type AnalyticsOptions struct {
+	GroupBy GroupBy
+	// Filter selects the payments; the zero filter selects every one.
+	Filter PaymentFilter
+	// IncludeRefunded counts the failed, cancelled and expired payments
+	// too. They are left out by default, as their money went back to the
+	// account.
+	IncludeRefunded bool
+	// IncludeTransfers counts both payments of the transfers between the
+	// accounts too. They are left out by default, as the money stays in
+	// the wallet.
+	IncludeTransfers bool
+	// Percentiles lists the percentiles of the amounts to compute, each
+	// greater than 0 and at most 100.
+	Percentiles []float64
+	// Location is where days, weeks and months begin; nil means UTC.
+	Location *time.Location
+}
+
+// AnalyticsReport is the summary of the payments by group.
+type AnalyticsReport struct {
+	GroupBy     GroupBy
+	Percentiles []float64
+	Groups      []PaymentGroup
+}
+
+// PaymentGroup summarizes the payments of one group in one currency.
+type PaymentGroup struct {
+	// Key is the account ID, the category or the status of the payments,
+	// or the period they were created in as 2006-01-02 for days and weeks
+	// and as 2006-01 for months.
+	Key      string
+	Currency types.Currency
+	Count    int
+	Total    types.Money
+	// Average is rounded to the nearest minor unit.
+	Average types.Money
+	// Percentiles holds the amount of every percentile of the options, by
+	// the nearest-rank method.
+	Percentiles []types.Money
+}
+
+// PaymentAnalytics summarizes the payments the options select by group.
+// Accounts of different currencies are never summed up together: a group
+// holding payments in several currencies is reported once per currency.
+// The groups are ordered by their keys, then by currency.
+func (s *Service) PaymentAnalytics(ctx context.Context, options AnalyticsOptions) (*AnalyticsReport, error) {
+	for _, p := range options.Percentiles {
+		if !(p > 0 && p <= 100) {
+			return nil, fmt.Errorf("percentile %v is not in (0, 100]", p)
+		}
+	}
+	if _, ok := groupByNames[options.GroupBy]; !ok {
+		return nil, fmt.Errorf("unknown grouping %v", options.GroupBy)
+	}
+	location := options.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	query := PaymentQuery{}.Where(options.Filter)
+	if !options.IncludeRefunded {
+		query = query.Where(Not(StatusIs(refundedStatuses...)))
+	}
+	if !options.IncludeTransfers {
+		query = query.Where(Not(CategoryIs(types.PaymentCategoryTransferOut, types.PaymentCategoryTransferIn)))
+	}
+	page, err := s.QueryPayments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := s.repository().Accounts()
+	if err != nil {
+		return nil, err
+	}
+	currencies := make(map[int64]types.Currency, len(accounts))
+	for i := range accounts {
+		currencies[accounts[i].ID] = currencyOf(&accounts[i])
+	}
+
+	type groupKey struct {
+		key      string
+		currency types.Currency
+	}
+	amounts := make(map[groupKey][]types.Money)
+	for _, payment := range page.Payments {
+		currency, ok := currencies[payment.AccountID]
+		if !ok {
+			currency = DefaultCurrency
+		}
+		key := groupKey{key: analyticsKey(payment, options.GroupBy, location), currency: currency}
+		amounts[key] = append(amounts[key], payment.Amount)
+	}
+
+	report := &AnalyticsReport{
+		GroupBy:     options.GroupBy,
+		Percentiles: append([]float64(nil), options.Percentiles...),
+		Groups:      []PaymentGroup{},
+	}
+	for key, values := range amounts {
+		report.Groups = append(report.Groups, summarize(key.key, key.currency, values, options.Percentiles))
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		a, b := report.Groups[i], report.Groups[j]
+		if a.Key != b.Key {
+			// account IDs are ordered as numbers
+			if options.GroupBy == GroupByAccount && len(a.Key) != len(b.Key) {
+				return len(a.Key) < len(b.Key)
+			}
+			return a.Key < b.Key
+		}
+		return a.Currency < b.Currency
+	})
+	return report, nil
+}
+
+func analyticsKey(payment types.Payment, groupBy GroupBy, location *time.Location) string {
+	created := payment.CreatedAt.In(location)
+	switch groupBy {
+	case GroupByAccount:
+		return strconv.FormatInt(payment.AccountID, 10)
+	case GroupByCategory:
+		return string(payment.Category)
+	case GroupByStatus:
+		return string(payment.Status)
+	case GroupByDay:
+		return created.Format("2006-01-02")
+	case GroupByWeek:
+		// days since Monday
+		days := (int(created.Weekday()) + 6) % 7
+		return created.AddDate(0, 0, -days).Format("2006-01-02")
+	default:
+		return created.Format("2006-01")
+	}
+}
+
+func summarize(key string, currency types.Currency, amounts []types.Money, percentiles []float64) PaymentGroup {
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i] < amounts[j] })
+	group := PaymentGroup{Key: key, Currency: currency, Count: len(amounts)}
+	for _, amount := range amounts {
+		group.Total += amount
+	}
+	count := types.Money(group.Count)
+	group.Average = (group.Total + count/2) / count
+
+	for _, p := range percentiles {
+		rank := int(math.Ceil(p / 100 * float64(len(amounts))))
+		if rank < 1 {
+			rank = 1
+		}
+		group.Percentiles = append(group.Percentiles, amounts[rank-1])
+	}
+	return group
+}
+
+// Formats of the analytics exports named in their manifests.
+const (
+	formatAnalyticsJSON = "analytics-json"
+	formatAnalyticsCSV  = "analytics-csv"
+)
+
+// ExportAnalyticsJSONTo writes the report to sink as analytics.json,
+// followed by the manifest of the export. The file is encoded as the export
+// encoding of the service says.
+func (s *Service) ExportAnalyticsJSONTo(sink FileSink, report *AnalyticsReport) error {
+	files := newManifestSink(sink, formatAnalyticsJSON, s.now(), s.exportEncoding().Keys)
+	err := exportFile(s.encodingSink(files), "analytics.json", func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(newJSONAnalytics(report))
+	})
+	if err != nil {
+		return err
+	}
+	return files.writeManifest()
+}
+
+// ExportAnalyticsCSVTo writes the report to sink as analytics.csv, a row
+// per group with a column per percentile, followed by the manifest of the
+// export. The file is encoded as the export encoding of the service says.
+func (s *Service) ExportAnalyticsCSVTo(sink FileSink, report *AnalyticsReport) error {
+	files := newManifestSink(sink, formatAnalyticsCSV, s.now(), s.exportEncoding().Keys)
+	err := exportFile(s.encodingSink(files), "analytics.csv", func(w io.Writer) error {
+		return writeAnalyticsCSV(w, report)
+	})
+	if err != nil {
+		return err
+	}
+	return files.writeManifest()
+}
+
+type jsonAnalytics struct {
+	GroupBy string               `json:"groupBy"`
+	Groups  []jsonAnalyticsGroup `json:"groups"`
+}
+
+type jsonAnalyticsGroup struct {
+	Key         string           `json:"key"`
+	Currency    string           `json:"currency"`
+	Count       int              `json:"count"`
+	Total       int64            `json:"total"`
+	Average     int64            `json:"average"`
+	Percentiles []jsonPercentile `json:"percentiles,omitempty"`
+}
+
+type jsonPercentile struct {
+	Percentile float64 `json:"percentile"`
+	Amount     int64   `json:"amount"`
+}
+
+func newJSONAnalytics(report *AnalyticsReport) jsonAnalytics {
+	result := jsonAnalytics{GroupBy: report.GroupBy.String(), Groups: []jsonAnalyticsGroup{}}
+	for _, group := range report.Groups {
+		record := jsonAnalyticsGroup{
+			Key:      group.Key,
+			Currency: string(group.Currency),
+			Count:    group.Count,
+			Total:    int64(group.Total),
+			Average:  int64(group.Average),
+		}
+		for i, amount := range group.Percentiles {
+			record.Percentiles = append(record.Percentiles, jsonPercentile{
+				Percentile: report.Percentiles[i],
+				Amount:     int64(amount),
+			})
+		}
+		result.Groups = append(result.Groups, record)
+	}
+	return result
+}
+
+func writeAnalyticsCSV(w io.Writer, report *AnalyticsReport) error {
+	writer := csv.NewWriter(w)
+	header := []string{report.GroupBy.String(), "currency", "count", "total", "average"}
+	for _, p := range report.Percentiles {
+		header = append(header, "p"+strconv.FormatFloat(p, 'f', -1, 64))
+	}
+	err := writer.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range report.Groups {
+		row := []string{
+			group.Key,
+			string(group.Currency),
+			strconv.Itoa(group.Count),
+			strconv.FormatInt(int64(group.Total), 10),
+			strconv.FormatInt(int64(group.Average), 10),
+		}
+		for _, amount := range group.Percentiles {
+			row = append(row, strconv.FormatInt(int64(amount), 10))
+		}
+		err := writer.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,188 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func TestService_PaymentAnalytics(t *testing.T) {
+	// the wallet of newQueryService with a USD account that paid 70 for "auto"
+	svc, _, _ := newQueryService(t)
+	svc.pay(svc.accountIn("+992000000004", types.CurrencyUSD, 100).ID, 70, "auto")
+	tjs, usd := types.CurrencyTJS, types.CurrencyUSD
+
+	tests := []struct {
+		name    string
+		options AnalyticsOptions
+		want    []PaymentGroup
+	}{
+		{"category", AnalyticsOptions{GroupBy: GroupByCategory, Percentiles: []float64{50, 90}}, []PaymentGroup{
+			{Key: "auto", Currency: tjs, Count: 4, Total: 750, Average: 188, Percentiles: []types.Money{100, 500}},
+			{Key: "auto", Currency: usd, Count: 1, Total: 70, Average: 70, Percentiles: []types.Money{70, 70}},
+			{Key: "food", Currency: tjs, Count: 1, Total: 200, Average: 200, Percentiles: []types.Money{200, 200}},
+		}},
+		{"account", AnalyticsOptions{GroupBy: GroupByAccount}, []PaymentGroup{
+			{Key: "1", Currency: tjs, Count: 2, Total: 200, Average: 100},
+			{Key: "2", Currency: tjs, Count: 2, Total: 700, Average: 350},
+			{Key: "3", Currency: tjs, Count: 1, Total: 50, Average: 50},
+			{Key: "4", Currency: usd, Count: 1, Total: 70, Average: 70},
+		}},
+		{"status with refunded", AnalyticsOptions{GroupBy: GroupByStatus, IncludeRefunded: true, Filter: AccountIs(1)}, []PaymentGroup{
+			{Key: "FAIL", Currency: tjs, Count: 1, Total: 300, Average: 300},
+			{Key: "INPROGRESS", Currency: tjs, Count: 2, Total: 200, Average: 100},
+		}},
+		{"week", AnalyticsOptions{GroupBy: GroupByWeek, Filter: AccountIs(1, 2, 3)}, []PaymentGroup{
+			{Key: "2019-12-30", Currency: tjs, Count: 5, Total: 950, Average: 190},
+		}},
+		{"month", AnalyticsOptions{GroupBy: GroupByMonth, Filter: AccountIs(4)}, []PaymentGroup{
+			{Key: "2020-01", Currency: usd, Count: 1, Total: 70, Average: 70},
+		}},
+		{"day in location", AnalyticsOptions{GroupBy: GroupByDay, Filter: AccountIs(1, 2, 3), Location: time.FixedZone("UTC-3", -3*60*60)}, []PaymentGroup{
+			{Key: "2019-12-31", Currency: tjs, Count: 2, Total: 300, Average: 150},
+			{Key: "2020-01-01", Currency: tjs, Count: 3, Total: 650, Average: 217},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := svc.PaymentAnalytics(context.Background(), tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(report.Groups, tt.want) {
+				t.Errorf("\ngot > %+v \nwant > %+v", report.Groups, tt.want)
+			}
+		})
+	}
+
+	_, err := svc.PaymentAnalytics(context.Background(), AnalyticsOptions{Percentiles: []float64{0}})
+	if err == nil {
+		t.Error("percentile 0 is accepted")
+	}
+}
+
+func TestService_PaymentAnalytics_refunded(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 1000)
+	w.pay(account.ID, 10, "auto")
+	w.check(w.Confirm(w.pay(account.ID, 20, "auto").ID))
+	w.check(w.Reject(w.pay(account.ID, 40, "auto").ID))
+	w.check(w.Cancel(w.pay(account.ID, 80, "auto").ID))
+	w.check(w.Expire(w.pay(account.ID, 160, "auto").ID))
+
+	options := AnalyticsOptions{GroupBy: GroupByStatus}
+	report, err := w.PaymentAnalytics(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PaymentGroup{
+		{Key: "INPROGRESS", Currency: types.CurrencyTJS, Count: 1, Total: 10, Average: 10},
+		{Key: "OK", Currency: types.CurrencyTJS, Count: 1, Total: 20, Average: 20},
+	}
+	if !reflect.DeepEqual(report.Groups, want) {
+		t.Errorf("\ngot > %+v \nwant > %+v", report.Groups, want)
+	}
+
+	options.IncludeRefunded = true
+	report, err = w.PaymentAnalytics(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []PaymentGroup{
+		{Key: "CANCELLED", Currency: types.CurrencyTJS, Count: 1, Total: 80, Average: 80},
+		{Key: "EXPIRED", Currency: types.CurrencyTJS, Count: 1, Total: 160, Average: 160},
+		{Key: "FAIL", Currency: types.CurrencyTJS, Count: 1, Total: 40, Average: 40},
+		want[0],
+		want[1],
+	}
+	if !reflect.DeepEqual(report.Groups, want) {
+		t.Errorf("\ngot > %+v \nwant > %+v", report.Groups, want)
+	}
+}
+
+func TestService_PaymentAnalytics_transfers(t *testing.T) {
+	// the wallet of newQueryService with a USD account that paid 70 for "auto"
+	svc, _, _ := newQueryService(t)
+	svc.pay(svc.accountIn("+992000000004", types.CurrencyUSD, 100).ID, 70, "auto")
+	_, err := svc.Transfer(1, 2, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := AnalyticsOptions{GroupBy: GroupByCategory, Filter: AccountIs(1, 2)}
+	report, err := svc.PaymentAnalytics(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PaymentGroup{
+		{Key: "auto", Currency: types.CurrencyTJS, Count: 3, Total: 700, Average: 233},
+		{Key: "food", Currency: types.CurrencyTJS, Count: 1, Total: 200, Average: 200},
+	}
+	if !reflect.DeepEqual(report.Groups, want) {
+		t.Errorf("\ngot > %+v \nwant > %+v", report.Groups, want)
+	}
+
+	options.IncludeTransfers = true
+	report, err = svc.PaymentAnalytics(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want,
+		PaymentGroup{Key: "transfer-in", Currency: types.CurrencyTJS, Count: 1, Total: 40, Average: 40},
+		PaymentGroup{Key: "transfer-out", Currency: types.CurrencyTJS, Count: 1, Total: 40, Average: 40},
+	)
+	if !reflect.DeepEqual(report.Groups, want) {
+		t.Errorf("\ngot > %+v \nwant > %+v", report.Groups, want)
+	}
+}
+
+func TestService_ExportAnalytics(t *testing.T) {
+	// the wallet of newQueryService with a USD account that paid 70 for "auto"
+	svc, _, _ := newQueryService(t)
+	svc.pay(svc.accountIn("+992000000004", types.CurrencyUSD, 100).ID, 70, "auto")
+	report, err := svc.PaymentAnalytics(context.Background(), AnalyticsOptions{GroupBy: GroupByCategory, Percentiles: []float64{50, 99.9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := memorySink{}
+	err = svc.ExportAnalyticsCSVTo(sink, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "category,currency,count,total,average,p50,p99.9\n" +
+		"auto,TJS,4,750,188,100,500\n" +
+		"auto,USD,1,70,70,70,70\n" +
+		"food,TJS,1,200,200,200,200\n"
+	if got := string(sink["analytics.csv"].Data); got != want {
+		t.Errorf("\ngot > %q \nwant > %q", got, want)
+	}
+	if _, err := readManifest(fstest.MapFS(sink), formatAnalyticsCSV, nil); err != nil {
+		t.Errorf("bad manifest, err => %v", err)
+	}
+
+	sink = memorySink{}
+	svc.SetExportEncoding(ExportEncoding{Compression: CompressGzip})
+	err = svc.ExportAnalyticsJSONTo(sink, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := svc.decodingFS(fstest.MapFS(sink)).Open("analytics.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var got jsonAnalytics
+	err = json.NewDecoder(file).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GroupBy != "category" || len(got.Groups) != 3 || got.Groups[0].Percentiles[1] != (jsonPercentile{Percentile: 99.9, Amount: 500}) {
+		t.Errorf("wrong report => %+v", got)
+	}
+}
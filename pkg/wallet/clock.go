@@ -0,0 +1,26 @@
+package wallet
+
+import "time"
+
+// Clock returns the current time. The service stamps payments, favorites and
+// ledger entries with it.
+type Clock func() time.Time
+
+// SetClock makes the service take the time from clock instead of time.Now.
+// Tests use it to control the timestamps of the records.
+func (s *Service) SetClock(clock Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = clock
+}
+
+func (s *Service) now() time.Time {
+	s.mu.Lock()
+	clock := s.clock
+	s.mu.Unlock()
+
+	if clock == nil {
+		return time.Now()
+	}
+	return clock()
+}
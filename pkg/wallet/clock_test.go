@@ -0,0 +1,181 @@
+package wallet
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// testClock is a Clock that only moves when the test says so.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestService_Timestamps(t *testing.T) {
+	w := newTestWallet(t)
+	clock, svc := w.clock, w.Service
+	account := w.account("+992000000001", 100)
+	created := clock.Now()
+
+	payment, err := svc.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	favorite, err := svc.FavoritePayment(payment.ID, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Hour)
+	err = svc.Confirm(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := svc.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(created) || !got.UpdatedAt.Equal(clock.Now()) {
+		t.Errorf("wrong timestamps of the payment => %v, %v", got.CreatedAt, got.UpdatedAt)
+	}
+	if !favorite.CreatedAt.Equal(created) || !favorite.UpdatedAt.Equal(created) {
+		t.Errorf("wrong timestamps of the favorite => %v, %v", favorite.CreatedAt, favorite.UpdatedAt)
+	}
+	entries, err := svc.LedgerEntries(LedgerCashIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].CreatedAt.Equal(created) {
+		t.Errorf("wrong time of the deposit => %v", entries)
+	}
+}
+
+func TestService_PaymentsBetween(t *testing.T) {
+	w := newTestWallet(t)
+	clock, svc := w.clock, w.Service
+	account := w.account("+992000000001", 1_000)
+
+	start := clock.Now()
+	// the clock goes back once, the payment still lands in its place
+	days := []int{0, 1, 2, 4, 3, 5}
+	ids := map[int]string{}
+	for _, day := range days {
+		clock.Set(start.AddDate(0, 0, day))
+		payment, err := svc.Pay(account.ID, types.Money(day+1), "auto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[day] = payment.ID
+	}
+
+	payments, err := svc.PaymentsBetween(account.ID, start.AddDate(0, 0, 1), start.AddDate(0, 0, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ids[1], ids[2], ids[3]}
+	if len(payments) != len(want) {
+		t.Fatalf("wrong payments\ngot > %v \nwant > %v", payments, want)
+	}
+	for i, payment := range payments {
+		if payment.ID != want[i] {
+			t.Errorf("wrong payment %v\ngot > %v \nwant > %v", i, payment.ID, want[i])
+		}
+	}
+
+	payments, err = svc.PaymentsBetween(account.ID, start.AddDate(0, 0, 10), start.AddDate(0, 0, 20))
+	if err != nil || len(payments) != 0 {
+		t.Errorf("got => %v, err => %v", payments, err)
+	}
+	_, err = svc.PaymentsBetween(42, start, start.AddDate(0, 0, 1))
+	if err != ErrAccountNotFound {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrAccountNotFound)
+	}
+}
+
+func TestService_Timestamps_surviveExportImport(t *testing.T) {
+	w := newTestWallet(t)
+	clock, svc := w.clock, w.Service
+	account := w.account("+992000000001", 100)
+	payment, err := svc.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	favorite, err := svc.FavoritePayment(payment.ID, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Minute)
+	err = svc.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := svc.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = svc.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := &Service{}
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := imported.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) || !got.UpdatedAt.Equal(want.UpdatedAt) {
+		t.Errorf("\ngot > %v, %v \nwant > %v, %v", got.CreatedAt, got.UpdatedAt, want.CreatedAt, want.UpdatedAt)
+	}
+	gotFavorite, err := imported.repository().FindFavorite(favorite.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotFavorite.CreatedAt.Equal(favorite.CreatedAt) {
+		t.Errorf("\ngot > %v \nwant > %v", gotFavorite.CreatedAt, favorite.CreatedAt)
+	}
+	payments, err := imported.PaymentsBetween(account.ID, want.CreatedAt, want.CreatedAt.Add(time.Nanosecond))
+	if err != nil || len(payments) != 1 {
+		t.Errorf("got => %v, err => %v", payments, err)
+	}
+}
+
+func TestDecodeFavorites_legacy(t *testing.T) {
+	favorites, err := decodeFavorites("f1;1;home;10;auto|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(favorites) != 1 || !favorites[0].CreatedAt.IsZero() || favorites[0].Category != "auto" {
+		t.Errorf("wrong favorites => %v", favorites)
+	}
+}
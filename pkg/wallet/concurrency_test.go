@@ -0,0 +1,366 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func TestService_Concurrent_DepositPay_balancesConsistent(t *testing.T) {
+	svc := &Service{}
+	const accounts = 8
+	const workers = 16
+	const operations = 200
+
+	for i := 0; i < accounts; i++ {
+		_, err := svc.RegisterAccount(types.Phone(fmt.Sprintf("+99200000000%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < operations; i++ {
+				accountID := int64((worker+i)%accounts + 1)
+				if err := svc.Deposit(accountID, 10); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := svc.Pay(accountID, 3, "auto"); err != nil && err != ErrNotEnoughBalance {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	paid := map[int64]types.Money{}
+	for _, payment := range svc.paymentsSnapshot() {
+		paid[payment.AccountID] += payment.Amount
+	}
+
+	total := types.Money(0)
+	for id := int64(1); id <= accounts; id++ {
+		account, err := svc.FindAccountByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += account.Balance + paid[id]
+	}
+
+	want := types.Money(workers * operations * 10)
+	if total != want {
+		t.Errorf("balances and payments don't add up to deposits\ngot > %v \nwant > %v", total, want)
+	}
+}
+
+func TestService_Concurrent_Pay_neverOverdraws(t *testing.T) {
+	svc := &Service{}
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	succeeded := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.Pay(account.ID, 7, "auto")
+			if err == ErrNotEnoughBalance {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 100/7 {
+		t.Errorf("wrong number of successful payments\ngot > %v \nwant > %v", succeeded, 100/7)
+	}
+	got, err := svc.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 100%7 {
+		t.Errorf("wrong balance\ngot > %v \nwant > %v", got.Balance, 100%7)
+	}
+}
+
+func TestService_Concurrent_RejectWithReaders(t *testing.T) {
+	svc := &Service{}
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for i := 0; i < 100; i++ {
+		payment, err := svc.Pay(account.ID, 10, "auto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, payment.ID)
+	}
+
+	wg := sync.WaitGroup{}
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := svc.Reject(id); err != nil {
+				t.Error(err)
+			}
+		}(id)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			svc.SumPayments(3)
+			svc.FilterPayments(account.ID, 3)
+			svc.FilterPaymentsByFn(func(payment types.Payment) bool {
+				return payment.Status == types.PaymentStatusFail
+			}, 2)
+			svc.ExportAccountHistory(account.ID)
+		}()
+	}
+	wg.Wait()
+
+	got, err := svc.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 1000 {
+		t.Errorf("wrong balance after rejecting every payment\ngot > %v \nwant > %v", got.Balance, 1000)
+	}
+}
+
+func TestService_Concurrent_ReconcileWithPayments(t *testing.T) {
+	svc := &Service{}
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if err := svc.Deposit(account.ID, 10); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := svc.Pay(account.ID, 3, "auto"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		discrepancies, err := svc.Reconcile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(discrepancies) != 0 {
+			<-done
+			t.Fatalf("\ngot > %v \nwant > nil", discrepancies)
+		}
+	}
+}
+
+// yieldingRepository yields the processor after reading an account, so
+// that other goroutines run between the read and the transaction writing
+// the account back.
+type yieldingRepository struct {
+	*MemoryRepository
+}
+
+func (r yieldingRepository) FindAccount(accountID int64) (*types.Account, error) {
+	account, err := r.MemoryRepository.FindAccount(accountID)
+	time.Sleep(10 * time.Microsecond)
+	return account, err
+}
+
+func TestService_Concurrent_ImportWithPayments(t *testing.T) {
+	w := newTestWallet(t)
+	w.Service = NewService(yieldingRepository{NewMemoryRepository()})
+	w.SetClock(w.clock.Now)
+	account := w.account("+992000000001", 1000)
+	sink := memorySink{}
+	w.check(w.ExportTo(sink))
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			mode := ImportMode(i % 2)
+			if err := w.ImportFrom(fstest.MapFS(sink), mode); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if err := w.Deposit(account.ID, 10); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := w.Pay(account.ID, 3, "auto"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// a balance change lost under an import leaves the ledger apart from
+	// the balance
+	discrepancies, err := w.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discrepancies) != 0 {
+		t.Errorf("\ngot > %v \nwant > %v", discrepancies, []Discrepancy{})
+	}
+}
+
+func TestService_lockAccount_doesNotBlockOtherAccounts(t *testing.T) {
+	svc := &Service{}
+	first, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := svc.lockAccount(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.Deposit(second.ID, 100)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Deposit on another account is blocked by a locked account")
+	}
+}
+
+func TestService_SumPaymentsWithProgress(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	count := 1000
+	w := newTestWallet(t)
+	w.storePayments(count)
+	svc := w.Service
+
+	sums := map[int]types.Money{}
+	for progress := range svc.SumPaymentsWithProgress() {
+		if _, ok := sums[progress.Part]; ok {
+			t.Errorf("part %d reported twice", progress.Part)
+		}
+		sums[progress.Part] = progress.Result
+	}
+	// a part per worker
+	if len(sums) != 4 {
+		t.Fatalf("\ngot > %v \nwant > 4 parts", sums)
+	}
+	total := types.Money(0)
+	for _, sum := range sums {
+		total += sum
+	}
+	if want := types.Money(count * (count + 1) / 2); total != want {
+		t.Errorf("\ngot > %v \nwant > %v", total, want)
+	}
+	if want := types.Money((751 + count) * 250 / 2); sums[3] != want {
+		t.Errorf("\ngot > %v \nwant > %v", sums[3], want)
+	}
+
+	for progress := range (&Service{}).SumPaymentsWithProgress() {
+		t.Errorf("empty wallet reported %v", progress)
+	}
+}
+
+func TestService_SumPaymentsWithProgress_fewPayments(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	w := newTestWallet(t)
+	w.storePayments(minProgressPartSize + 1)
+	svc := w.Service
+
+	parts := 0
+	for range svc.SumPaymentsWithProgress() {
+		parts++
+	}
+	if parts != 2 {
+		t.Errorf("\ngot > %v \nwant > 2", parts)
+	}
+}
+
+func TestService_SumPaymentsWithProgressContext_cancel(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	w := newTestWallet(t)
+	w.storePayments(100_000)
+	svc := w.Service
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := svc.SumPaymentsWithProgressContext(ctx)
+	<-ch
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range ch {
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel is not closed after cancelling")
+	}
+}
@@ -0,0 +1,146 @@
+package wallet
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// ExportCSV writes the accounts, payments and favorites of the wallet to
+// accounts.csv, payments.csv and favorites.csv in dir. Every file starts
+// with a header row naming the columns. Times are in RFC 3339 and the
+// transitions of a payment are written as STATUS@time pairs separated by
+// ",".
+func (s *Service) ExportCSV(dir string) error {
+	return s.ExportCSVTo(DirSink(dir))
+}
+
+// ExportCSVTo writes the files of ExportCSV to sink, followed by the
+// manifest of the export.
+func (s *Service) ExportCSVTo(sink FileSink) error {
+	data, err := fetchWalletData(s.repository())
+	if err != nil {
+		return err
+	}
+
+	files := newManifestSink(sink, formatCSV, s.now(), s.exportEncoding().Keys)
+	encoded := s.encodingSink(files)
+	for _, file := range csvFiles {
+		err := exportFile(encoded, file.name, func(w io.Writer) error {
+			return file.encode(w, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return files.writeManifest()
+}
+
+// ImportCSV reads the files written by ExportCSV from dir into the
+// wallet.
+func (s *Service) ImportCSV(dir string) error {
+	return s.ImportCSVFrom(os.DirFS(dir), ImportMerge)
+}
+
+// ImportCSVFrom reads the files of ExportCSVTo from fsys into the
+// wallet as mode says. Missing files are skipped.
+func (s *Service) ImportCSVFrom(fsys fs.FS, mode ImportMode) error {
+	fsys, err := openManifest(fsys, formatCSV, s.exportEncoding().Keys)
+	if err != nil {
+		return err
+	}
+	fsys = s.decodingFS(fsys)
+
+	data := &walletData{}
+	for _, file := range csvFiles {
+		err := importFile(fsys, file.name, func(r io.Reader) error {
+			return file.decode(r, data)
+		})
+		if err == ErrFileNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+	}
+
+	return s.load(data, mode)
+}
+
+// csvFile tells how one collection of walletData is exported as CSV. The
+// rows have the fields of the records in the dumps.
+type csvFile struct {
+	name   string
+	header []string
+	dump   dumpFile
+}
+
+var csvFiles = []csvFile{
+	{
+		name:   "accounts.csv",
+		header: []string{"id", "phone", "balance", "currency"},
+		dump:   accountsFile,
+	},
+	{
+		name:   "payments.csv",
+		header: []string{"id", "accountId", "amount", "category", "status", "linkedPaymentId", "transitions", "createdAt", "updatedAt", "favoriteId"},
+		dump:   paymentsFile,
+	},
+	{
+		name:   "favorites.csv",
+		header: []string{"id", "accountId", "name", "amount", "category", "createdAt", "updatedAt"},
+		dump:   favoritesFile,
+	},
+}
+
+func (file csvFile) encode(w io.Writer, data *walletData) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(file.header)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < file.dump.size(data); i++ {
+		err := writer.Write(file.dump.fields(data, i))
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// decode reads the rows of the collection one by one. Records are counted
+// from 1 after the header row. Files written before columns were added
+// have only the leading columns.
+func (file csvFile) decode(r io.Reader, data *walletData) error {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(header) > len(file.header) || strings.Join(header, ",") != strings.Join(file.header[:len(header)], ",") {
+		return fmt.Errorf("want columns %v, got %v", file.header, header)
+	}
+	reader.FieldsPerRecord = len(header)
+
+	for record := 1; ; record++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = file.dump.add(data, fields)
+		}
+		if err != nil {
+			return &DumpError{Record: record, Err: err}
+		}
+	}
+}
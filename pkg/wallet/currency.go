@@ -0,0 +1,194 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+var (
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrCurrencyMismatch = errors.New("currency does not match the account")
+	ErrRateNotFound     = errors.New("exchange rate not found")
+	ErrAmountOverflow   = errors.New("converted amount is out of range")
+)
+
+// DefaultCurrency is the currency of accounts registered with
+// RegisterAccount and of accounts read from dumps that have no currency.
+const DefaultCurrency = types.CurrencyTJS
+
+var currencies = map[types.Currency]bool{
+	types.CurrencyTJS: true,
+	types.CurrencyUSD: true,
+	types.CurrencyRUB: true,
+}
+
+// ExchangeRateProvider tells how many units of one currency one unit of
+// another is worth.
+type ExchangeRateProvider interface {
+	Rate(from types.Currency, to types.Currency) (float64, error)
+}
+
+// StaticRates is an ExchangeRateProvider that keeps fixed rates in memory.
+type StaticRates struct {
+	mu    sync.RWMutex
+	rates map[[2]types.Currency]float64
+}
+
+func NewStaticRates() *StaticRates {
+	return &StaticRates{rates: make(map[[2]types.Currency]float64)}
+}
+
+// Set stores the rate of converting from into to.
+func (r *StaticRates) Set(from types.Currency, to types.Currency, rate float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rates[[2]types.Currency{from, to}] = rate
+}
+
+// Rate returns the stored rate. If only the opposite rate is stored, its
+// inverse is returned.
+func (r *StaticRates) Rate(from types.Currency, to types.Currency) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if rate, ok := r.rates[[2]types.Currency{from, to}]; ok {
+		return rate, nil
+	}
+	if rate, ok := r.rates[[2]types.Currency{to, from}]; ok && rate != 0 {
+		return 1 / rate, nil
+	}
+	return 0, ErrRateNotFound
+}
+
+// SetExchangeRates makes Convert take the rates from provider.
+func (s *Service) SetExchangeRates(provider ExchangeRateProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rates = provider
+}
+
+// Convert returns amount in the currency to, rounded to the nearest minor
+// unit with halves rounded away from zero. The amount is multiplied by the
+// exact value of the rate, so amounts of any size convert without losing
+// precision; a result that does not fit in types.Money fails with
+// ErrAmountOverflow.
+func (s *Service) Convert(amount types.Amount, to types.Currency) (types.Amount, error) {
+	if !currencies[amount.Currency] || !currencies[to] {
+		return types.Amount{}, ErrUnknownCurrency
+	}
+	if amount.Currency == to {
+		return amount, nil
+	}
+
+	s.mu.Lock()
+	provider := s.rates
+	s.mu.Unlock()
+	if provider == nil {
+		return types.Amount{}, ErrRateNotFound
+	}
+	rate, err := provider.Rate(amount.Currency, to)
+	if err != nil {
+		return types.Amount{}, err
+	}
+	exact := new(big.Rat).SetFloat64(rate)
+	if exact == nil || exact.Sign() <= 0 {
+		return types.Amount{}, fmt.Errorf("bad exchange rate %v of %s to %s", rate, amount.Currency, to)
+	}
+
+	value := roundRat(exact.Mul(exact, new(big.Rat).SetInt64(int64(amount.Value))))
+	if !value.IsInt64() {
+		return types.Amount{}, ErrAmountOverflow
+	}
+	return types.Amount{Value: types.Money(value.Int64()), Currency: to}, nil
+}
+
+// roundRat rounds x to the nearest integer, halves away from zero.
+func roundRat(x *big.Rat) *big.Int {
+	quotient, remainder := new(big.Int).QuoRem(x.Num(), x.Denom(), new(big.Int))
+	// the remainder has the sign of x; it is half the denominator or more
+	// when twice its size reaches the denominator
+	twice := remainder.Abs(remainder)
+	twice.Lsh(twice, 1)
+	if twice.Cmp(x.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(x.Sign())))
+	}
+	return quotient
+}
+
+// RegisterAccountIn registers an account denominated in the currency.
+func (s *Service) RegisterAccountIn(phone types.Phone, currency types.Currency) (*types.Account, error) {
+	if !currencies[currency] {
+		return nil, ErrUnknownCurrency
+	}
+	return s.registerAccount(phone, currency)
+}
+
+// DepositAmount is Deposit that fails with ErrCurrencyMismatch unless the
+// amount is in the currency of the account.
+func (s *Service) DepositAmount(accountID int64, amount types.Amount) error {
+	if !currencies[amount.Currency] {
+		return ErrUnknownCurrency
+	}
+	return s.deposit(accountID, amount, nil)
+}
+
+// PayAmount is Pay that fails with ErrCurrencyMismatch unless the amount is
+// in the currency of the account.
+func (s *Service) PayAmount(accountID int64, amount types.Amount, category types.PaymentCategory) (*types.Payment, error) {
+	if !currencies[amount.Currency] {
+		return nil, ErrUnknownCurrency
+	}
+	return s.pay(accountID, amount, category, nil)
+}
+
+// accountCurrency stands in the amounts of the calls taking a bare
+// types.Money, such as Deposit and Pay, for the currency of the account
+// the amount is booked on. The calls taking a types.Amount never accept it.
+const accountCurrency types.Currency = "<account>"
+
+// inAccountCurrency returns value as an amount in the currency of the
+// account it is booked on.
+func inAccountCurrency(value types.Money) types.Amount {
+	return types.Amount{Value: value, Currency: accountCurrency}
+}
+
+// checkCurrency fails unless amount can be booked on the account.
+func checkCurrency(account *types.Account, amount types.Amount) error {
+	if amount.Currency == accountCurrency {
+		return nil
+	}
+	if !currencies[amount.Currency] {
+		return ErrUnknownCurrency
+	}
+	if amount.Currency != currencyOf(account) {
+		return ErrCurrencyMismatch
+	}
+	return nil
+}
+
+// currencyOf returns the currency of the account. Accounts read from dumps
+// written before accounts had currencies have none and hold the default
+// currency.
+func currencyOf(account *types.Account) types.Currency {
+	if account.Currency == "" {
+		return DefaultCurrency
+	}
+	return account.Currency
+}
+
+// currencyLedger returns the system or merchant ledger account that holds
+// the money of the currency, so that every ledger account stays in one
+// currency. The default currency uses the ledger accounts as they are.
+func currencyLedger(ledger types.LedgerAccount, currency types.Currency) types.LedgerAccount {
+	if currency == "" || currency == DefaultCurrency {
+		return ledger
+	}
+	return ledger + types.LedgerAccount("@"+currency)
+}
@@ -0,0 +1,199 @@
+package wallet
+
+import (
+	"math"
+	"testing"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func TestService_RegisterAccountIn(t *testing.T) {
+	svc := &Service{}
+	account, err := svc.RegisterAccountIn("+992000000001", types.CurrencyUSD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Currency != types.CurrencyUSD {
+		t.Errorf("\ngot > %v \nwant > %v", account.Currency, types.CurrencyUSD)
+	}
+	_, err = svc.RegisterAccountIn("+992000000002", "EUR")
+	if err != ErrUnknownCurrency {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrUnknownCurrency)
+	}
+
+	account, err = svc.RegisterAccount("+992000000003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Currency != DefaultCurrency {
+		t.Errorf("\ngot > %v \nwant > %v", account.Currency, DefaultCurrency)
+	}
+}
+
+func TestService_PayAmount_currencyMismatch(t *testing.T) {
+	svc := &Service{}
+	account, err := svc.RegisterAccountIn("+992000000001", types.CurrencyRUB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.DepositAmount(account.ID, types.Amount{Value: 100, Currency: types.CurrencyUSD})
+	if err != ErrCurrencyMismatch {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrCurrencyMismatch)
+	}
+	err = svc.DepositAmount(account.ID, types.Amount{Value: 100, Currency: types.CurrencyRUB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.PayAmount(account.ID, types.Amount{Value: 30, Currency: types.CurrencyTJS}, "auto")
+	if err != ErrCurrencyMismatch {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrCurrencyMismatch)
+	}
+	payment, err := svc.PayAmount(account.ID, types.Amount{Value: 30, Currency: types.CurrencyRUB}, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, svc, account.ID, 70)
+
+	// the money of other currencies goes to their own system accounts
+	err = svc.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balances := map[types.LedgerAccount]types.Money{
+		LedgerCashIn + "@RUB":           -100,
+		MerchantLedger("auto") + "@RUB": 30,
+		LedgerRefunds + "@RUB":          -30,
+		LedgerCashIn:                    0,
+	}
+	for ledger, want := range balances {
+		got, err := svc.LedgerBalance(ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("wrong balance of %v\ngot > %v \nwant > %v", ledger, got, want)
+		}
+	}
+}
+
+func TestService_Transfer_currencyMismatch(t *testing.T) {
+	w := newTestWallet(t)
+	from := w.accountIn("+992000000001", types.CurrencyUSD, 100)
+	to := w.account("+992000000002", 0)
+	svc := w.Service
+
+	_, err := svc.Transfer(from.ID, to.ID, 10)
+	if err != ErrCurrencyMismatch {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrCurrencyMismatch)
+	}
+	checkBalance(t, svc, from.ID, 100)
+}
+
+func TestService_Convert(t *testing.T) {
+	svc := &Service{}
+	_, err := svc.Convert(types.Amount{Value: 100, Currency: types.CurrencyUSD}, types.CurrencyTJS)
+	if err != ErrRateNotFound {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrRateNotFound)
+	}
+
+	rates := NewStaticRates()
+	rates.Set(types.CurrencyUSD, types.CurrencyTJS, 10.95)
+	svc.SetExchangeRates(rates)
+
+	tests := []struct {
+		amount types.Amount
+		to     types.Currency
+		want   types.Amount
+		err    error
+	}{
+		{types.Amount{Value: 100, Currency: types.CurrencyUSD}, types.CurrencyTJS, types.Amount{Value: 1095, Currency: types.CurrencyTJS}, nil},
+		{types.Amount{Value: 1095, Currency: types.CurrencyTJS}, types.CurrencyUSD, types.Amount{Value: 100, Currency: types.CurrencyUSD}, nil},
+		{types.Amount{Value: 7, Currency: types.CurrencyRUB}, types.CurrencyRUB, types.Amount{Value: 7, Currency: types.CurrencyRUB}, nil},
+		{types.Amount{Value: 7, Currency: types.CurrencyRUB}, types.CurrencyUSD, types.Amount{}, ErrRateNotFound},
+		{types.Amount{Value: 7, Currency: "EUR"}, types.CurrencyUSD, types.Amount{}, ErrUnknownCurrency},
+	}
+	for _, test := range tests {
+		got, err := svc.Convert(test.amount, test.to)
+		if err != test.err || got != test.want {
+			t.Errorf("Convert(%v, %v) => %v, %v want => %v, %v", test.amount, test.to, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestService_Convert_exact(t *testing.T) {
+	svc := &Service{}
+	rates := NewStaticRates()
+	rates.Set(types.CurrencyUSD, types.CurrencyRUB, 0.5)
+	rates.Set(types.CurrencyTJS, types.CurrencyRUB, 1)
+	svc.SetExchangeRates(rates)
+
+	tests := []struct {
+		amount types.Amount
+		to     types.Currency
+		want   types.Amount
+		err    error
+	}{
+		{types.Amount{Value: 1<<53 + 1, Currency: types.CurrencyTJS}, types.CurrencyRUB, types.Amount{Value: 1<<53 + 1, Currency: types.CurrencyRUB}, nil},
+		{types.Amount{Value: 3, Currency: types.CurrencyUSD}, types.CurrencyRUB, types.Amount{Value: 2, Currency: types.CurrencyRUB}, nil},
+		{types.Amount{Value: -3, Currency: types.CurrencyUSD}, types.CurrencyRUB, types.Amount{Value: -2, Currency: types.CurrencyRUB}, nil},
+		{types.Amount{Value: math.MaxInt64, Currency: types.CurrencyRUB}, types.CurrencyUSD, types.Amount{}, ErrAmountOverflow},
+		{types.Amount{Value: 7}, types.CurrencyUSD, types.Amount{}, ErrUnknownCurrency},
+	}
+	for _, test := range tests {
+		got, err := svc.Convert(test.amount, test.to)
+		if err != test.err || got != test.want {
+			t.Errorf("Convert(%v, %v) => %v, %v want => %v, %v", test.amount, test.to, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestService_DepositAmount_noCurrency(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+
+	err := w.DepositAmount(account.ID, types.Amount{Value: 10})
+	if err != ErrUnknownCurrency {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrUnknownCurrency)
+	}
+	_, err = w.PayAmount(account.ID, types.Amount{Value: 10, Currency: accountCurrency}, "auto")
+	if err != ErrUnknownCurrency {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrUnknownCurrency)
+	}
+	checkBalance(t, w.Service, account.ID, 100)
+}
+
+func TestService_Currency_survivesExportImport(t *testing.T) {
+	svc := &Service{}
+	account, err := svc.RegisterAccountIn("+992000000001", types.CurrencyUSD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = svc.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := &Service{}
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := imported.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Currency != types.CurrencyUSD {
+		t.Errorf("\ngot > %v \nwant > %v", got.Currency, types.CurrencyUSD)
+	}
+
+	accounts, err := decodeAccounts("1;+992000000001;10|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accounts[0].Currency != DefaultCurrency {
+		t.Errorf("legacy account\ngot > %v \nwant > %v", accounts[0].Currency, DefaultCurrency)
+	}
+}
@@ -0,0 +1,704 @@
+package wallet
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// The dump format used by Export and Import. A dump starts with the header
+// line
+//
+//	wallet-dump v2 <collection>
+//
+// followed by one line per record:
+//
+//	<crc32> <field>;<field>;...
+//
+// where crc32 is the IEEE CRC-32 of the rest of the line in 8 hex digits. In
+// a field "\", ";", "|", CR and LF are escaped as "\\", "\;", "\|", "\r"
+// and "\n".
+//
+// Dumps written before the header existed keep every record on one line:
+// fields are separated by ";", every record is terminated by "|" and nothing
+// is escaped. They are still read.
+
+const (
+	accountsDump    = "accounts.dump"
+	paymentsDump    = "payments.dump"
+	favoritesDump   = "favorites.dump"
+	ledgerDump      = "ledger.dump"
+	idempotencyDump = "idempotency.dump"
+)
+
+const (
+	dumpMagic   = "wallet-dump"
+	dumpVersion = 2
+)
+
+var (
+	ErrUnsupportedDumpVersion = errors.New("unsupported dump version")
+	ErrDumpChecksum           = errors.New("dump record checksum mismatch")
+)
+
+// DumpError reports a malformed record of a dump. Line counts the lines of
+// the dump from 1, header included. Legacy dumps keep all records on one
+// line, so for them Record, the number of the record from 1, tells which
+// one is broken.
+type DumpError struct {
+	Line   int
+	Record int
+	Err    error
+}
+
+func (e *DumpError) Error() string {
+	if e.Record > 0 {
+		return fmt.Sprintf("record %d: %v", e.Record, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *DumpError) Unwrap() error {
+	return e.Err
+}
+
+// walletData holds every collection of the wallet, as written to or read
+// from a set of dump files.
+type walletData struct {
+	accounts  []types.Account
+	payments  []types.Payment
+	favorites []types.Favorite
+	entries   []types.Entry
+	records   []types.IdempotencyRecord
+}
+
+// dumpFile tells how one collection of walletData is stored. fields returns
+// the fields of the i-th record of the collection, add parses the fields of
+// a record and appends it to the collection.
+type dumpFile struct {
+	name       string
+	collection string
+	size       func(data *walletData) int
+	fields     func(data *walletData, i int) []string
+	add        func(data *walletData, fields []string) error
+}
+
+var (
+	accountsFile = dumpFile{
+		name:       accountsDump,
+		collection: "accounts",
+		size:       func(data *walletData) int { return len(data.accounts) },
+		fields:     func(data *walletData, i int) []string { return accountFields(data.accounts[i]) },
+		add: func(data *walletData, fields []string) error {
+			account, err := parseAccount(fields)
+			if err != nil {
+				return err
+			}
+			data.accounts = append(data.accounts, account)
+			return nil
+		},
+	}
+	paymentsFile = dumpFile{
+		name:       paymentsDump,
+		collection: "payments",
+		size:       func(data *walletData) int { return len(data.payments) },
+		fields:     func(data *walletData, i int) []string { return paymentFields(data.payments[i]) },
+		add: func(data *walletData, fields []string) error {
+			payment, err := parsePayment(fields)
+			if err != nil {
+				return err
+			}
+			data.payments = append(data.payments, payment)
+			return nil
+		},
+	}
+	favoritesFile = dumpFile{
+		name:       favoritesDump,
+		collection: "favorites",
+		size:       func(data *walletData) int { return len(data.favorites) },
+		fields:     func(data *walletData, i int) []string { return favoriteFields(data.favorites[i]) },
+		add: func(data *walletData, fields []string) error {
+			favorite, err := parseFavorite(fields)
+			if err != nil {
+				return err
+			}
+			data.favorites = append(data.favorites, favorite)
+			return nil
+		},
+	}
+	ledgerFile = dumpFile{
+		name:       ledgerDump,
+		collection: "ledger",
+		size:       func(data *walletData) int { return len(data.entries) },
+		fields:     func(data *walletData, i int) []string { return entryFields(data.entries[i]) },
+		add: func(data *walletData, fields []string) error {
+			entry, err := parseEntry(fields)
+			if err != nil {
+				return err
+			}
+			data.entries = append(data.entries, entry)
+			return nil
+		},
+	}
+	idempotencyFile = dumpFile{
+		name:       idempotencyDump,
+		collection: "idempotency",
+		size:       func(data *walletData) int { return len(data.records) },
+		fields:     func(data *walletData, i int) []string { return idempotencyRecordFields(data.records[i]) },
+		add: func(data *walletData, fields []string) error {
+			record, err := parseIdempotencyRecord(fields)
+			if err != nil {
+				return err
+			}
+			data.records = append(data.records, record)
+			return nil
+		},
+	}
+)
+
+var dumpFiles = []dumpFile{accountsFile, paymentsFile, favoritesFile, ledgerFile, idempotencyFile}
+
+// write writes the dump of the collection to w one record at a time.
+func (file dumpFile) write(w io.Writer, data *walletData) error {
+	_, err := io.WriteString(w, dumpHeader(file.collection)+"\n")
+	if err != nil {
+		return err
+	}
+	for i := 0; i < file.size(data); i++ {
+		_, err := io.WriteString(w, encodeDumpLine(file.fields(data, i))+"\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read parses a dump of the collection, in either format, and appends its
+// records to data. An empty dump holds no records.
+func (file dumpFile) read(r io.Reader, data *walletData) error {
+	reader := bufio.NewReader(r)
+	prefix, err := reader.Peek(len(dumpMagic) + 1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if string(prefix) != dumpMagic+" " {
+		return file.readLegacy(reader, data)
+	}
+
+	for number := 1; ; number++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if number == 1 {
+			err = checkDumpHeader(line, file.collection)
+		} else if line == "" {
+			err = errors.New("empty line")
+		} else {
+			var fields []string
+			fields, err = decodeDumpLine(line)
+			if err == nil {
+				err = file.add(data, fields)
+			}
+		}
+		if err != nil {
+			return &DumpError{Line: number, Err: err}
+		}
+	}
+}
+
+func (file dumpFile) readLegacy(reader *bufio.Reader, data *walletData) error {
+	for number := 1; ; number++ {
+		record, err := reader.ReadString('|')
+		if err == io.EOF {
+			if record != "" {
+				return &DumpError{Record: number, Err: fmt.Errorf("record %q is not terminated by \"|\"", record)}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = file.add(data, strings.Split(strings.TrimSuffix(record, "|"), ";"))
+		if err != nil {
+			return &DumpError{Record: number, Err: err}
+		}
+	}
+}
+
+// encode returns the dump of the collection.
+func (file dumpFile) encode(data *walletData) string {
+	builder := strings.Builder{}
+	// writing to a strings.Builder never fails
+	_ = file.write(&builder, data)
+	return builder.String()
+}
+
+// decode parses a dump of the collection held in content.
+func (file dumpFile) decode(data *walletData, content string) error {
+	return file.read(strings.NewReader(content), data)
+}
+func dumpHeader(collection string) string {
+	return dumpMagic + " v" + strconv.Itoa(dumpVersion) + " " + collection
+}
+
+func checkDumpHeader(header string, collection string) error {
+	parts := strings.Fields(header)
+	if len(parts) != 3 || parts[0] != dumpMagic || !strings.HasPrefix(parts[1], "v") {
+		return fmt.Errorf("bad dump header %q", header)
+	}
+	version, err := strconv.Atoi(parts[1][1:])
+	if err != nil {
+		return fmt.Errorf("bad dump header %q", header)
+	}
+	if version != dumpVersion {
+		return fmt.Errorf("%w %d", ErrUnsupportedDumpVersion, version)
+	}
+	if parts[2] != collection {
+		return fmt.Errorf("dump holds %s, not %s", parts[2], collection)
+	}
+	return nil
+}
+
+var dumpEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, "|", `\|`, "\r", `\r`, "\n", `\n`)
+
+// encodeDumpLine escapes the fields, joins them and puts the checksum in
+// front.
+func encodeDumpLine(fields []string) string {
+	record := joinDumpRecord(fields)
+	return fmt.Sprintf("%08x %s", crc32.ChecksumIEEE([]byte(record)), record)
+}
+
+// decodeDumpLine checks the checksum of the line and splits it into
+// unescaped fields.
+func decodeDumpLine(line string) ([]string, error) {
+	if len(line) < 9 || line[8] != ' ' {
+		return nil, errors.New("missing checksum")
+	}
+	sum, err := strconv.ParseUint(line[:8], 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad checksum %q", line[:8])
+	}
+	record := line[9:]
+	if crc32.ChecksumIEEE([]byte(record)) != uint32(sum) {
+		return nil, ErrDumpChecksum
+	}
+	return splitDumpRecord(record)
+}
+
+// joinDumpRecord escapes the fields and joins them with ";".
+func joinDumpRecord(fields []string) string {
+	escaped := make([]string, len(fields))
+	for i, field := range fields {
+		escaped[i] = dumpEscaper.Replace(field)
+	}
+	return strings.Join(escaped, ";")
+}
+
+// splitDumpRecord splits a record joined by joinDumpRecord into unescaped
+// fields.
+func splitDumpRecord(record string) ([]string, error) {
+	var fields []string
+	field := strings.Builder{}
+	for i := 0; i < len(record); i++ {
+		c := record[i]
+		switch c {
+		case ';':
+			fields = append(fields, field.String())
+			field.Reset()
+		case '\\':
+			i++
+			if i == len(record) {
+				return nil, errors.New("escape at the end of the line")
+			}
+			switch record[i] {
+			case '\\', ';', '|':
+				field.WriteByte(record[i])
+			case 'r':
+				field.WriteByte('\r')
+			case 'n':
+				field.WriteByte('\n')
+			default:
+				return nil, fmt.Errorf("unknown escape \\%c", record[i])
+			}
+		default:
+			field.WriteByte(c)
+		}
+	}
+	return append(fields, field.String()), nil
+}
+
+// checkFields fails if a record has fewer fields than a dump of any version
+// has for it.
+func checkFields(fields []string, min int) error {
+	if len(fields) < min {
+		return fmt.Errorf("want at least %d fields, got %d", min, len(fields))
+	}
+	return nil
+}
+
+// walletReader lists the collections of a Repository or a Tx.
+type walletReader interface {
+	Accounts() ([]types.Account, error)
+	Payments() ([]types.Payment, error)
+	Favorites() ([]types.Favorite, error)
+	Entries() ([]types.Entry, error)
+	IdempotencyRecords() ([]types.IdempotencyRecord, error)
+}
+
+// fetchWalletData reads every collection of the repository or of the
+// transaction.
+func fetchWalletData(repo walletReader) (data *walletData, err error) {
+	data = &walletData{}
+	data.accounts, err = repo.Accounts()
+	if err != nil {
+		return nil, err
+	}
+	data.payments, err = repo.Payments()
+	if err != nil {
+		return nil, err
+	}
+	data.favorites, err = repo.Favorites()
+	if err != nil {
+		return nil, err
+	}
+	data.entries, err = repo.Entries()
+	if err != nil {
+		return nil, err
+	}
+	data.records, err = repo.IdempotencyRecords()
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// save stores every record of data through tx.
+func (data *walletData) save(tx Tx) error {
+	for _, account := range data.accounts {
+		if err := tx.SaveAccount(account); err != nil {
+			return err
+		}
+	}
+	for _, payment := range data.payments {
+		if err := tx.SavePayment(payment); err != nil {
+			return err
+		}
+	}
+	for _, favorite := range data.favorites {
+		if err := tx.SaveFavorite(favorite); err != nil {
+			return err
+		}
+	}
+	for _, entry := range data.entries {
+		if err := tx.SaveEntry(entry); err != nil {
+			return err
+		}
+	}
+	for _, record := range data.records {
+		if err := tx.SaveIdempotencyRecord(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete removes every record of data through tx.
+func (data *walletData) delete(tx Tx) error {
+	for _, record := range data.records {
+		if err := tx.DeleteIdempotencyRecord(record.Key); err != nil {
+			return err
+		}
+	}
+	for _, entry := range data.entries {
+		if err := tx.DeleteEntry(entry.ID); err != nil {
+			return err
+		}
+	}
+	for _, favorite := range data.favorites {
+		if err := tx.DeleteFavorite(favorite.ID); err != nil {
+			return err
+		}
+	}
+	for _, payment := range data.payments {
+		if err := tx.DeletePayment(payment.ID); err != nil {
+			return err
+		}
+	}
+	for _, account := range data.accounts {
+		if err := tx.DeleteAccount(account.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func accountFields(account types.Account) []string {
+	return []string{
+		strconv.FormatInt(account.ID, 10),
+		string(account.Phone),
+		strconv.FormatInt(int64(account.Balance), 10),
+		string(account.Currency),
+	}
+}
+
+func parseAccount(fields []string) (types.Account, error) {
+	if err := checkFields(fields, 3); err != nil {
+		return types.Account{}, err
+	}
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return types.Account{}, err
+	}
+	balance, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return types.Account{}, err
+	}
+	// accounts of older dumps are in the default currency
+	currency := DefaultCurrency
+	if len(fields) > 3 && fields[3] != "" {
+		currency = types.Currency(fields[3])
+	}
+	return types.Account{
+		ID:       id,
+		Phone:    types.Phone(fields[1]),
+		Balance:  types.Money(balance),
+		Currency: currency,
+	}, nil
+}
+
+func paymentFields(payment types.Payment) []string {
+	return []string{
+		payment.ID,
+		strconv.FormatInt(payment.AccountID, 10),
+		strconv.FormatInt(int64(payment.Amount), 10),
+		string(payment.Category),
+		string(payment.Status),
+		payment.LinkedPaymentID,
+		encodeTransitions(payment.Transitions),
+		encodeTime(payment.CreatedAt),
+		encodeTime(payment.UpdatedAt),
+		payment.FavoriteID,
+	}
+}
+
+func parsePayment(fields []string) (types.Payment, error) {
+	if err := checkFields(fields, 5); err != nil {
+		return types.Payment{}, err
+	}
+	accountID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return types.Payment{}, err
+	}
+	amount, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return types.Payment{}, err
+	}
+	payment := types.Payment{
+		ID:        fields[0],
+		AccountID: accountID,
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(fields[3]),
+		Status:    types.PaymentStatus(fields[4]),
+	}
+
+	// older dumps have neither linked payments, transitions nor
+	// timestamps
+	if len(fields) > 5 {
+		payment.LinkedPaymentID = fields[5]
+	}
+	if len(fields) > 6 {
+		payment.Transitions, err = decodeTransitions(fields[6])
+		if err != nil {
+			return types.Payment{}, err
+		}
+	}
+	if len(fields) > 8 {
+		payment.CreatedAt, err = decodeTime(fields[7])
+		if err != nil {
+			return types.Payment{}, err
+		}
+		payment.UpdatedAt, err = decodeTime(fields[8])
+		if err != nil {
+			return types.Payment{}, err
+		}
+	}
+	if len(fields) > 9 {
+		payment.FavoriteID = fields[9]
+	}
+	return payment, nil
+}
+
+// encodeTransitions writes the transitions as STATUS@time pairs separated
+// by ",".
+func encodeTransitions(transitions []types.PaymentTransition) string {
+	data := ""
+	for i, transition := range transitions {
+		if i > 0 {
+			data += ","
+		}
+		data += string(transition.Status) + "@" + transition.At.Format(time.RFC3339Nano)
+	}
+	return data
+}
+
+func decodeTransitions(data string) ([]types.PaymentTransition, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	var result []types.PaymentTransition
+	for _, transition := range strings.Split(data, ",") {
+		value := strings.SplitN(transition, "@", 2)
+		if len(value) != 2 {
+			return nil, fmt.Errorf("bad payment transition %q", transition)
+		}
+		at, err := time.Parse(time.RFC3339Nano, value[1])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, types.PaymentTransition{
+			Status: types.PaymentStatus(value[0]),
+			At:     at,
+		})
+	}
+	return result, nil
+}
+
+// encodeTime writes the time as RFC 3339; the zero time, which records
+// imported from older dumps have, is written as an empty field.
+func encodeTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func decodeTime(data string) (time.Time, error) {
+	if data == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, data)
+}
+
+func favoriteFields(favorite types.Favorite) []string {
+	return []string{
+		favorite.ID,
+		strconv.FormatInt(favorite.AccountID, 10),
+		favorite.Name,
+		strconv.FormatInt(int64(favorite.Amount), 10),
+		string(favorite.Category),
+		encodeTime(favorite.CreatedAt),
+		encodeTime(favorite.UpdatedAt),
+	}
+}
+
+func parseFavorite(fields []string) (types.Favorite, error) {
+	if err := checkFields(fields, 5); err != nil {
+		return types.Favorite{}, err
+	}
+	accountID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return types.Favorite{}, err
+	}
+	amount, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return types.Favorite{}, err
+	}
+	favorite := types.Favorite{
+		ID:        fields[0],
+		AccountID: accountID,
+		Name:      fields[2],
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(fields[4]),
+	}
+
+	// older dumps have no timestamps
+	if len(fields) > 6 {
+		favorite.CreatedAt, err = decodeTime(fields[5])
+		if err != nil {
+			return types.Favorite{}, err
+		}
+		favorite.UpdatedAt, err = decodeTime(fields[6])
+		if err != nil {
+			return types.Favorite{}, err
+		}
+	}
+	return favorite, nil
+}
+
+func entryFields(entry types.Entry) []string {
+	return []string{
+		entry.ID,
+		entry.TransactionID,
+		string(entry.Account),
+		string(entry.Side),
+		strconv.FormatInt(int64(entry.Amount), 10),
+		entry.PaymentID,
+		encodeTime(entry.CreatedAt),
+	}
+}
+
+func parseEntry(fields []string) (types.Entry, error) {
+	if err := checkFields(fields, 6); err != nil {
+		return types.Entry{}, err
+	}
+	amount, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return types.Entry{}, err
+	}
+	entry := types.Entry{
+		ID:            fields[0],
+		TransactionID: fields[1],
+		Account:       types.LedgerAccount(fields[2]),
+		Side:          types.EntrySide(fields[3]),
+		Amount:        types.Money(amount),
+		PaymentID:     fields[5],
+	}
+
+	// older dumps have no posting time
+	if len(fields) > 6 {
+		entry.CreatedAt, err = decodeTime(fields[6])
+		if err != nil {
+			return types.Entry{}, err
+		}
+	}
+	return entry, nil
+}
+
+func idempotencyRecordFields(record types.IdempotencyRecord) []string {
+	return []string{
+		record.Key,
+		record.Request,
+		record.PaymentID,
+		record.CreatedAt.Format(time.RFC3339Nano),
+	}
+}
+
+func parseIdempotencyRecord(fields []string) (types.IdempotencyRecord, error) {
+	if err := checkFields(fields, 4); err != nil {
+		return types.IdempotencyRecord{}, err
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, fields[3])
+	if err != nil {
+		return types.IdempotencyRecord{}, err
+	}
+	return types.IdempotencyRecord{
+		Key:       fields[0],
+		Request:   fields[1],
+		PaymentID: fields[2],
+		CreatedAt: createdAt,
+	}, nil
+}
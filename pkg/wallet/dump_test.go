@@ -0,0 +1,164 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func TestDumpFile_roundTripEscapes(t *testing.T) {
+	at := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	data := &walletData{
+		favorites: []types.Favorite{{
+			ID:        "f1",
+			AccountID: 1,
+			Name:      "home; sweet|home\nwith a \\ and\r",
+			Amount:    10,
+			Category:  "a;b|c",
+			CreatedAt: at,
+			UpdatedAt: at,
+		}},
+	}
+
+	content := favoritesFile.encode(data)
+	if !strings.HasPrefix(content, "wallet-dump v2 favorites\n") {
+		t.Errorf("wrong header => %q", content)
+	}
+	if strings.Count(content, "\n") != 2 {
+		t.Errorf("record is not on one line => %q", content)
+	}
+
+	favorites, err := decodeFavorites(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(favorites, data.favorites) {
+		t.Errorf("\ngot > %v \nwant > %v", favorites, data.favorites)
+	}
+}
+
+func TestDumpFile_checksumMismatch(t *testing.T) {
+	content := encodeAccounts([]types.Account{
+		{ID: 1, Phone: "+992000000001", Balance: 10, Currency: types.CurrencyTJS},
+		{ID: 2, Phone: "+992000000002", Balance: 20, Currency: types.CurrencyTJS},
+	})
+	content = strings.Replace(content, "+992000000002;20", "+992000000002;99", 1)
+
+	_, err := decodeAccounts(content)
+	if !errors.Is(err, ErrDumpChecksum) {
+		t.Fatalf("\ngot > %v \nwant > %v", err, ErrDumpChecksum)
+	}
+	var dumpErr *DumpError
+	if !errors.As(err, &dumpErr) || dumpErr.Line != 3 {
+		t.Errorf("wrong line => %v", err)
+	}
+}
+
+func TestDumpFile_unsupportedVersion(t *testing.T) {
+	_, err := decodeAccounts("wallet-dump v3 accounts\n")
+	if !errors.Is(err, ErrUnsupportedDumpVersion) {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrUnsupportedDumpVersion)
+	}
+	_, err = decodeAccounts("wallet-dump v2 payments\n")
+	if err == nil {
+		t.Error("dump of payments is decoded as accounts")
+	}
+}
+
+func TestDumpFile_shortRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    dumpFile
+		content string
+		record  int
+		line    int
+	}{
+		{"legacy account", accountsFile, "1;+992000000001;10|2|", 2, 0},
+		{"legacy payment", paymentsFile, "p1;1|", 1, 0},
+		{"legacy favorite", favoritesFile, "f1;1;home|", 1, 0},
+		{"legacy entry", ledgerFile, "e1;t1;cash|", 1, 0},
+		{"legacy record", idempotencyFile, "key|", 1, 0},
+		{"unterminated", accountsFile, "1;+992000000001;10", 1, 0},
+		{"account", accountsFile, "wallet-dump v2 accounts\n" + encodeDumpLine([]string{"1"}) + "\n", 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.file.decode(&walletData{}, test.content)
+			var dumpErr *DumpError
+			if !errors.As(err, &dumpErr) {
+				t.Fatalf("\ngot > %v \nwant > *DumpError", err)
+			}
+			if dumpErr.Record != test.record || dumpErr.Line != test.line {
+				t.Errorf("wrong position => %v", err)
+			}
+		})
+	}
+}
+
+func TestService_Import_legacyDumps(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		accountsDump:  "1;+992000000001;90|",
+		paymentsDump:  "p1;1;10;auto;INPROGRESS|",
+		favoritesDump: "f1;1;car;10;auto|",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var svc Service
+	err := svc.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := svc.FindAccountByID(1)
+	if err != nil || account.Balance != 90 || account.Currency != DefaultCurrency {
+		t.Errorf("wrong account => %v, err => %v", account, err)
+	}
+	if _, err := svc.FindPaymentByID("p1"); err != nil {
+		t.Errorf("legacy payment is not imported, err => %v", err)
+	}
+	if _, err := svc.PayFromFavorite("f1"); err != nil {
+		t.Errorf("legacy favorite is not imported, err => %v", err)
+	}
+}
+
+func TestService_Import_reportsFileAndLine(t *testing.T) {
+	dir := t.TempDir()
+	content := "wallet-dump v2 accounts\n00000000 1;+992000000001;10;TJS\n"
+	err := os.WriteFile(filepath.Join(dir, accountsDump), []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var svc Service
+	err = svc.Import(dir)
+	if err == nil || !strings.Contains(err.Error(), accountsDump+": line 2") {
+		t.Errorf("wrong error => %v", err)
+	}
+}
+
+func encodeAccounts(accounts []types.Account) string {
+	return accountsFile.encode(&walletData{accounts: accounts})
+}
+
+func decodeAccounts(content string) ([]types.Account, error) {
+	data := &walletData{}
+	err := accountsFile.decode(data, content)
+	return data.accounts, err
+}
+
+func decodeFavorites(content string) ([]types.Favorite, error) {
+	data := &walletData{}
+	err := favoritesFile.decode(data, content)
+	return data.favorites, err
+}
@@ -0,0 +1,502 @@
+package wallet
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	ErrWrongKey          = errors.New("export is encrypted with another key")
+	ErrTamperedExport    = errors.New("encrypted export was tampered with")
+	ErrUnencryptedExport = errors.New("export is not encrypted")
+)
+
+// Compression is the compression of the exported files.
+type Compression int
+
+const (
+	CompressNone Compression = iota
+	CompressGzip
+	CompressZstd
+)
+
+// ExportEncoding tells how the service stores the files it exports: they
+// are compressed first and then encrypted when Keys is set. The manifest
+// stays plain; its checksums are those of the stored files, and with Keys
+// set it is authenticated with the encryption key.
+//
+// Imports recognize compressed and encrypted files by their content and
+// decode them with the same Keys, so the compression can be changed
+// without making older exports unreadable. Once Keys is set, imports
+// refuse files that are not encrypted and manifests that are not
+// authenticated with ErrUnencryptedExport, so that an export can't be
+// swapped for a plain one; plain exports are read by a service without
+// Keys.
+type ExportEncoding struct {
+	Compression Compression
+	Keys        KeyProvider
+}
+
+// KeyProvider supplies the AES keys of encrypted exports. A key is 16, 24
+// or 32 bytes long. Its ID is stored in the files encrypted with it, so
+// that keys can be rotated while the older exports stay readable.
+type KeyProvider interface {
+	// EncryptionKey returns the key new exports are encrypted with.
+	EncryptionKey() (id string, key []byte, err error)
+	// DecryptionKey returns the key with the id, or ErrWrongKey when the
+	// provider does not have it.
+	DecryptionKey(id string) ([]byte, error)
+}
+
+// StaticKey returns a KeyProvider that always uses key.
+func StaticKey(key []byte) KeyProvider {
+	return staticKey(key)
+}
+
+type staticKey []byte
+
+const staticKeyID = "static"
+
+func (k staticKey) EncryptionKey() (string, []byte, error) {
+	return staticKeyID, k, nil
+}
+
+func (k staticKey) DecryptionKey(id string) ([]byte, error) {
+	if id != staticKeyID {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrWrongKey, id)
+	}
+	return k, nil
+}
+
+// SetExportEncoding makes the service compress and encrypt the files of
+// its exports as encoding says. The imports decrypt with encoding.Keys.
+func (s *Service) SetExportEncoding(encoding ExportEncoding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoding = encoding
+}
+
+func (s *Service) exportEncoding() ExportEncoding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoding
+}
+
+// encoder returns a writer encoding the file name into w. Closing it
+// finishes the encoding but leaves w open.
+func (s *Service) encoder(w io.Writer, name string) (io.WriteCloser, error) {
+	encoding := s.exportEncoding()
+
+	var encrypted io.WriteCloser = nopWriteCloser{w}
+	if encoding.Keys != nil {
+		id, key, err := encoding.Keys.EncryptionKey()
+		if err != nil {
+			return nil, err
+		}
+		encrypted, err = newEncryptWriter(w, name, id, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var compressed io.WriteCloser
+	switch encoding.Compression {
+	case CompressNone:
+		return encrypted, nil
+	case CompressGzip:
+		compressed = gzip.NewWriter(encrypted)
+	case CompressZstd:
+		encoder, err := zstd.NewWriter(encrypted, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		compressed = encoder
+	default:
+		return nil, fmt.Errorf("unknown compression %d", encoding.Compression)
+	}
+	return chainedWriter{WriteCloser: compressed, next: encrypted}, nil
+}
+
+// decoder returns a reader of the file name read from r, decrypting and
+// decompressing it when it is encrypted or compressed. Closing it leaves r
+// open.
+func (s *Service) decoder(r io.Reader, name string) (io.ReadCloser, error) {
+	return decodeFile(r, name, s.exportEncoding().Keys)
+}
+
+// decodeFile is the decoder of a service whose imports decrypt with keys.
+func decodeFile(r io.Reader, name string, keys KeyProvider) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	var plain io.Reader = buffered
+	if keys != nil && !peekPrefix(buffered, encryptedMagic) {
+		return nil, ErrUnencryptedExport
+	}
+	if peekPrefix(buffered, encryptedMagic) {
+		decrypted, err := newDecryptReader(buffered, name, keys)
+		if err != nil {
+			return nil, err
+		}
+		buffered = bufio.NewReader(decrypted)
+		plain = buffered
+	}
+
+	switch {
+	case peekPrefix(buffered, gzipMagic):
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return reader, nil
+	case peekPrefix(buffered, zstdMagic):
+		decoder, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return io.NopCloser(plain), nil
+}
+
+var (
+	gzipMagic = "\x1f\x8b"
+	zstdMagic = "\x28\xb5\x2f\xfd"
+)
+
+func peekPrefix(r *bufio.Reader, prefix string) bool {
+	head, _ := r.Peek(len(prefix))
+	return string(head) == prefix
+}
+
+// encodingSink encodes the files created in sink as the export encoding of
+// the service says.
+type encodingSink struct {
+	sink FileSink
+	s    *Service
+}
+
+func (s *Service) encodingSink(sink FileSink) FileSink {
+	return encodingSink{sink: sink, s: s}
+}
+
+func (e encodingSink) Create(name string) (io.WriteCloser, error) {
+	file, err := e.sink.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := e.s.encoder(file, name)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return chainedWriter{WriteCloser: encoder, next: file}, nil
+}
+
+// decodingFS decodes the files of fsys opened for reading, decrypting them
+// with keys.
+type decodingFS struct {
+	fsys fs.FS
+	keys KeyProvider
+}
+
+func (s *Service) decodingFS(fsys fs.FS) fs.FS {
+	return decodingFS{fsys: fsys, keys: s.exportEncoding().Keys}
+}
+
+func (d decodingFS) Open(name string) (fs.File, error) {
+	file, err := d.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := decodeFile(file, name, d.keys)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return decodedFile{File: file, decoder: decoder}, nil
+}
+
+// decodedFile reads the decoded content of File.
+type decodedFile struct {
+	fs.File
+	decoder io.ReadCloser
+}
+
+func (f decodedFile) Read(p []byte) (int, error) {
+	return f.decoder.Read(p)
+}
+
+func (f decodedFile) Close() error {
+	err := f.decoder.Close()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// chainedWriter closes next after the writer itself.
+type chainedWriter struct {
+	io.WriteCloser
+	next io.Closer
+}
+
+func (w chainedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if cerr := w.next.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// An encrypted file starts with the line
+//
+//	wallet-encrypted v1 <key ID> <key check>
+//
+// and a random nonce prefix, followed by the content in chunks sealed with
+// AES-GCM. Every chunk is stored as its 4-byte big-endian length and the
+// sealed bytes. The nonce of a chunk is the prefix, the 4-byte number of
+// the chunk and a byte telling whether the chunk is the last one, so that
+// chunks cannot be reordered, dropped or cut off unnoticed. The header and
+// the file name are authenticated with every chunk. The key check tells a
+// wrong key from tampered data.
+const (
+	encryptedMagic   = "wallet-encrypted "
+	encryptedVersion = "v1"
+	encryptedChunk   = 64 << 10
+	noncePrefixSize  = 7
+)
+
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyCheck identifies key without revealing it.
+func keyCheck(key []byte) string {
+	sum := sha256.Sum256(append([]byte("wallet export key\n"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	nonce   []byte
+	counter uint32
+	chunk   []byte
+	sealed  []byte
+}
+
+func newEncryptWriter(w io.Writer, name string, id string, key []byte) (*encryptWriter, error) {
+	if id == "" || strings.ContainsAny(id, " \r\n") {
+		return nil, fmt.Errorf("bad key ID %q", id)
+	}
+	aead, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte(encryptedMagic + encryptedVersion + " " + id + " " + keyCheck(key) + "\n")
+	prefix := make([]byte, noncePrefixSize)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		aad:   append(header, name...),
+		nonce: append(prefix, make([]byte, aead.NonceSize()-noncePrefixSize)...),
+		chunk: make([]byte, 0, encryptedChunk),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is sealed only once more content follows: the
+		// last chunk is sealed by Close.
+		if len(e.chunk) == encryptedChunk {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.chunk[len(e.chunk):cap(e.chunk)], p)
+		e.chunk = e.chunk[:len(e.chunk)+n]
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close seals the last chunk, which may be empty.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("encrypted file is too large")
+	}
+	setChunkNonce(e.nonce, e.counter, last)
+	e.counter++
+
+	e.sealed = append(e.sealed[:0], 0, 0, 0, 0)
+	e.sealed = e.aead.Seal(e.sealed, e.nonce, e.chunk, e.aad)
+	binary.BigEndian.PutUint32(e.sealed, uint32(len(e.sealed)-4))
+	e.chunk = e.chunk[:0]
+
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+func setChunkNonce(nonce []byte, counter uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	nonce   []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+func newDecryptReader(r *bufio.Reader, name string, keys KeyProvider) (*decryptReader, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: header is cut off", ErrTamperedExport)
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, encryptedMagic))
+	if len(fields) == 0 || fields[0] != encryptedVersion {
+		return nil, fmt.Errorf("unsupported encryption %q", strings.TrimSpace(line))
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("%w: bad header %q", ErrTamperedExport, strings.TrimSpace(line))
+	}
+	id, check := fields[1], fields[2]
+
+	if keys == nil {
+		return nil, fmt.Errorf("%w %q: no key is set", ErrWrongKey, id)
+	}
+	key, err := keys.DecryptionKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if keyCheck(key) != check {
+		return nil, fmt.Errorf("%w %q", ErrWrongKey, id)
+	}
+	aead, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	_, err = io.ReadFull(r, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header is cut off", ErrTamperedExport)
+	}
+
+	header := append([]byte(line), prefix...)
+	return &decryptReader{
+		r:     r,
+		aead:  aead,
+		aad:   append(header, name...),
+		nonce: append(prefix, make([]byte, aead.NonceSize()-noncePrefixSize)...),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk. The chunk is the last one when the
+// file ends after it.
+func (d *decryptReader) open() error {
+	var size [4]byte
+	_, err := io.ReadFull(d.r, size[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: file is cut off", ErrTamperedExport)
+	}
+	if err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > encryptedChunk+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("%w: chunk %d is too large", ErrTamperedExport, d.counter)
+	}
+
+	if cap(d.sealed) < int(n) {
+		d.sealed = make([]byte, n)
+	}
+	d.sealed = d.sealed[:n]
+	_, err = io.ReadFull(d.r, d.sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: file is cut off", ErrTamperedExport)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = d.r.Peek(1)
+	last := err == io.EOF
+	if err != nil && !last {
+		return err
+	}
+
+	setChunkNonce(d.nonce, d.counter, last)
+	plain, err := d.aead.Open(d.sealed[:0], d.nonce, d.sealed, d.aad)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d does not authenticate", ErrTamperedExport, d.counter)
+	}
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
@@ -0,0 +1,320 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestService_ExportTo_encodings(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding ExportEncoding
+	}{
+		{"plain", ExportEncoding{}},
+		{"gzip", ExportEncoding{Compression: CompressGzip}},
+		{"zstd", ExportEncoding{Compression: CompressZstd}},
+		{"encrypted", ExportEncoding{Keys: StaticKey(testKey)}},
+		{"zstd encrypted", ExportEncoding{Compression: CompressZstd, Keys: StaticKey(testKey)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newExportService(t)
+			svc.SetExportEncoding(tt.encoding)
+			sink := memorySink{}
+			err := svc.ExportTo(sink)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.encoding.Keys != nil && bytes.Contains(sink["accounts.dump"].Data, []byte("+992000000001")) {
+				t.Error("phones are stored in plain text")
+			}
+
+			imported := &Service{}
+			imported.SetExportEncoding(ExportEncoding{Keys: tt.encoding.Keys})
+			err = imported.ImportFrom(fstest.MapFS(sink), ImportMerge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSameWallet(t, imported, svc)
+		})
+	}
+}
+
+func TestService_ExportJSONCSV_encrypted(t *testing.T) {
+	svc := newExportService(t)
+	svc.SetExportEncoding(ExportEncoding{Compression: CompressGzip, Keys: StaticKey(testKey)})
+
+	json := memorySink{}
+	err := svc.ExportJSONTo(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := memorySink{}
+	err = svc.ExportCSVTo(csv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	imported.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+	err = imported.ImportJSONFrom(fstest.MapFS(json), ImportMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameWallet(t, imported, svc)
+
+	imported = &Service{}
+	imported.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+	err = imported.ImportCSVFrom(fstest.MapFS(csv), ImportMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameWallet(t, imported, svc)
+}
+
+func TestService_ExportToFile_encrypted(t *testing.T) {
+	svc := newExportService(t)
+	svc.SetExportEncoding(ExportEncoding{Compression: CompressZstd, Keys: StaticKey(testKey)})
+	path := filepath.Join(t.TempDir(), "accounts.dump")
+	err := svc.ExportToFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	err = imported.ImportFromFile(path)
+	if !errors.Is(err, ErrWrongKey) {
+		t.Errorf("without a key\ngot > %v \nwant > %v", err, ErrWrongKey)
+	}
+	imported.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+	err = imported.ImportFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := imported.FindAccountByID(1)
+	if err != nil || account.Balance != 80 {
+		t.Errorf("wrong account => %v, err => %v", account, err)
+	}
+}
+
+func TestService_ImportFrom_wrongKey(t *testing.T) {
+	svc := newExportService(t)
+	svc.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+	sink := memorySink{}
+	err := svc.ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	imported.SetExportEncoding(ExportEncoding{Keys: StaticKey([]byte("fedcba9876543210fedcba9876543210"))})
+	err = imported.ImportFrom(fstest.MapFS(sink), ImportMerge)
+	if !errors.Is(err, ErrWrongKey) {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrWrongKey)
+	}
+	if _, err := imported.FindAccountByID(1); err != ErrAccountNotFound {
+		t.Errorf("wallet changed by a failed import, err => %v", err)
+	}
+}
+
+func TestService_ImportFrom_tampered(t *testing.T) {
+	svc := newExportService(t)
+	svc.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+	sink := memorySink{}
+	err := svc.ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts := sink["accounts.dump"].Data
+
+	tests := []struct {
+		name   string
+		tamper func(data []byte) []byte
+	}{
+		{"flipped byte", func(data []byte) []byte {
+			data[len(data)-20] ^= 1
+			return data
+		}},
+		{"cut off", func(data []byte) []byte {
+			return data[:len(data)-1]
+		}},
+		{"empty", func(data []byte) []byte {
+			return data[:bytes.IndexByte(data, '\n')+1+noncePrefixSize]
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The decryption has to notice what the manifest would.
+			imported := &Service{}
+			imported.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+			err := readEncoded(imported, tt.tamper(append([]byte(nil), accounts...)), "accounts.dump")
+			if !errors.Is(err, ErrTamperedExport) {
+				t.Errorf("\ngot > %v \nwant > %v", err, ErrTamperedExport)
+			}
+		})
+	}
+
+	// Files swapped inside an export do not authenticate either.
+	imported := &Service{}
+	imported.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+	err = readEncoded(imported, accounts, "payments.dump")
+	if !errors.Is(err, ErrTamperedExport) {
+		t.Errorf("swapped files\ngot > %v \nwant > %v", err, ErrTamperedExport)
+	}
+
+	// A manifest changed along with the file it lists does not
+	// authenticate.
+	m, err := readManifest(fstest.MapFS(sink), formatDump, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := fstest.MapFS(sink)
+	tampered["accounts.dump"] = &fstest.MapFile{Data: sink["payments.dump"].Data}
+	for i, file := range m.Files {
+		if file.Name == "accounts.dump" {
+			m.Files[i].Size, m.Files[i].SHA256 = fileChecksum(sink["payments.dump"].Data)
+		}
+	}
+	manifests := memorySink{}
+	err = (&manifestSink{sink: manifests, manifest: *m}).writeManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered[manifestName] = manifests[manifestName]
+	err = imported.ImportFrom(tampered, ImportMerge)
+	if !errors.Is(err, ErrTamperedExport) {
+		t.Errorf("changed manifest\ngot > %v \nwant > %v", err, ErrTamperedExport)
+	}
+}
+
+func TestService_ImportFrom_unencrypted(t *testing.T) {
+	svc := newExportService(t)
+	plain := memorySink{}
+	err := svc.ExportTo(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	imported.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+	err = imported.ImportFrom(fstest.MapFS(plain), ImportMerge)
+	if !errors.Is(err, ErrUnencryptedExport) {
+		t.Errorf("plain export\ngot > %v \nwant > %v", err, ErrUnencryptedExport)
+	}
+
+	// A plain file in an encrypted export is refused even when the
+	// manifest is dropped or lists it.
+	svc.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+	sink := memorySink{}
+	err = svc.ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink["accounts.dump"] = plain["accounts.dump"]
+	delete(sink, manifestName)
+	err = imported.ImportFrom(fstest.MapFS(sink), ImportMerge)
+	if !errors.Is(err, ErrUnencryptedExport) {
+		t.Errorf("no manifest\ngot > %v \nwant > %v", err, ErrUnencryptedExport)
+	}
+	sink[manifestName] = plain[manifestName]
+	err = imported.ImportFrom(fstest.MapFS(sink), ImportMerge)
+	if !errors.Is(err, ErrUnencryptedExport) {
+		t.Errorf("plain manifest\ngot > %v \nwant > %v", err, ErrUnencryptedExport)
+	}
+	err = readEncoded(imported, plain["accounts.dump"].Data, "accounts.dump")
+	if !errors.Is(err, ErrUnencryptedExport) {
+		t.Errorf("plain file\ngot > %v \nwant > %v", err, ErrUnencryptedExport)
+	}
+	if _, err := imported.FindAccountByID(1); err != ErrAccountNotFound {
+		t.Errorf("wallet changed by a failed import, err => %v", err)
+	}
+}
+
+// readEncoded reads the file name stored as data through the decoder of
+// svc.
+func readEncoded(svc *Service, data []byte, name string) error {
+	decoder, err := svc.decoder(bytes.NewReader(data), name)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+	_, err = io.ReadAll(decoder)
+	return err
+}
+
+// fileChecksum returns the size and checksum of data as a manifest lists
+// them.
+func fileChecksum(data []byte) (int64, string) {
+	sum := sha256.Sum256(data)
+	return int64(len(data)), hex.EncodeToString(sum[:])
+}
+
+func TestEncryptWriter_chunks(t *testing.T) {
+	content := strings.Repeat("0123456789", 3*encryptedChunk/10)
+	var file bytes.Buffer
+	writer, err := newEncryptWriter(&file, "history.dump", "k1", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(writer, content)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := &Service{}
+	svc.SetExportEncoding(ExportEncoding{Keys: StaticKey(testKey)})
+	_, err = svc.decoder(bytes.NewReader(file.Bytes()), "history.dump")
+	if !errors.Is(err, ErrWrongKey) {
+		t.Errorf("unknown key ID\ngot > %v \nwant > %v", err, ErrWrongKey)
+	}
+
+	svc.SetExportEncoding(ExportEncoding{Keys: testKeys{"k1": testKey}})
+	decoder, err := svc.decoder(bytes.NewReader(file.Bytes()), "history.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil || string(got) != content {
+		t.Errorf("got %d bytes want %d, err => %v", len(got), len(content), err)
+	}
+
+	// Dropping the full last chunk leaves a file that ends in a chunk not
+	// sealed as the last one.
+	stored := file.Bytes()
+	lastSize := 4 + 16 + len(content) - 2*encryptedChunk
+	decoder, err = svc.decoder(bytes.NewReader(stored[:len(stored)-lastSize]), "history.dump")
+	if err == nil {
+		_, err = io.ReadAll(decoder)
+	}
+	if !errors.Is(err, ErrTamperedExport) {
+		t.Errorf("dropped chunk\ngot > %v \nwant > %v", err, ErrTamperedExport)
+	}
+}
+
+// testKeys provides the keys by their IDs and encrypts with none.
+type testKeys map[string][]byte
+
+func (k testKeys) EncryptionKey() (string, []byte, error) {
+	return "", nil, errors.New("no encryption key")
+}
+
+func (k testKeys) DecryptionKey(id string) ([]byte, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, ErrWrongKey
+	}
+	return key, nil
+}
@@ -0,0 +1,145 @@
+package wallet
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// Engine runs queries over payments on a bounded pool of goroutines. The
+// payments are cut into chunks of a fixed size which the workers take one
+// by one; the results of the chunks are put together in the order of the
+// payments, so a query gives the same result however many workers run it.
+//
+// The queries stop early when their context is done and then return the
+// error of the context.
+type Engine struct {
+	workers   int
+	chunkSize int
+}
+
+// engineChunkSize is the number of payments in a chunk.
+const engineChunkSize = 1024
+
+// NewEngine returns an Engine running queries on up to workers goroutines;
+// fewer than one worker means one.
+func NewEngine(workers int) *Engine {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Engine{workers: workers, chunkSize: engineChunkSize}
+}
+
+// Filter returns the payments keep reports true for, in their order.
+func (e *Engine) Filter(ctx context.Context, payments []types.Payment, keep func(payment types.Payment) bool) ([]types.Payment, error) {
+	chunks := make([][]types.Payment, e.chunks(len(payments)))
+	err := e.run(ctx, len(payments), func(chunk int, from int, to int) {
+		for _, payment := range payments[from:to] {
+			if keep(payment) {
+				chunks[chunk] = append(chunks[chunk], payment)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []types.Payment
+	for _, chunk := range chunks {
+		kept = append(kept, chunk...)
+	}
+	return kept, nil
+}
+
+// Map returns the results of fn for every payment, in the order of the
+// payments.
+func (e *Engine) Map(ctx context.Context, payments []types.Payment, fn func(payment types.Payment) interface{}) ([]interface{}, error) {
+	results := make([]interface{}, len(payments))
+	err := e.run(ctx, len(payments), func(chunk int, from int, to int) {
+		for i := from; i < to; i++ {
+			results[i] = fn(payments[i])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Reduce folds the payments of every chunk into a value, starting from the
+// one zero returns, and then combines the values of the chunks in order.
+// For the result not to depend on the chunks, combine has to be
+// associative and zero has to return its identity.
+func (e *Engine) Reduce(ctx context.Context, payments []types.Payment, zero func() interface{}, fold func(acc interface{}, payment types.Payment) interface{}, combine func(a interface{}, b interface{}) interface{}) (interface{}, error) {
+	values := make([]interface{}, e.chunks(len(payments)))
+	err := e.run(ctx, len(payments), func(chunk int, from int, to int) {
+		acc := zero()
+		for _, payment := range payments[from:to] {
+			acc = fold(acc, payment)
+		}
+		values[chunk] = acc
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := zero()
+	for _, value := range values {
+		result = combine(result, value)
+	}
+	return result, nil
+}
+
+func (e *Engine) chunks(n int) int {
+	return (n + e.chunkSize - 1) / e.chunkSize
+}
+
+// run calls work for every chunk of n items, from the item with the index
+// from up to the one before to. It returns the error of ctx when ctx is
+// done before every chunk is worked on.
+func (e *Engine) run(ctx context.Context, n int, work func(chunk int, from int, to int)) error {
+	chunks := e.chunks(n)
+	workers := e.workers
+	if workers > chunks {
+		workers = chunks
+	}
+
+	next := make(chan int)
+	done := int64(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range next {
+				if ctx.Err() != nil {
+					continue
+				}
+				to := (chunk + 1) * e.chunkSize
+				if to > n {
+					to = n
+				}
+				work(chunk, chunk*e.chunkSize, to)
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+
+dispatch:
+	for chunk := 0; chunk < chunks; chunk++ {
+		select {
+		case next <- chunk:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if atomic.LoadInt64(&done) < int64(chunks) {
+		return ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package wallet
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func enginePayments(count int) []types.Payment {
+	payments := make([]types.Payment, count)
+	for i := range payments {
+		payments[i] = types.Payment{ID: strconv.Itoa(i), AccountID: int64(i % 3), Amount: types.Money(i)}
+	}
+	return payments
+}
+
+func TestEngine_Filter_keepsOrder(t *testing.T) {
+	payments := enginePayments(1000)
+	for _, workers := range []int{0, 1, 3, 16} {
+		engine := NewEngine(workers)
+		engine.chunkSize = 7
+		got, err := engine.Filter(context.Background(), payments, func(payment types.Payment) bool {
+			return payment.AccountID == 1
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 333 {
+			t.Fatalf("workers %d, got %d payments", workers, len(got))
+		}
+		for i, payment := range got {
+			if payment.ID != strconv.Itoa(3*i+1) {
+				t.Fatalf("workers %d, payment %d => %v", workers, i, payment)
+			}
+		}
+	}
+}
+
+func TestEngine_MapReduce(t *testing.T) {
+	payments := enginePayments(100)
+	engine := NewEngine(4)
+	engine.chunkSize = 3
+
+	ids, err := engine.Map(context.Background(), payments, func(payment types.Payment) interface{} {
+		return payment.ID
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		if id != strconv.Itoa(i) {
+			t.Fatalf("result %d => %v", i, id)
+		}
+	}
+
+	// Joining the IDs is associative but not commutative, so it shows the
+	// chunks are combined in order.
+	joined, err := engine.Reduce(context.Background(), payments,
+		func() interface{} { return "" },
+		func(acc interface{}, payment types.Payment) interface{} { return acc.(string) + payment.ID + "," },
+		func(a interface{}, b interface{}) interface{} { return a.(string) + b.(string) },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ""
+	for _, payment := range payments {
+		want += payment.ID + ","
+	}
+	if joined != want {
+		t.Errorf("\ngot > %v \nwant > %v", joined, want)
+	}
+
+	empty, err := engine.Map(context.Background(), nil, func(payment types.Payment) interface{} { return nil })
+	if err != nil || len(empty) != 0 {
+		t.Errorf("got => %v, err => %v", empty, err)
+	}
+}
+
+func TestEngine_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	kept, err := NewEngine(2).Filter(ctx, enginePayments(10*engineChunkSize), func(payment types.Payment) bool {
+		return true
+	})
+	if err != context.Canceled || kept != nil {
+		t.Errorf("got => %d payments, err => %v", len(kept), err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	calls := 0
+	_, err = (&Engine{workers: 1, chunkSize: 1}).Map(ctx, enginePayments(100), func(payment types.Payment) interface{} {
+		calls++
+		if calls == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled || calls >= 100 {
+		t.Errorf("got %d calls, err => %v", calls, err)
+	}
+}
+
+func TestService_FilterPaymentsByFn_keepsOrder(t *testing.T) {
+	w := newTestWallet(t)
+	w.storePayments(5000)
+	svc := w.Service
+	payments, err := svc.repository().Payments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.Payment{}
+	for _, payment := range payments {
+		if payment.Amount%7 == 0 {
+			want = append(want, payment)
+		}
+	}
+
+	got, err := svc.FilterPaymentsByFn(func(payment types.Payment) bool {
+		return payment.Amount%7 == 0
+	}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d payments want %d in the order of the wallet", len(got), len(want))
+	}
+	if sum := svc.SumPayments(8); sum != 5000*5001/2 {
+		t.Errorf("wrong sum => %v", sum)
+	}
+	if _, err := svc.FilterPaymentsByFn(func(types.Payment) bool { return false }, 8); err != ErrAccountNotFound {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrAccountNotFound)
+	}
+}
@@ -0,0 +1,603 @@
+package wallet
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrCorruptedExport = errors.New("export is corrupted")
+
+// ImportMode tells what an import does with the records already stored in
+// the wallet.
+type ImportMode int
+
+const (
+	// ImportMerge adds the imported records to the wallet; the ones that
+	// conflict with stored records replace them as with ConflictOverwrite.
+	// Merge lets the caller choose another ConflictStrategy.
+	ImportMerge ImportMode = iota
+	// ImportReplace makes the wallet hold exactly the imported records. The
+	// balances of an import without ledger entries become opening balances
+	// of the ledger, and an import without idempotency records keeps the
+	// stored ones.
+	ImportReplace
+)
+
+// FileSink receives the files of an export. Every file is written and
+// closed before the next one is created, so a sink can stream the files one
+// after another, for example into an archive or an HTTP response.
+//
+// Exports are read back from an fs.FS such as os.DirFS or fstest.MapFS.
+type FileSink interface {
+	Create(name string) (io.WriteCloser, error)
+}
+
+// DirSink returns a FileSink creating the files in dir.
+func DirSink(dir string) FileSink {
+	return dirSink{dir: dir}
+}
+
+// dirSink creates the files in dir; with sync set it fsyncs every file
+// before closing it.
+type dirSink struct {
+	dir  string
+	sync bool
+}
+
+func (sink dirSink) Create(name string) (io.WriteCloser, error) {
+	file, err := createFile(filepath.Join(sink.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	file.sync = sink.sync
+	return file, nil
+}
+
+// bufferedFile buffers the writes to a file and flushes them on Close.
+type bufferedFile struct {
+	*bufio.Writer
+	file *os.File
+	sync bool
+}
+
+func createFile(path string) (*bufferedFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedFile{Writer: bufio.NewWriter(file), file: file}, nil
+}
+
+func (f *bufferedFile) Close() error {
+	err := f.Flush()
+	if err == nil && f.sync {
+		err = f.file.Sync()
+	}
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// exportFile creates the file name in sink and writes it with write. The
+// error of closing the file is reported too.
+func exportFile(sink FileSink, name string, write func(w io.Writer) error) (err error) {
+	file, err := sink.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	return write(file)
+}
+
+// importFile opens the file name of fsys and reads it with read. A missing
+// file is reported as ErrFileNotFound.
+func importFile(fsys fs.FS, name string, read func(r io.Reader) error) error {
+	file, err := fsys.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return read(file)
+}
+
+// writeDumps writes a dump file of every collection of data that is not
+// empty to sink.
+func writeDumps(sink FileSink, data *walletData) error {
+	for _, file := range dumpFiles {
+		if file.size(data) == 0 {
+			continue
+		}
+		err := exportFile(sink, file.name, func(w io.Writer) error {
+			return file.write(w, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDumps reads the dump files written by writeDumps from fsys, checking
+// them against its manifest and decrypting them with keys. Missing files
+// are read as empty.
+func readDumps(fsys fs.FS, keys KeyProvider) (*walletData, error) {
+	fsys, err := openManifest(fsys, formatDump, keys)
+	if err != nil {
+		return nil, err
+	}
+	fsys = decodingFS{fsys: fsys, keys: keys}
+
+	data := &walletData{}
+	for _, file := range dumpFiles {
+		err := importFile(fsys, file.name, func(r io.Reader) error {
+			return file.read(r, data)
+		})
+		if err == ErrFileNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.name, err)
+		}
+	}
+	return data, nil
+}
+
+// load stores the imported data in the wallet as mode says.
+func (s *Service) load(data *walletData, mode ImportMode) error {
+	switch mode {
+	case ImportMerge:
+		_, err := s.merge(data, ConflictOverwrite)
+		return err
+	case ImportReplace:
+		return s.replace(data)
+	default:
+		return fmt.Errorf("unknown import mode %d", mode)
+	}
+}
+
+// replace makes the wallet hold the imported data in one transaction. The
+// ledger is replaced too; the balances of an import without ledger entries
+// are posted as opening balances. The idempotency records are kept unless
+// the import carries its own, so that retried requests are still
+// recognized.
+func (s *Service) replace(data *walletData) error {
+	unlock, err := s.lockAllAccounts()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := s.now()
+	return s.repository().Update(func(tx Tx) error {
+		current, err := fetchWalletData(tx)
+		if err != nil {
+			return err
+		}
+		if len(data.records) == 0 {
+			current.records = nil
+		}
+		err = current.delete(tx)
+		if err != nil {
+			return err
+		}
+		err = data.save(tx)
+		if err != nil {
+			return err
+		}
+
+		accountIDs := make([]int64, len(data.accounts))
+		for i, account := range data.accounts {
+			accountIDs[i] = account.ID
+		}
+		return balanceLedgers(tx, accountIDs, now)
+	})
+}
+
+// Every export ends with a manifest listing the files written before it,
+// so that an import reads the files of one export only and notices files
+// that were changed or cut short.
+const manifestName = "manifest.json"
+
+// Formats of the exports named in the manifest.
+const (
+	formatDump = "dump"
+	formatJSON = "json"
+	formatCSV  = "csv"
+	// The parts of a payment history; the manifest lists them in order.
+	formatHistory = "history"
+)
+
+type manifest struct {
+	Snapshot  string         `json:"snapshot"`
+	Format    string         `json:"format"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Files     []manifestFile `json:"files"`
+	// KeyID, KeyCheck and MAC authenticate the manifest of an encrypted
+	// export: MAC is an HMAC-SHA256 of the rest of the manifest, keyed with
+	// the key KeyID names. KeyCheck tells a wrong key from a tampered
+	// manifest, as in the header of an encrypted file.
+	KeyID    string `json:"keyId,omitempty"`
+	KeyCheck string `json:"keyCheck,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+}
+
+type manifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Records is the number of records in a part of a payment history.
+	Records int `json:"records,omitempty"`
+}
+
+// manifestSink passes the files to sink and lists them in the manifest,
+// which is authenticated with the encryption key of keys unless keys is nil.
+type manifestSink struct {
+	sink     FileSink
+	keys     KeyProvider
+	manifest manifest
+}
+
+func newManifestSink(sink FileSink, format string, createdAt time.Time, keys KeyProvider) *manifestSink {
+	return &manifestSink{
+		sink: sink,
+		keys: keys,
+		manifest: manifest{
+			Snapshot:  uuid.New().String(),
+			Format:    format,
+			CreatedAt: createdAt,
+		},
+	}
+}
+
+func (m *manifestSink) Create(name string) (io.WriteCloser, error) {
+	file, err := m.sink.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestWriter{WriteCloser: file, sink: m, name: name, digest: sha256.New()}, nil
+}
+
+// writeManifest writes the manifest of the files created so far to sink.
+func (m *manifestSink) writeManifest() error {
+	if m.keys != nil {
+		id, key, err := m.keys.EncryptionKey()
+		if err != nil {
+			return err
+		}
+		m.manifest.KeyID = id
+		m.manifest.KeyCheck = keyCheck(key)
+		m.manifest.MAC = manifestMAC(m.manifest, key)
+	}
+	return exportFile(m.sink, manifestName, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(m.manifest)
+	})
+}
+
+type manifestWriter struct {
+	io.WriteCloser
+	sink   *manifestSink
+	name   string
+	digest digest
+	size   int64
+}
+
+// digest is the part of hash.Hash the manifest needs.
+type digest interface {
+	io.Writer
+	Sum(b []byte) []byte
+}
+
+func (w *manifestWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.digest.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *manifestWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if err != nil {
+		return err
+	}
+	w.sink.manifest.Files = append(w.sink.manifest.Files, manifestFile{
+		Name:   w.name,
+		Size:   w.size,
+		SHA256: hex.EncodeToString(w.digest.Sum(nil)),
+	})
+	return nil
+}
+
+// manifestMAC returns the MAC of the manifest m keyed with key.
+func manifestMAC(m manifest, key []byte) string {
+	sum := sha256.Sum256(append([]byte("wallet manifest key\n"), key...))
+	mac := hmac.New(sha256.New, sum[:])
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n", m.Snapshot, m.Format, m.CreatedAt.UTC().Format(time.RFC3339Nano), m.KeyID, m.KeyCheck)
+	for _, file := range m.Files {
+		fmt.Fprintf(mac, "%q %d %s %d\n", file.Name, file.Size, file.SHA256, file.Records)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkManifestMAC checks that the manifest m is authenticated with a key
+// of keys.
+func checkManifestMAC(m manifest, keys KeyProvider) error {
+	if m.MAC == "" {
+		return fmt.Errorf("%w: %s is not authenticated", ErrUnencryptedExport, manifestName)
+	}
+	key, err := keys.DecryptionKey(m.KeyID)
+	if err != nil {
+		return err
+	}
+	if keyCheck(key) != m.KeyCheck {
+		return fmt.Errorf("%w %q", ErrWrongKey, m.KeyID)
+	}
+	if !hmac.Equal([]byte(manifestMAC(m, key)), []byte(m.MAC)) {
+		return fmt.Errorf("%w: %s does not authenticate", ErrTamperedExport, manifestName)
+	}
+	return nil
+}
+
+// openManifest checks the files of fsys against its manifest and returns
+// the files the manifest lists. Exports written before manifests existed
+// have none; their files are returned as they are unless keys is set.
+func openManifest(fsys fs.FS, format string, keys KeyProvider) (fs.FS, error) {
+	m, err := readManifest(fsys, format, keys)
+	if err != nil || m == nil {
+		return fsys, err
+	}
+
+	listed := manifestFS{fsys: fsys, names: make(map[string]bool)}
+	for _, file := range m.Files {
+		listed.names[file.Name] = true
+	}
+	return listed, nil
+}
+
+// readManifest returns the manifest of fsys after checking the files it
+// lists, or nil when fsys has no manifest. With keys set the manifest must
+// be there and be authenticated by one of keys.
+func readManifest(fsys fs.FS, format string, keys KeyProvider) (*manifest, error) {
+	content, err := fs.ReadFile(fsys, manifestName)
+	if errors.Is(err, fs.ErrNotExist) {
+		if keys != nil {
+			return nil, fmt.Errorf("%w: %s is missing", ErrUnencryptedExport, manifestName)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	err = json.Unmarshal(content, &m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorruptedExport, manifestName, err)
+	}
+	if keys != nil {
+		err := checkManifestMAC(m, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.Format != format {
+		return nil, fmt.Errorf("export holds %s files, not %s", m.Format, format)
+	}
+
+	for _, file := range m.Files {
+		err := checkManifestFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+func checkManifestFile(fsys fs.FS, file manifestFile) error {
+	sum := sha256.New()
+	err := importFile(fsys, file.Name, func(r io.Reader) error {
+		size, err := io.Copy(sum, r)
+		if err != nil {
+			return err
+		}
+		if size != file.Size {
+			return fmt.Errorf("%w: %s has %d bytes, want %d", ErrCorruptedExport, file.Name, size, file.Size)
+		}
+		return nil
+	})
+	if err == ErrFileNotFound {
+		return fmt.Errorf("%w: %s is missing", ErrCorruptedExport, file.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("%w: checksum of %s does not match", ErrCorruptedExport, file.Name)
+	}
+	return nil
+}
+
+// manifestFS hides the files of fsys that the manifest does not list.
+type manifestFS struct {
+	fsys  fs.FS
+	names map[string]bool
+}
+
+func (m manifestFS) Open(name string) (fs.File, error) {
+	if !m.names[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.fsys.Open(name)
+}
+
+// An export into a directory is written into a new snapshot directory
+// inside it. Only when every file is written and synced is the snapshot
+// renamed into place and named in the CURRENT file, so a crash never
+// leaves a half-written export behind: imports keep reading the previous
+// snapshot.
+//
+// Snapshots are named after the time of the export, so that their names
+// sort from the oldest to the newest.
+const (
+	currentName    = "CURRENT"
+	snapshotPrefix = "snapshot-"
+	snapshotTime   = "20060102T150405.000000000Z"
+)
+
+// exportSnapshot runs export on a sink writing a new snapshot of dir and
+// makes it the current one. It returns the name of the snapshot.
+func exportSnapshot(dir string, export func(sink FileSink) error) (string, error) {
+	return createSnapshot(dir, func(tmp string) error {
+		return export(dirSink{dir: tmp, sync: true})
+	})
+}
+
+// createSnapshot runs write on the directory of a new snapshot of dir and
+// makes it the current one. The snapshot that was current before stays, as
+// imports may still be reading it; the finished snapshots older than it
+// are removed. Snapshots still being written are never touched.
+func createSnapshot(dir string, write func(tmp string) error) (string, error) {
+	name := snapshotPrefix + time.Now().UTC().Format(snapshotTime) + "-" + uuid.New().String()
+	tmp := filepath.Join(dir, "."+name)
+	err := os.Mkdir(tmp, 0777)
+	if err != nil {
+		return "", err
+	}
+
+	err = write(tmp)
+	if err == nil {
+		err = syncDir(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+
+	previous, err := currentSnapshot(dir)
+	if err != nil || previous == "" {
+		previous = name
+	}
+	err = replaceFile(filepath.Join(dir, currentName), name+"\n")
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		os.RemoveAll(filepath.Join(dir, name))
+		return "", err
+	}
+	removeSnapshots(dir, previous)
+	return name, nil
+}
+
+// openSnapshot returns the current snapshot of dir. Directories exported
+// before snapshots existed hold the files themselves.
+func openSnapshot(dir string) (fs.FS, error) {
+	path, err := snapshotDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return os.DirFS(path), nil
+}
+
+// snapshotDir returns the path of the current snapshot of dir, or dir
+// itself when it holds no snapshots.
+func snapshotDir(dir string) (string, error) {
+	name, err := currentSnapshot(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// currentSnapshot returns the name of the current snapshot of dir, or an
+// empty name when dir has none.
+func currentSnapshot(dir string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, currentName))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSpace(string(content))
+	if !strings.HasPrefix(name, snapshotPrefix) || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%w: bad %s %q", ErrCorruptedExport, currentName, name)
+	}
+	return name, nil
+}
+
+// removeSnapshots removes the finished snapshots of dir older than keep.
+// Hidden directories of snapshots being written and snapshots whose names
+// do not tell their time are left alone.
+func removeSnapshots(dir string, keep string) {
+	if !timedSnapshot(keep) {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !timedSnapshot(name) || name >= keep {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// timedSnapshot reports whether name is the name of a snapshot starting
+// with the time of its export.
+func timedSnapshot(name string) bool {
+	if !strings.HasPrefix(name, snapshotPrefix) || len(name) < len(snapshotPrefix)+len(snapshotTime) {
+		return false
+	}
+	_, err := time.Parse(snapshotTime, name[len(snapshotPrefix):len(snapshotPrefix)+len(snapshotTime)])
+	return err == nil
+}
+
+// syncDir fsyncs the directory so that the files created or renamed in it
+// survive a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
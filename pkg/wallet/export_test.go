@@ -0,0 +1,519 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// newExportService returns a wallet with accounts in two currencies, a
+// transfer, a rejected payment and a favorite whose name needs quoting.
+func newExportService(t *testing.T) *Service {
+	w := newTestWallet(t)
+	from := w.account("+992000000001", 0)
+	to := w.account("+992000000002", 0)
+	w.accountIn("+992000000003", types.CurrencyUSD, 0)
+	w.check(w.Deposit(from.ID, 100))
+	payment := w.pay(from.ID, 30, "auto")
+	w.favorite(payment.ID, "car, \"daily\"\nrefill")
+	w.clock.Add(time.Minute)
+	w.transfer(from.ID, to.ID, 20)
+	w.check(w.Reject(payment.ID))
+	return w.Service
+}
+
+// memorySink keeps the files of an export in memory.
+type memorySink fstest.MapFS
+
+func (sink memorySink) Create(name string) (io.WriteCloser, error) {
+	return &memoryFile{sink: sink, name: name}, nil
+}
+
+type memoryFile struct {
+	bytes.Buffer
+	sink memorySink
+	name string
+}
+
+func (f *memoryFile) Close() error {
+	f.sink[f.name] = &fstest.MapFile{Data: f.Bytes()}
+	return nil
+}
+
+func checkSameWallet(t *testing.T, got *Service, want *Service) {
+	t.Helper()
+	gotData, err := fetchWalletData(got.repository())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantData, err := fetchWalletData(want.repository())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotData.accounts, wantData.accounts) {
+		t.Errorf("accounts\ngot > %v \nwant > %v", gotData.accounts, wantData.accounts)
+	}
+	if !reflect.DeepEqual(gotData.payments, wantData.payments) {
+		t.Errorf("payments\ngot > %v \nwant > %v", gotData.payments, wantData.payments)
+	}
+	if !reflect.DeepEqual(gotData.favorites, wantData.favorites) {
+		t.Errorf("favorites\ngot > %v \nwant > %v", gotData.favorites, wantData.favorites)
+	}
+}
+
+func TestService_ExportImportJSON(t *testing.T) {
+	svc := newExportService(t)
+	dir := t.TempDir()
+	err := svc.ExportJSON(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	err = imported.ImportJSON(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameWallet(t, imported, svc)
+}
+
+func TestService_ExportImportCSV(t *testing.T) {
+	svc := newExportService(t)
+	dir := t.TempDir()
+	err := svc.ExportCSV(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	err = imported.ImportCSV(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameWallet(t, imported, svc)
+}
+
+func TestService_ExportJSON_emptyWallet(t *testing.T) {
+	dir := t.TempDir()
+	err := (&Service{}).ExportJSON(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "[\n]\n" {
+		t.Errorf("\ngot > %q \nwant > %q", content, "[\n]\n")
+	}
+}
+
+func TestService_ImportCSV_badRecord(t *testing.T) {
+	dir := t.TempDir()
+	content := "id,phone,balance,currency\n1,+992000000001,10,TJS\n2,+992000000002,ten,TJS\n"
+	err := os.WriteFile(filepath.Join(dir, "accounts.csv"), []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := &Service{}
+	err = svc.ImportCSV(dir)
+	var dumpErr *DumpError
+	if !errors.As(err, &dumpErr) || dumpErr.Record != 2 {
+		t.Errorf("wrong error => %v", err)
+	}
+	if _, err := svc.FindAccountByID(1); err != ErrAccountNotFound {
+		t.Errorf("wallet changed by a failed import, err => %v", err)
+	}
+}
+
+func TestService_ImportJSON_badRecord(t *testing.T) {
+	dir := t.TempDir()
+	content := `[{"id":1,"phone":"+992000000001","balance":10},{"id":2,"phone":"+992000000002","balance":"ten"}]`
+	err := os.WriteFile(filepath.Join(dir, "accounts.json"), []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&Service{}).ImportJSON(dir)
+	var dumpErr *DumpError
+	if !errors.As(err, &dumpErr) || dumpErr.Record != 2 {
+		t.Errorf("wrong error => %v", err)
+	}
+}
+
+func TestDecode_badRecordIsNotKept(t *testing.T) {
+	data := &walletData{}
+	err := csvFiles[0].decode(strings.NewReader("id,phone,balance,currency\n1,+992000000001,10,TJS\n2,+992000000002,ten,TJS\n"), data)
+	if err == nil || len(data.accounts) != 1 {
+		t.Errorf("\ngot > %v %v \nwant > 1 account", err, data.accounts)
+	}
+
+	data = &walletData{}
+	err = jsonFiles[0].decode(strings.NewReader(`[{"id":1,"phone":"+992000000001","balance":10},{"id":2,"phone":"+992000000002","balance":"ten"}]`), data)
+	if err == nil || len(data.accounts) != 1 {
+		t.Errorf("\ngot > %v %v \nwant > 1 account", err, data.accounts)
+	}
+}
+
+func TestService_ExportToImportFrom(t *testing.T) {
+	svc := newExportService(t)
+	sink := memorySink{}
+	err := svc.ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{accountsDump, paymentsDump, favoritesDump, ledgerDump} {
+		if _, ok := sink[name]; !ok {
+			t.Errorf("%s is not exported", name)
+		}
+	}
+
+	imported := &Service{}
+	err = imported.ImportFrom(fstest.MapFS(sink), ImportMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameWallet(t, imported, svc)
+}
+
+func TestService_ExportJSONTo(t *testing.T) {
+	svc := newExportService(t)
+	sink := memorySink{}
+	err := svc.ExportJSONTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	err = imported.ImportJSONFrom(fstest.MapFS(sink), ImportMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameWallet(t, imported, svc)
+}
+
+func TestService_WriteReadAccounts(t *testing.T) {
+	svc := newExportService(t)
+	buffer := &bytes.Buffer{}
+	err := svc.WriteAccounts(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	err = imported.ReadAccounts(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, _ := imported.repository().Accounts()
+	want, _ := svc.repository().Accounts()
+	if !reflect.DeepEqual(accounts, want) {
+		t.Errorf("\ngot > %v \nwant > %v", accounts, want)
+	}
+}
+
+func TestService_HistoryTo(t *testing.T) {
+	svc := newExportService(t)
+	payments, err := svc.ExportAccountHistory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := memorySink{}
+	err = svc.HistoryTo(payments, sink, HistoryOptions{MaxRecords: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink) != len(payments)+1 {
+		t.Fatalf("wrong files => %v", sink)
+	}
+	want := payments[1].ID + ";1;20;transfer-out;INPROGRESS\n"
+	if got := string(sink["payments2.dump"].Data); got != want {
+		t.Errorf("\ngot > %q \nwant > %q", got, want)
+	}
+
+	sink = memorySink{}
+	err = svc.HistoryTo(payments, sink, HistoryOptions{MaxRecords: len(payments)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sink["payments.dump"]; !ok || len(sink) != 2 {
+		t.Errorf("wrong files => %v", sink)
+	}
+}
+
+func TestService_Export_snapshots(t *testing.T) {
+	svc := newExportService(t)
+	dir := t.TempDir()
+	// being written by another export
+	err := os.Mkdir(filepath.Join(dir, ".snapshot-20200101T000000.000000000Z-writing"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshots []string
+	for i := 0; i < 3; i++ {
+		err := svc.Export(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, err := os.ReadFile(filepath.Join(dir, currentName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, strings.TrimSpace(string(current)))
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	// the previous snapshot stays for the imports reading it
+	want := []string{".snapshot-20200101T000000.000000000Z-writing", currentName, snapshots[1], snapshots[2]}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("\ngot > %v \nwant > %v", names, want)
+	}
+
+	imported := &Service{}
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameWallet(t, imported, svc)
+}
+
+func TestService_Import_corruptedSnapshot(t *testing.T) {
+	svc := newExportService(t)
+	dir := t.TempDir()
+	err := svc.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := os.ReadFile(filepath.Join(dir, currentName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, string(bytes.TrimSpace(current)), paymentsDump)
+	err = os.Truncate(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	err = imported.Import(dir)
+	if !errors.Is(err, ErrCorruptedExport) {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrCorruptedExport)
+	}
+	if _, err := imported.FindAccountByID(1); err != ErrAccountNotFound {
+		t.Errorf("wallet changed by a failed import, err => %v", err)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = imported.Import(dir)
+	if !errors.Is(err, ErrCorruptedExport) {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrCorruptedExport)
+	}
+}
+
+func TestService_ImportFrom_wrongFormat(t *testing.T) {
+	sink := memorySink{}
+	err := newExportService(t).ExportJSONTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&Service{}).ImportFrom(fstest.MapFS(sink), ImportMerge)
+	if err == nil {
+		t.Error("JSON export is imported as dumps")
+	}
+}
+
+func TestService_ImportWithMode(t *testing.T) {
+	svc := newExportService(t)
+	dir := t.TempDir()
+	err := svc.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Service{}
+	other, err := imported.RegisterAccount("+992000000009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = imported.Deposit(other.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = imported.ImportWithMode(dir, ImportMerge)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	accounts, _ := imported.repository().Accounts()
+	if len(accounts) != 3 {
+		t.Errorf("merged twice, got => %v", accounts)
+	}
+
+	err = imported.ImportWithMode(dir, ImportReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameWallet(t, imported, svc)
+	gotEntries, _ := imported.repository().Entries()
+	wantEntries, _ := svc.repository().Entries()
+	if !reflect.DeepEqual(gotEntries, wantEntries) {
+		t.Errorf("entries\ngot > %v \nwant > %v", gotEntries, wantEntries)
+	}
+	if discrepancies, err := imported.Reconcile(); err != nil || len(discrepancies) != 0 {
+		t.Errorf("ledger disagrees with balances => %v, err => %v", discrepancies, err)
+	}
+}
+
+func TestService_ImportJSONFrom_replaceBalancesLedger(t *testing.T) {
+	svc := &Service{}
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.PayWithKey("key-1", account.ID, 100, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := memorySink{}
+	err = svc.ExportJSONTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.ImportJSONFrom(fstest.MapFS(sink), ImportReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discrepancies, err := svc.Reconcile()
+	if err != nil || len(discrepancies) != 0 {
+		t.Errorf("\ngot > %v %v \nwant > nil", discrepancies, err)
+	}
+	entries, err := svc.LedgerEntries(AccountLedger(account.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Side != types.EntrySideCredit || entries[0].Amount != 900 {
+		t.Errorf("\ngot > %v \nwant > an opening balance of 900", entries)
+	}
+	opening, err := svc.LedgerBalance(LedgerOpening)
+	if err != nil || opening != -900 {
+		t.Errorf("\ngot > %v %v \nwant > %v", opening, err, -900)
+	}
+
+	// the key is still known, the retry does not pay again
+	_, err = svc.PayWithKey("key-1", account.ID, 100, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, svc, account.ID, 900)
+}
+
+func TestOpenService_replaceSurvivesReopen(t *testing.T) {
+	svc := newExportService(t)
+	exported := t.TempDir()
+	err := svc.Export(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	opened, err := OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = opened.RegisterAccount("+992000000009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = opened.ImportWithMode(exported, ImportReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = opened.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	checkSameWallet(t, reopened, svc)
+}
+
+func TestService_Export_favoritePayments(t *testing.T) {
+	svc, ids, _ := newQueryService(t)
+	exports := map[string]func(sink FileSink) error{
+		"dump": svc.ExportTo,
+		"json": svc.ExportJSONTo,
+		"csv":  svc.ExportCSVTo,
+	}
+	for name, export := range exports {
+		sink := memorySink{}
+		err := export(sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported := &Service{}
+		switch name {
+		case "dump":
+			err = imported.ImportFrom(fstest.MapFS(sink), ImportMerge)
+		case "json":
+			err = imported.ImportJSONFrom(fstest.MapFS(sink), ImportMerge)
+		case "csv":
+			err = imported.ImportCSVFrom(fstest.MapFS(sink), ImportMerge)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		payment, err := imported.FindPaymentByID(ids["p4"])
+		if err != nil || payment.FavoriteID != ids["favorite"] {
+			t.Errorf("%s: wrong payment => %v, err => %v", name, payment, err)
+		}
+	}
+}
+
+func TestService_ImportCSV_olderColumns(t *testing.T) {
+	export := fstest.MapFS{
+		"payments.csv": &fstest.MapFile{Data: []byte("id,accountId,amount,category,status,linkedPaymentId,transitions,createdAt,updatedAt\n" +
+			"p1,1,10,auto,OK,,,2020-01-01T00:00:00Z,2020-01-01T00:00:00Z\n")},
+	}
+	svc := &Service{}
+	err := svc.ImportCSVFrom(export, ImportMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := svc.FindPaymentByID("p1")
+	if err != nil || payment.Amount != 10 || payment.FavoriteID != "" {
+		t.Errorf("wrong payment => %v, err => %v", payment, err)
+	}
+}
@@ -0,0 +1,96 @@
+package wallet
+
+import (
+	"os"
+	"time"
+)
+
+// FileRepository keeps the wallet in memory like MemoryRepository and, on
+// every commit that changes it, writes a new snapshot of its directory in
+// the layout written by Export, so a directory of Export can be opened as
+// a repository and a repository can be imported. A directory of dump files
+// written before snapshots existed is read too; the first commit moves it
+// to a snapshot.
+type FileRepository struct {
+	*MemoryRepository
+	dir string
+}
+
+// NewFileRepository opens the repository stored in dir, loading its current
+// snapshot if there is one.
+func NewFileRepository(dir string) (*FileRepository, error) {
+	r := &FileRepository{
+		MemoryRepository: NewMemoryRepository(),
+		dir:              dir,
+	}
+
+	data, err := loadDumps(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.MemoryRepository.restore(data)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *FileRepository) Update(fn func(tx Tx) error) error {
+	return r.MemoryRepository.update(fn, r.commit)
+}
+
+// commit is called with the write lock of the memory repository held.
+func (r *FileRepository) commit(tx *memoryTx) error {
+	if len(tx.changed) == 0 {
+		return nil
+	}
+	data := r.MemoryRepository.data()
+	_, err := exportSnapshot(r.dir, func(sink FileSink) error {
+		return writeSnapshot(sink, data)
+	})
+	return err
+}
+
+// writeSnapshot writes data to sink as an Export without encoding does.
+func writeSnapshot(sink FileSink, data *walletData) error {
+	files := newManifestSink(sink, formatDump, time.Now(), nil)
+	err := writeDumps(files, data)
+	if err != nil {
+		return err
+	}
+	return files.writeManifest()
+}
+
+// loadDumps reads the current snapshot of dir; missing files are treated
+// as empty.
+func loadDumps(dir string) (*walletData, error) {
+	fsys, err := openSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return readDumps(fsys, nil)
+}
+
+// replaceFile writes data next to path and renames it over path, so that
+// readers never see a partly written file.
+func replaceFile(path string, data string) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
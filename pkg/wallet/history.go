@@ -0,0 +1,195 @@
+package wallet
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// HistoryOptions tells when the history of payments moves on to the next
+// part.
+type HistoryOptions struct {
+	// MaxRecords is the most payments a part holds; 0 means no limit.
+	MaxRecords int
+	// MaxBytes is the most bytes of payments a part holds before it is
+	// compressed or encrypted; 0 means no limit. A part holds at least one
+	// payment, so a larger payment gets a part of its own.
+	MaxBytes int64
+}
+
+// HistoryTo writes the payments to sink, one payment per line with its ID,
+// account, amount, category and status separated by ";" and escaped as in
+// the dump format. Payments that fit in one part as
+// options say go to payments.dump; more are split into payments1.dump,
+// payments2.dump and so on. The manifest of the history lists the parts in
+// order with the number of payments in each. The files are encoded as the
+// export encoding of the service says.
+func (s *Service) HistoryTo(payments []types.Payment, sink FileSink, options HistoryOptions) error {
+	files := newManifestSink(sink, formatHistory, s.now(), s.exportEncoding().Keys)
+	encoded := s.encodingSink(files)
+
+	parts := splitHistory(payments, options)
+	for i, part := range parts {
+		name := "payments.dump"
+		if len(parts) > 1 {
+			name = historyPartName(i + 1)
+		}
+		err := exportFile(encoded, name, func(w io.Writer) error {
+			for _, line := range part {
+				_, err := io.WriteString(w, line)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		listed := files.manifest.Files
+		listed[len(listed)-1].Records = len(part)
+	}
+	return files.writeManifest()
+}
+
+// splitHistory returns the lines of the payments split into parts, starting
+// the next part whenever one is full as options say.
+func splitHistory(payments []types.Payment, options HistoryOptions) [][]string {
+	parts := [][]string{}
+	var part []string
+	var size int64
+	for _, payment := range payments {
+		line := historyLine(payment)
+		full := options.MaxRecords > 0 && len(part) >= options.MaxRecords ||
+			options.MaxBytes > 0 && size+int64(len(line)) > options.MaxBytes
+		if len(part) > 0 && full {
+			parts = append(parts, part)
+			part = nil
+			size = 0
+		}
+		part = append(part, line)
+		size += int64(len(line))
+	}
+	if len(part) > 0 {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+func historyLine(payment types.Payment) string {
+	return joinDumpRecord([]string{
+		payment.ID,
+		strconv.FormatInt(payment.AccountID, 10),
+		strconv.FormatInt(int64(payment.Amount), 10),
+		string(payment.Category),
+		string(payment.Status),
+	}) + "\n"
+}
+
+func historyPartName(number int) string {
+	return "payments" + strconv.Itoa(number) + ".dump"
+}
+
+// HistoryFrom reads the payment history written by HistoryTo from fsys,
+// with the parts in order. The parts are checked against the manifest
+// first. Histories written before they had manifests are read from
+// payments.dump or from payments1.dump, payments2.dump and so on.
+func (s *Service) HistoryFrom(fsys fs.FS) ([]types.Payment, error) {
+	m, err := readManifest(fsys, formatHistory, s.exportEncoding().Keys)
+	if err != nil {
+		return nil, err
+	}
+	var parts []manifestFile
+	if m != nil {
+		parts = m.Files
+	} else {
+		parts, err = legacyHistoryParts(fsys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	decoded := s.decodingFS(fsys)
+	payments := []types.Payment{}
+	for _, part := range parts {
+		data := &walletData{}
+		err := importFile(decoded, part.Name, func(r io.Reader) error {
+			return readHistoryPart(r, data)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", part.Name, err)
+		}
+		if m != nil && len(data.payments) != part.Records {
+			return nil, fmt.Errorf("%w: %s has %d payments, want %d", ErrCorruptedExport, part.Name, len(data.payments), part.Records)
+		}
+		payments = append(payments, data.payments...)
+	}
+	return payments, nil
+}
+
+// legacyHistoryParts finds the parts of a history without a manifest.
+func legacyHistoryParts(fsys fs.FS) ([]manifestFile, error) {
+	exists := func(name string) (bool, error) {
+		_, err := fs.Stat(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	ok, err := exists("payments.dump")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return []manifestFile{{Name: "payments.dump"}}, nil
+	}
+
+	var parts []manifestFile
+	for number := 1; ; number++ {
+		name := historyPartName(number)
+		ok, err := exists(name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		parts = append(parts, manifestFile{Name: name})
+	}
+	if len(parts) == 0 {
+		return nil, ErrFileNotFound
+	}
+	return parts, nil
+}
+
+// readHistoryPart reads a part of a history as HistoryTo writes it, a
+// payment per line with its escaped ID, account, amount, category and
+// status.
+func readHistoryPart(r io.Reader, data *walletData) error {
+	reader := bufio.NewReader(r)
+	for number := 1; ; number++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		fields, err := splitDumpRecord(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return &DumpError{Line: number, Err: err}
+		}
+		payment, err := parsePayment(fields)
+		if err != nil {
+			return &DumpError{Line: number, Err: err}
+		}
+		data.payments = append(data.payments, payment)
+	}
+}
@@ -0,0 +1,268 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func historyPayments(t *testing.T, svc *Service) []types.Payment {
+	t.Helper()
+	payments, err := svc.repository().Payments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 3 {
+		t.Fatalf("wrong payments => %v", payments)
+	}
+	return payments
+}
+
+func checkHistory(t *testing.T, got []types.Payment, want []types.Payment) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("\ngot > %d payments \nwant > %d", len(got), len(want))
+	}
+	// a history keeps the ID, account, amount, category and status
+	for i := range want {
+		want := types.Payment{
+			ID:        want[i].ID,
+			AccountID: want[i].AccountID,
+			Amount:    want[i].Amount,
+			Category:  want[i].Category,
+			Status:    want[i].Status,
+		}
+		if !reflect.DeepEqual(got[i], want) {
+			t.Errorf("payment %d\ngot > %v \nwant > %v", i, got[i], want)
+		}
+	}
+}
+
+func partNames(sink memorySink) []string {
+	names := []string{}
+	for name := range sink {
+		if name != manifestName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestService_HistoryTo_rotation(t *testing.T) {
+	svc := newExportService(t)
+	payments := historyPayments(t, svc)
+
+	tests := []struct {
+		name    string
+		options HistoryOptions
+		parts   []string
+	}{
+		{"no limit", HistoryOptions{}, []string{"payments.dump"}},
+		{"records", HistoryOptions{MaxRecords: 2}, []string{"payments1.dump", "payments2.dump"}},
+		{"bytes", HistoryOptions{MaxBytes: 1}, []string{"payments1.dump", "payments2.dump", "payments3.dump"}},
+		{"bytes and records", HistoryOptions{MaxRecords: 2, MaxBytes: 1 << 20}, []string{"payments1.dump", "payments2.dump"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := memorySink{}
+			err := svc.HistoryTo(payments, sink, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := partNames(sink); !reflect.DeepEqual(names, tt.parts) {
+				t.Errorf("wrong parts\ngot > %v \nwant > %v", names, tt.parts)
+			}
+
+			got, err := svc.HistoryFrom(fstest.MapFS(sink))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkHistory(t, got, payments)
+		})
+	}
+}
+
+func TestService_HistoryTo_maxBytes(t *testing.T) {
+	svc := newExportService(t)
+	payments := historyPayments(t, svc)
+
+	sink := memorySink{}
+	err := svc.HistoryTo(payments, sink, HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(sink["payments.dump"].Data))
+
+	// The part holding all the payments fits exactly; one byte less moves
+	// the last payment into a part of its own.
+	sink = memorySink{}
+	err = svc.HistoryTo(payments, sink, HistoryOptions{MaxBytes: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := partNames(sink); len(names) != 1 {
+		t.Errorf("wrong parts => %v", names)
+	}
+	sink = memorySink{}
+	err = svc.HistoryTo(payments, sink, HistoryOptions{MaxBytes: size - 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := partNames(sink); len(names) != 2 {
+		t.Errorf("wrong parts => %v", names)
+	}
+}
+
+func TestService_HistoryTo_empty(t *testing.T) {
+	svc := &Service{}
+	sink := memorySink{}
+	err := svc.HistoryTo(nil, sink, HistoryOptions{MaxRecords: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := svc.HistoryFrom(fstest.MapFS(sink))
+	if err != nil || len(payments) != 0 {
+		t.Errorf("got => %v, err => %v", payments, err)
+	}
+}
+
+type failingSink struct {
+	err error
+}
+
+func (sink failingSink) Create(name string) (io.WriteCloser, error) {
+	return nil, sink.err
+}
+
+func TestService_HistoryToFiles_errors(t *testing.T) {
+	svc := newExportService(t)
+	payments := historyPayments(t, svc)
+
+	file := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(file, nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.HistoryToFiles(payments, filepath.Join(file, "history"), 2)
+	if err == nil {
+		t.Error("export under a file succeeded")
+	}
+
+	failure := errors.New("disk is full")
+	err = svc.HistoryTo(payments, failingSink{err: failure}, HistoryOptions{})
+	if err != failure {
+		t.Errorf("\ngot > %v \nwant > %v", err, failure)
+	}
+}
+
+func TestService_HistoryFromFiles(t *testing.T) {
+	svc := newExportService(t)
+	svc.SetExportEncoding(ExportEncoding{Compression: CompressGzip, Keys: StaticKey(testKey)})
+	payments := historyPayments(t, svc)
+
+	dir := t.TempDir()
+	err := svc.HistoryToFiles(payments, dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := svc.HistoryFromFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(t, got, payments)
+}
+
+func TestService_HistoryFrom_corrupted(t *testing.T) {
+	svc := newExportService(t)
+	payments := historyPayments(t, svc)
+	sink := memorySink{}
+	err := svc.HistoryTo(payments, sink, HistoryOptions{MaxRecords: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := fstest.MapFS{}
+	for name, file := range sink {
+		missing[name] = file
+	}
+	delete(missing, "payments2.dump")
+	_, err = svc.HistoryFrom(missing)
+	if !errors.Is(err, ErrCorruptedExport) {
+		t.Errorf("missing part\ngot > %v \nwant > %v", err, ErrCorruptedExport)
+	}
+
+	// A manifest counting other payments than the parts hold is
+	// rejected even when the checksums match.
+	m, err := readManifest(fstest.MapFS(sink), formatHistory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Files[0].Records = 1
+	manifests := memorySink{}
+	err = (&manifestSink{sink: manifests, manifest: *m}).writeManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink[manifestName] = manifests[manifestName]
+	_, err = svc.HistoryFrom(fstest.MapFS(sink))
+	if !errors.Is(err, ErrCorruptedExport) {
+		t.Errorf("wrong count\ngot > %v \nwant > %v", err, ErrCorruptedExport)
+	}
+}
+
+func TestService_HistoryTo_escaping(t *testing.T) {
+	svc := &Service{}
+	payments := []types.Payment{
+		{ID: "p1", AccountID: 1, Amount: 10, Category: "a;b", Status: types.PaymentStatusOk},
+		{ID: "p2", AccountID: 1, Amount: 20, Category: "line\nbreak\\", Status: types.PaymentStatusFail},
+	}
+	sink := memorySink{}
+	err := svc.HistoryTo(payments, sink, HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(sink["payments.dump"].Data, []byte("\n")); lines != len(payments) {
+		t.Errorf("wrong number of lines\ngot > %v \nwant > %v", lines, len(payments))
+	}
+
+	got, err := svc.HistoryFrom(fstest.MapFS(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(t, got, payments)
+}
+
+func TestService_HistoryFrom_legacy(t *testing.T) {
+	svc := &Service{}
+	history := fstest.MapFS{
+		"payments1.dump": &fstest.MapFile{Data: []byte("p1;1;10;auto;OK\np2;1;20;cafe;FAIL\n")},
+		"payments2.dump": &fstest.MapFile{Data: []byte("p3;2;30;auto;INPROGRESS\n")},
+		"payments4.dump": &fstest.MapFile{Data: []byte("p5;2;50;auto;OK\n")},
+	}
+	payments, err := svc.HistoryFrom(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.Payment{
+		{ID: "p1", AccountID: 1, Amount: 10, Category: "auto", Status: types.PaymentStatusOk},
+		{ID: "p2", AccountID: 1, Amount: 20, Category: "cafe", Status: types.PaymentStatusFail},
+		{ID: "p3", AccountID: 2, Amount: 30, Category: "auto", Status: types.PaymentStatusInProgress},
+	}
+	if !reflect.DeepEqual(payments, want) {
+		t.Errorf("\ngot > %v \nwant > %v", payments, want)
+	}
+
+	_, err = svc.HistoryFrom(fstest.MapFS{})
+	if err != ErrFileNotFound {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrFileNotFound)
+	}
+}
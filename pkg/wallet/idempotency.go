@@ -0,0 +1,215 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+var (
+	ErrIdempotencyRecordNotFound = errors.New("idempotency record not found")
+	ErrIdempotencyConflict       = errors.New("idempotency key was used with other parameters")
+)
+
+// DefaultIdempotencyWindow is how long an idempotency key is remembered
+// unless SetIdempotencyWindow says otherwise.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// keyLock serializes requests made with the same idempotency key. refs counts
+// the callers holding or waiting for it, so that the lock can be dropped
+// once nobody needs it.
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// SetIdempotencyWindow sets how long an idempotency key is remembered. A key
+// used again after the window is treated as a new one.
+func (s *Service) SetIdempotencyWindow(window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idempotencyWindow = window
+}
+
+func (s *Service) window() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idempotencyWindow <= 0 {
+		return DefaultIdempotencyWindow
+	}
+	return s.idempotencyWindow
+}
+
+// PayWithKey is Pay made at most once per key: calling it again with the same
+// key and parameters returns the original payment, calling it with the same
+// key and other parameters fails with ErrIdempotencyConflict. An empty key
+// makes a plain Pay.
+func (s *Service) PayWithKey(key string, accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	if key == "" {
+		return s.Pay(accountID, amount, category)
+	}
+	request := fmt.Sprintf("pay;%d;%d;%q", accountID, amount, category)
+	return s.idempotent(key, request, func(record *types.IdempotencyRecord) (*types.Payment, error) {
+		return s.pay(accountID, inAccountCurrency(amount), category, record)
+	})
+}
+
+// DepositWithKey is Deposit made at most once per key, see PayWithKey.
+func (s *Service) DepositWithKey(key string, accountID int64, amount types.Money) error {
+	if key == "" {
+		return s.Deposit(accountID, amount)
+	}
+	request := fmt.Sprintf("deposit;%d;%d", accountID, amount)
+	_, err := s.idempotent(key, request, func(record *types.IdempotencyRecord) (*types.Payment, error) {
+		return nil, s.deposit(accountID, inAccountCurrency(amount), record)
+	})
+	return err
+}
+
+// RepeatWithKey is Repeat made at most once per key, see PayWithKey.
+func (s *Service) RepeatWithKey(key string, paymentID string) (*types.Payment, error) {
+	if key == "" {
+		return s.Repeat(paymentID)
+	}
+	request := fmt.Sprintf("repeat;%q", paymentID)
+	return s.idempotent(key, request, func(record *types.IdempotencyRecord) (*types.Payment, error) {
+		return s.repeat(paymentID, record)
+	})
+}
+
+// PayFromFavoriteWithKey is PayFromFavorite made at most once per key, see
+// PayWithKey.
+func (s *Service) PayFromFavoriteWithKey(key string, favoriteID string) (*types.Payment, error) {
+	if key == "" {
+		return s.PayFromFavorite(favoriteID)
+	}
+	request := fmt.Sprintf("favorite;%q", favoriteID)
+	return s.idempotent(key, request, func(record *types.IdempotencyRecord) (*types.Payment, error) {
+		return s.payFromFavorite(favoriteID, record)
+	})
+}
+
+// PurgeIdempotencyRecords forgets the keys whose window has passed and
+// returns how many were removed. Every record is checked again in the
+// transaction deleting it, so a key used anew meanwhile is kept.
+func (s *Service) PurgeIdempotencyRecords() (int, error) {
+	records, err := s.repository().IdempotencyRecords()
+	if err != nil {
+		return 0, err
+	}
+
+	now := s.now()
+	window := s.window()
+	purged := 0
+	err = s.repository().Update(func(tx Tx) error {
+		purged = 0
+		for _, record := range records {
+			if !expired(&record, now, window) {
+				continue
+			}
+			stored, err := tx.FindIdempotencyRecord(record.Key)
+			if err == ErrIdempotencyRecordNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !expired(stored, now, window) {
+				continue
+			}
+			err = tx.DeleteIdempotencyRecord(record.Key)
+			if err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// idempotent runs operation unless a live record of the key exists. The
+// operation must save the record it is given in the transaction making its
+// changes, so that the result and the record are stored together.
+func (s *Service) idempotent(key string, request string, operation func(record *types.IdempotencyRecord) (*types.Payment, error)) (*types.Payment, error) {
+	keyHash := hash(key)
+	requestHash := hash(request)
+
+	unlock := s.lockKey(keyHash)
+	defer unlock()
+
+	now := s.now()
+	record, err := s.repository().FindIdempotencyRecord(keyHash)
+	if err != nil && err != ErrIdempotencyRecordNotFound {
+		return nil, err
+	}
+	if err == nil && !expired(record, now, s.window()) {
+		if record.Request != requestHash {
+			return nil, ErrIdempotencyConflict
+		}
+		if record.PaymentID == "" {
+			return nil, nil
+		}
+		return s.FindPaymentByID(record.PaymentID)
+	}
+
+	return operation(&types.IdempotencyRecord{
+		Key:       keyHash,
+		Request:   requestHash,
+		CreatedAt: now,
+	})
+}
+
+// lockKey acquires the lock of the key and returns the function releasing
+// it.
+func (s *Service) lockKey(key string) func() {
+	s.mu.Lock()
+	if s.keyLocks == nil {
+		s.keyLocks = make(map[string]*keyLock)
+	}
+	lock, ok := s.keyLocks[key]
+	if !ok {
+		lock = &keyLock{}
+		s.keyLocks[key] = lock
+	}
+	lock.refs++
+	s.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		s.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(s.keyLocks, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// saveIdempotencyRecord saves the record, if any, with the ID of the payment
+// the request made.
+func saveIdempotencyRecord(tx Tx, record *types.IdempotencyRecord, paymentID string) error {
+	if record == nil {
+		return nil
+	}
+	record.PaymentID = paymentID
+	return tx.SaveIdempotencyRecord(*record)
+}
+
+func expired(record *types.IdempotencyRecord, now time.Time, window time.Duration) bool {
+	return !record.CreatedAt.Add(window).After(now)
+}
+
+func hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,287 @@
+package wallet
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func TestService_PayWithKey_replay(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	first, err := svc.PayWithKey("key-1", account.ID, 10, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.PayWithKey("key-1", account.ID, 10, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != second.ID {
+		t.Errorf("replay made a new payment\ngot > %v \nwant > %v", second.ID, first.ID)
+	}
+	checkBalance(t, svc, account.ID, 60)
+
+	_, err = svc.PayWithKey("key-1", account.ID, 20, "food")
+	if err != ErrIdempotencyConflict {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrIdempotencyConflict)
+	}
+	checkBalance(t, svc, account.ID, 60)
+}
+
+func TestService_PayWithKey_failureIsNotRemembered(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	_, err := svc.PayWithKey("key-1", account.ID, 100, "food")
+	if err != ErrNotEnoughBalance {
+		t.Fatalf("\ngot > %v \nwant > %v", err, ErrNotEnoughBalance)
+	}
+	err = svc.Deposit(account.ID, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.PayWithKey("key-1", account.ID, 100, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, svc, account.ID, 0)
+}
+
+func TestService_DepositWithKey_replay(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	for i := 0; i < 3; i++ {
+		err := svc.DepositWithKey("key-1", account.ID, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkBalance(t, svc, account.ID, 120)
+
+	err := svc.DepositWithKey("key-1", account.ID, 60)
+	if err != ErrIdempotencyConflict {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrIdempotencyConflict)
+	}
+}
+
+func TestService_RepeatWithKey_replay(t *testing.T) {
+	w := newTestWallet(t)
+	from, to := w.account("+992000000001", 100), w.account("+992000000002", 0)
+	svc := w.Service
+
+	outgoing, err := svc.Transfer(from.ID, to.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := svc.RepeatWithKey("key-1", outgoing.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.RepeatWithKey("key-1", outgoing.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != second.ID {
+		t.Errorf("replay made a new transfer\ngot > %v \nwant > %v", second.ID, first.ID)
+	}
+	checkBalance(t, svc, from.ID, 80)
+	checkBalance(t, svc, to.ID, 20)
+}
+
+func TestService_PayFromFavoriteWithKey_replay(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	favorite, err := svc.FavoritePayment(payment.ID, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := svc.PayFromFavoriteWithKey("key-1", favorite.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.PayFromFavoriteWithKey("key-1", favorite.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != second.ID {
+		t.Errorf("replay made a new payment\ngot > %v \nwant > %v", second.ID, first.ID)
+	}
+	checkBalance(t, svc, account.ID, 40)
+
+	// the same key can't be reused for another kind of request
+	_, err = svc.RepeatWithKey("key-1", payment.ID)
+	if err != ErrIdempotencyConflict {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrIdempotencyConflict)
+	}
+}
+
+func TestService_PayWithKey_expired(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	w.pay(account.ID, 30, "auto")
+	svc := w.Service
+	svc.SetIdempotencyWindow(time.Nanosecond)
+
+	first, err := svc.PayWithKey("key-1", account.ID, 10, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.clock.Add(time.Millisecond)
+	second, err := svc.PayWithKey("key-1", account.ID, 20, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID {
+		t.Error("expired key returned the old payment")
+	}
+	checkBalance(t, svc, account.ID, 40)
+
+	w.clock.Add(time.Millisecond)
+	purged, err := svc.PurgeIdempotencyRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("wrong number of purged records\ngot > %v \nwant > %v", purged, 1)
+	}
+}
+
+func TestService_PayWithKey_concurrent(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	payments := make([]*types.Payment, 20)
+	wg := sync.WaitGroup{}
+	for i := range payments {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payment, err := svc.PayWithKey("key-1", account.ID, 10, "food")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			payments[i] = payment
+		}(i)
+	}
+	wg.Wait()
+
+	for _, payment := range payments {
+		if payment != nil && payment.ID != payments[0].ID {
+			t.Errorf("key made several payments => %v, %v", payment.ID, payments[0].ID)
+		}
+	}
+	checkBalance(t, svc, account.ID, 60)
+}
+
+func TestService_PayWithKey_survivesExportImport(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	payment, err := svc.PayWithKey("key-1", account.ID, 10, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = svc.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := &Service{}
+	imported.SetClock(w.clock.Now)
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := imported.PayWithKey("key-1", account.ID, 10, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ID != payment.ID {
+		t.Errorf("\ngot > %v \nwant > %v", replayed.ID, payment.ID)
+	}
+	checkBalance(t, imported, account.ID, 60)
+}
+
+// recordsHookRepository calls listed, if set, after listing the idempotency
+// records.
+type recordsHookRepository struct {
+	Repository
+	listed func()
+}
+
+func (r *recordsHookRepository) IdempotencyRecords() ([]types.IdempotencyRecord, error) {
+	records, err := r.Repository.IdempotencyRecords()
+	if r.listed != nil {
+		r.listed()
+	}
+	return records, err
+}
+
+func TestService_PurgeIdempotencyRecords_keepsReusedKey(t *testing.T) {
+	clock := newTestClock()
+	repo := &recordsHookRepository{Repository: NewMemoryRepository()}
+	svc := NewService(repo)
+	svc.SetClock(clock.Now)
+	svc.SetIdempotencyWindow(time.Hour)
+
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.PayWithKey("key-1", account.ID, 10, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Add(2 * time.Hour)
+	var reused *types.Payment
+	repo.listed = func() {
+		// the expired key is used anew while the purge runs
+		reused, err = svc.PayWithKey("key-1", account.ID, 10, "food")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	purged, err := svc.PurgeIdempotencyRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.listed = nil
+	if purged != 0 {
+		t.Errorf("\ngot > %v \nwant > %v", purged, 0)
+	}
+
+	retried, err := svc.PayWithKey("key-1", account.ID, 10, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.ID != reused.ID {
+		t.Errorf("retry made a new payment \ngot > %v \nwant > %v", retried.ID, reused.ID)
+	}
+	checkBalance(t, svc, account.ID, 80)
+}
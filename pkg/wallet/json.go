@@ -0,0 +1,314 @@
+package wallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// ExportJSON writes the accounts, payments and favorites of the wallet to
+// accounts.json, payments.json and favorites.json in dir. Every file holds
+// a JSON array, written one record at a time.
+func (s *Service) ExportJSON(dir string) error {
+	return s.ExportJSONTo(DirSink(dir))
+}
+
+// ExportJSONTo writes the files of ExportJSON to sink, followed by the
+// manifest of the export.
+func (s *Service) ExportJSONTo(sink FileSink) error {
+	data, err := fetchWalletData(s.repository())
+	if err != nil {
+		return err
+	}
+
+	files := newManifestSink(sink, formatJSON, s.now(), s.exportEncoding().Keys)
+	encoded := s.encodingSink(files)
+	for _, file := range jsonFiles {
+		err := exportFile(encoded, file.name, func(w io.Writer) error {
+			return file.encode(w, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return files.writeManifest()
+}
+
+// ImportJSON reads the files written by ExportJSON from dir into the
+// wallet.
+func (s *Service) ImportJSON(dir string) error {
+	return s.ImportJSONFrom(os.DirFS(dir), ImportMerge)
+}
+
+// ImportJSONFrom reads the files of ExportJSONTo from fsys into the
+// wallet as mode says. Missing files are skipped.
+func (s *Service) ImportJSONFrom(fsys fs.FS, mode ImportMode) error {
+	fsys, err := openManifest(fsys, formatJSON, s.exportEncoding().Keys)
+	if err != nil {
+		return err
+	}
+	fsys = s.decodingFS(fsys)
+
+	data := &walletData{}
+	for _, file := range jsonFiles {
+		err := importFile(fsys, file.name, func(r io.Reader) error {
+			return file.decode(r, data)
+		})
+		if err == ErrFileNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+	}
+
+	return s.load(data, mode)
+}
+
+// jsonFile tells how one collection of walletData is exported as JSON.
+// record returns the i-th record of the collection, add decodes the next
+// record and appends it to the collection.
+type jsonFile struct {
+	name   string
+	size   func(data *walletData) int
+	record func(data *walletData, i int) interface{}
+	add    func(data *walletData, decoder *json.Decoder) error
+}
+
+var jsonFiles = []jsonFile{
+	{
+		name:   "accounts.json",
+		size:   func(data *walletData) int { return len(data.accounts) },
+		record: func(data *walletData, i int) interface{} { return newJSONAccount(data.accounts[i]) },
+		add: func(data *walletData, decoder *json.Decoder) error {
+			var account jsonAccount
+			err := decoder.Decode(&account)
+			if err != nil {
+				return err
+			}
+			data.accounts = append(data.accounts, account.account())
+			return nil
+		},
+	},
+	{
+		name:   "payments.json",
+		size:   func(data *walletData) int { return len(data.payments) },
+		record: func(data *walletData, i int) interface{} { return newJSONPayment(data.payments[i]) },
+		add: func(data *walletData, decoder *json.Decoder) error {
+			var payment jsonPayment
+			err := decoder.Decode(&payment)
+			if err != nil {
+				return err
+			}
+			data.payments = append(data.payments, payment.payment())
+			return nil
+		},
+	},
+	{
+		name:   "favorites.json",
+		size:   func(data *walletData) int { return len(data.favorites) },
+		record: func(data *walletData, i int) interface{} { return newJSONFavorite(data.favorites[i]) },
+		add: func(data *walletData, decoder *json.Decoder) error {
+			var favorite jsonFavorite
+			err := decoder.Decode(&favorite)
+			if err != nil {
+				return err
+			}
+			data.favorites = append(data.favorites, favorite.favorite())
+			return nil
+		},
+	},
+}
+
+// encode writes the collection as a JSON array with one record per line.
+func (file jsonFile) encode(w io.Writer, data *walletData) error {
+	_, err := io.WriteString(w, "[")
+	if err != nil {
+		return err
+	}
+	for i := 0; i < file.size(data); i++ {
+		record, err := json.Marshal(file.record(data, i))
+		if err != nil {
+			return err
+		}
+		separator := ",\n"
+		if i == 0 {
+			separator = "\n"
+		}
+		_, err = io.WriteString(w, separator)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
+
+// decode reads a JSON array of the collection record by record.
+func (file jsonFile) decode(r io.Reader, data *walletData) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("want a JSON array, got %v", token)
+	}
+	for record := 1; decoder.More(); record++ {
+		err := file.add(data, decoder)
+		if err != nil {
+			return &DumpError{Record: record, Err: err}
+		}
+	}
+	_, err = decoder.Token()
+	return err
+}
+
+type jsonAccount struct {
+	ID       int64  `json:"id"`
+	Phone    string `json:"phone"`
+	Balance  int64  `json:"balance"`
+	Currency string `json:"currency"`
+}
+
+func newJSONAccount(account types.Account) jsonAccount {
+	return jsonAccount{
+		ID:       account.ID,
+		Phone:    string(account.Phone),
+		Balance:  int64(account.Balance),
+		Currency: string(account.Currency),
+	}
+}
+
+func (a jsonAccount) account() types.Account {
+	currency := types.Currency(a.Currency)
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return types.Account{
+		ID:       a.ID,
+		Phone:    types.Phone(a.Phone),
+		Balance:  types.Money(a.Balance),
+		Currency: currency,
+	}
+}
+
+type jsonTransition struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+type jsonPayment struct {
+	ID              string           `json:"id"`
+	AccountID       int64            `json:"accountId"`
+	Amount          int64            `json:"amount"`
+	Category        string           `json:"category"`
+	Status          string           `json:"status"`
+	LinkedPaymentID string           `json:"linkedPaymentId,omitempty"`
+	Transitions     []jsonTransition `json:"transitions,omitempty"`
+	CreatedAt       *time.Time       `json:"createdAt,omitempty"`
+	UpdatedAt       *time.Time       `json:"updatedAt,omitempty"`
+	FavoriteID      string           `json:"favoriteId,omitempty"`
+}
+
+func newJSONPayment(payment types.Payment) jsonPayment {
+	record := jsonPayment{
+		ID:              payment.ID,
+		AccountID:       payment.AccountID,
+		Amount:          int64(payment.Amount),
+		Category:        string(payment.Category),
+		Status:          string(payment.Status),
+		LinkedPaymentID: payment.LinkedPaymentID,
+		CreatedAt:       jsonTime(payment.CreatedAt),
+		UpdatedAt:       jsonTime(payment.UpdatedAt),
+		FavoriteID:      payment.FavoriteID,
+	}
+	for _, transition := range payment.Transitions {
+		record.Transitions = append(record.Transitions, jsonTransition{
+			Status: string(transition.Status),
+			At:     transition.At,
+		})
+	}
+	return record
+}
+
+func (p jsonPayment) payment() types.Payment {
+	payment := types.Payment{
+		ID:              p.ID,
+		AccountID:       p.AccountID,
+		Amount:          types.Money(p.Amount),
+		Category:        types.PaymentCategory(p.Category),
+		Status:          types.PaymentStatus(p.Status),
+		LinkedPaymentID: p.LinkedPaymentID,
+		CreatedAt:       fromJSONTime(p.CreatedAt),
+		UpdatedAt:       fromJSONTime(p.UpdatedAt),
+		FavoriteID:      p.FavoriteID,
+	}
+	for _, transition := range p.Transitions {
+		payment.Transitions = append(payment.Transitions, types.PaymentTransition{
+			Status: types.PaymentStatus(transition.Status),
+			At:     transition.At,
+		})
+	}
+	return payment
+}
+
+type jsonFavorite struct {
+	ID        string     `json:"id"`
+	AccountID int64      `json:"accountId"`
+	Name      string     `json:"name"`
+	Amount    int64      `json:"amount"`
+	Category  string     `json:"category"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+func newJSONFavorite(favorite types.Favorite) jsonFavorite {
+	return jsonFavorite{
+		ID:        favorite.ID,
+		AccountID: favorite.AccountID,
+		Name:      favorite.Name,
+		Amount:    int64(favorite.Amount),
+		Category:  string(favorite.Category),
+		CreatedAt: jsonTime(favorite.CreatedAt),
+		UpdatedAt: jsonTime(favorite.UpdatedAt),
+	}
+}
+
+func (f jsonFavorite) favorite() types.Favorite {
+	return types.Favorite{
+		ID:        f.ID,
+		AccountID: f.AccountID,
+		Name:      f.Name,
+		Amount:    types.Money(f.Amount),
+		Category:  types.PaymentCategory(f.Category),
+		CreatedAt: fromJSONTime(f.CreatedAt),
+		UpdatedAt: fromJSONTime(f.UpdatedAt),
+	}
+}
+
+// jsonTime leaves the zero time, which records imported from older dumps
+// have, out of the JSON.
+func jsonTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func fromJSONTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
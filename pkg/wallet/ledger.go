@@ -0,0 +1,181 @@
+package wallet
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+var ErrEntryNotFound = errors.New("ledger entry not found")
+
+// System accounts of the ledger. Money enters the wallet through
+// LedgerCashIn, leaves it to the merchant account of the payment category
+// and comes back to the customers through LedgerRefunds. LedgerOpening
+// holds the balances imported without the ledger entries behind them.
+const (
+	LedgerCashIn  types.LedgerAccount = "system:cash-in"
+	LedgerRefunds types.LedgerAccount = "system:refunds"
+	LedgerOpening types.LedgerAccount = "system:opening-balance"
+)
+
+// Discrepancy describes an account whose Balance disagrees with its ledger
+// entries.
+type Discrepancy struct {
+	AccountID     int64
+	Balance       types.Money
+	LedgerBalance types.Money
+}
+
+// AccountLedger returns the ledger account of a wallet account.
+func AccountLedger(accountID int64) types.LedgerAccount {
+	return types.LedgerAccount("account:" + strconv.FormatInt(accountID, 10))
+}
+
+// MerchantLedger returns the ledger account that receives the payments of
+// the category.
+func MerchantLedger(category types.PaymentCategory) types.LedgerAccount {
+	return types.LedgerAccount("merchant:" + string(category))
+}
+
+// LedgerBalance returns credits minus debits of the ledger account. For a
+// wallet account it equals the balance the account should have.
+func (s *Service) LedgerBalance(ledger types.LedgerAccount) (types.Money, error) {
+	entries, err := s.repository().LedgerEntries(ledger)
+	if err != nil {
+		return 0, err
+	}
+	return ledgerBalance(entries), nil
+}
+
+// LedgerEntries returns the entries of the ledger account in the order they
+// were written.
+func (s *Service) LedgerEntries(ledger types.LedgerAccount) ([]types.Entry, error) {
+	return s.repository().LedgerEntries(ledger)
+}
+
+// Reconcile compares the Balance of every account with its ledger entries
+// and returns the accounts where they differ. Every account is compared
+// under its lock, so payments made meanwhile are not taken for
+// discrepancies.
+func (s *Service) Reconcile() ([]Discrepancy, error) {
+	accounts, err := s.repository().Accounts()
+	if err != nil {
+		return nil, err
+	}
+
+	var discrepancies []Discrepancy
+	for _, account := range accounts {
+		discrepancy, err := s.reconcileAccount(account.ID)
+		if err == ErrAccountNotFound {
+			// removed since the accounts were listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if discrepancy != nil {
+			discrepancies = append(discrepancies, *discrepancy)
+		}
+	}
+	return discrepancies, nil
+}
+
+// reconcileAccount compares the Balance of the account with its ledger
+// entries and returns the discrepancy, if any.
+func (s *Service) reconcileAccount(accountID int64) (*Discrepancy, error) {
+	unlock, err := s.lockAccount(accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	account, err := s.repository().FindAccount(accountID)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := s.LedgerBalance(AccountLedger(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if ledger == account.Balance {
+		return nil, nil
+	}
+	return &Discrepancy{
+		AccountID:     accountID,
+		Balance:       account.Balance,
+		LedgerBalance: ledger,
+	}, nil
+}
+
+func ledgerBalance(entries []types.Entry) types.Money {
+	balance := types.Money(0)
+	for _, entry := range entries {
+		if entry.Side == types.EntrySideCredit {
+			balance += entry.Amount
+		} else {
+			balance -= entry.Amount
+		}
+	}
+	return balance
+}
+
+// balanceLedgers makes the ledger of every account add up to its Balance,
+// posting the difference from LedgerOpening. Imports call it for the
+// accounts they store, as JSON, CSV and older dumps carry balances without
+// ledger entries.
+func balanceLedgers(tx Tx, accountIDs []int64, at time.Time) error {
+	for _, accountID := range accountIDs {
+		account, err := tx.FindAccount(accountID)
+		if err != nil {
+			return err
+		}
+		ledger := AccountLedger(accountID)
+		entries, err := tx.LedgerEntries(ledger)
+		if err != nil {
+			return err
+		}
+
+		opening := currencyLedger(LedgerOpening, currencyOf(account))
+		difference := account.Balance - ledgerBalance(entries)
+		switch {
+		case difference > 0:
+			err = postLedger(tx, opening, ledger, difference, "", at)
+		case difference < 0:
+			err = postLedger(tx, ledger, opening, -difference, "", at)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postLedger writes a balanced pair of entries moving amount from the debit
+// account to the credit account.
+func postLedger(tx Tx, debit types.LedgerAccount, credit types.LedgerAccount, amount types.Money, paymentID string, at time.Time) error {
+	transactionID := uuid.New().String()
+	err := tx.SaveEntry(types.Entry{
+		ID:            uuid.New().String(),
+		TransactionID: transactionID,
+		Account:       debit,
+		Side:          types.EntrySideDebit,
+		Amount:        amount,
+		PaymentID:     paymentID,
+		CreatedAt:     at,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.SaveEntry(types.Entry{
+		ID:            uuid.New().String(),
+		TransactionID: transactionID,
+		Account:       credit,
+		Side:          types.EntrySideCredit,
+		Amount:        amount,
+		PaymentID:     paymentID,
+		CreatedAt:     at,
+	})
+}
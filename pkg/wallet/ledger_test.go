@@ -0,0 +1,161 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func TestService_Ledger_balancedEntries(t *testing.T) {
+	svc := &Service{}
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := svc.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Pay(account.ID, 20, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := svc.repository().Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 8 {
+		t.Fatalf("wrong number of entries\ngot > %v \nwant > %v", len(entries), 8)
+	}
+	transactions := map[string]types.Money{}
+	for _, entry := range entries {
+		if entry.Side == types.EntrySideDebit {
+			transactions[entry.TransactionID] += entry.Amount
+		} else {
+			transactions[entry.TransactionID] -= entry.Amount
+		}
+	}
+	for id, sum := range transactions {
+		if sum != 0 {
+			t.Errorf("transaction %v is not balanced, debit - credit => %v", id, sum)
+		}
+	}
+
+	balances := map[types.LedgerAccount]types.Money{
+		AccountLedger(account.ID): 80,
+		LedgerCashIn:              -100,
+		MerchantLedger("auto"):    30,
+		MerchantLedger("food"):    20,
+		LedgerRefunds:             -30,
+	}
+	for ledger, want := range balances {
+		got, err := svc.LedgerBalance(ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("wrong balance of %v\ngot > %v \nwant > %v", ledger, got, want)
+		}
+	}
+
+	discrepancies, err := svc.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discrepancies) != 0 {
+		t.Errorf("unexpected discrepancies => %v", discrepancies)
+	}
+}
+
+func TestService_Reconcile_reportsDiscrepancy(t *testing.T) {
+	svc := &Service{}
+	first, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(first.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(second.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change the balance behind the ledger's back
+	err = svc.repository().Update(func(tx Tx) error {
+		account, err := tx.FindAccount(second.ID)
+		if err != nil {
+			return err
+		}
+		account.Balance = 150
+		return tx.SaveAccount(*account)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discrepancies, err := svc.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Discrepancy{AccountID: second.ID, Balance: 150, LedgerBalance: 100}
+	if len(discrepancies) != 1 || discrepancies[0] != want {
+		t.Errorf("\ngot > %v \nwant > %v", discrepancies, []Discrepancy{want})
+	}
+}
+
+func TestService_Ledger_survivesExportImport(t *testing.T) {
+	svc := &Service{}
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = svc.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := &Service{}
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discrepancies, err := imported.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discrepancies) != 0 {
+		t.Errorf("unexpected discrepancies => %v", discrepancies)
+	}
+	entries, err := imported.LedgerEntries(AccountLedger(account.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("wrong number of entries\ngot > %v \nwant > %v", len(entries), 2)
+	}
+}
@@ -0,0 +1,143 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+var ErrIllegalTransition = errors.New("illegal payment status transition")
+
+// TransitionError is returned when a payment can't move from its current
+// status to the requested one. It matches ErrIllegalTransition with
+// errors.Is.
+type TransitionError struct {
+	PaymentID string
+	From      types.PaymentStatus
+	To        types.PaymentStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("payment %s: can't move from %s to %s", e.PaymentID, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrIllegalTransition
+}
+
+// paymentTransitions lists the statuses a payment may move to from each
+// status. A payment starts INPROGRESS; OK, FAIL, CANCELLED and EXPIRED are
+// final except that a confirmed payment can still be rejected.
+var paymentTransitions = map[types.PaymentStatus][]types.PaymentStatus{
+	types.PaymentStatusInProgress: {
+		types.PaymentStatusOk,
+		types.PaymentStatusFail,
+		types.PaymentStatusCancelled,
+		types.PaymentStatusExpired,
+	},
+	types.PaymentStatusOk: {
+		types.PaymentStatusFail,
+	},
+}
+
+func canTransition(from types.PaymentStatus, to types.PaymentStatus) bool {
+	for _, status := range paymentTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// refundedStatuses lists the statuses of the payments whose money went back
+// to the account.
+var refundedStatuses = []types.PaymentStatus{
+	types.PaymentStatusFail,
+	types.PaymentStatusCancelled,
+	types.PaymentStatusExpired,
+}
+
+// refunds reports whether moving to the status returns the money to the
+// account.
+func refunds(status types.PaymentStatus) bool {
+	return status != types.PaymentStatusOk
+}
+
+// Confirm marks an INPROGRESS payment as OK.
+func (s *Service) Confirm(paymentID string) error {
+	return s.changeStatus(paymentID, types.PaymentStatusOk)
+}
+
+// Cancel cancels an INPROGRESS payment on behalf of the customer and
+// returns the money to the account.
+func (s *Service) Cancel(paymentID string) error {
+	return s.changeStatus(paymentID, types.PaymentStatusCancelled)
+}
+
+// Expire marks an INPROGRESS payment that was never confirmed as EXPIRED and
+// returns the money to the account.
+func (s *Service) Expire(paymentID string) error {
+	return s.changeStatus(paymentID, types.PaymentStatusExpired)
+}
+
+// changeStatus moves the payment, or both payments of a transfer, to the
+// status, refunding the amount if the status requires it.
+func (s *Service) changeStatus(paymentID string, status types.PaymentStatus) error {
+	payment, err := s.FindPaymentByID(paymentID)
+	if err != nil {
+		return err
+	}
+	if payment.LinkedPaymentID != "" {
+		return s.changeTransferStatus(payment, status)
+	}
+
+	unlock, err := s.lockAccount(payment.AccountID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// read the payment again, another call may have changed it meanwhile
+	payment, err = s.FindPaymentByID(paymentID)
+	if err != nil {
+		return err
+	}
+	if !canTransition(payment.Status, status) {
+		return &TransitionError{PaymentID: payment.ID, From: payment.Status, To: status}
+	}
+	account, err := s.repository().FindAccount(payment.AccountID)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	setStatus(payment, status, now)
+	if refunds(status) {
+		account.Balance += payment.Amount
+	}
+	return s.repository().Update(func(tx Tx) error {
+		if err := tx.SavePayment(*payment); err != nil {
+			return err
+		}
+		if !refunds(status) {
+			return nil
+		}
+		if err := tx.SaveAccount(*account); err != nil {
+			return err
+		}
+		refunds := currencyLedger(LedgerRefunds, currencyOf(account))
+		return postLedger(tx, refunds, AccountLedger(account.ID), payment.Amount, payment.ID, now)
+	})
+}
+
+// setStatus changes the status of the payment and records the transition.
+// It also marks the payment as updated at that time.
+func setStatus(payment *types.Payment, status types.PaymentStatus, at time.Time) {
+	transitions := make([]types.PaymentTransition, len(payment.Transitions), len(payment.Transitions)+1)
+	copy(transitions, payment.Transitions)
+	payment.Transitions = append(transitions, types.PaymentTransition{Status: status, At: at})
+	payment.Status = status
+	payment.UpdatedAt = at
+}
@@ -0,0 +1,231 @@
+package wallet
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func checkStatus(t *testing.T, svc *Service, paymentID string, want ...types.PaymentStatus) {
+	t.Helper()
+	payment, err := svc.FindPaymentByID(paymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != want[len(want)-1] {
+		t.Errorf("wrong status\ngot > %v \nwant > %v", payment.Status, want[len(want)-1])
+	}
+	if len(payment.Transitions) != len(want) {
+		t.Fatalf("wrong transitions\ngot > %v \nwant > %v", payment.Transitions, want)
+	}
+	for i, transition := range payment.Transitions {
+		if transition.Status != want[i] || transition.At.IsZero() {
+			t.Errorf("wrong transition %v\ngot > %v \nwant > %v", i, transition, want[i])
+		}
+	}
+}
+
+func TestService_Confirm(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	err := svc.Confirm(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, svc, payment.ID, types.PaymentStatusOk)
+	checkBalance(t, svc, account.ID, 70)
+
+	err = svc.Confirm(payment.ID)
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrIllegalTransition)
+	}
+}
+
+func TestService_Reject_twice(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	err := svc.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Reject(payment.ID)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) {
+		t.Fatalf("\ngot > %v \nwant > %T", err, transitionErr)
+	}
+	if transitionErr.From != types.PaymentStatusFail || transitionErr.To != types.PaymentStatusFail {
+		t.Errorf("wrong error => %v", transitionErr)
+	}
+	checkStatus(t, svc, payment.ID, types.PaymentStatusFail)
+	checkBalance(t, svc, account.ID, 100)
+}
+
+func TestService_Reject_confirmed(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	err := svc.Confirm(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, svc, payment.ID, types.PaymentStatusOk, types.PaymentStatusFail)
+	checkBalance(t, svc, account.ID, 100)
+}
+
+func TestService_Cancel(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	err := svc.Cancel(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, svc, payment.ID, types.PaymentStatusCancelled)
+	checkBalance(t, svc, account.ID, 100)
+
+	err = svc.Reject(payment.ID)
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrIllegalTransition)
+	}
+}
+
+func TestService_Cancel_confirmed(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	err := svc.Confirm(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Cancel(payment.ID)
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrIllegalTransition)
+	}
+	checkBalance(t, svc, account.ID, 70)
+}
+
+func TestService_Expire(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	err := svc.Expire(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, svc, payment.ID, types.PaymentStatusExpired)
+	checkBalance(t, svc, account.ID, 100)
+
+	discrepancies, err := svc.Reconcile()
+	if err != nil || len(discrepancies) != 0 {
+		t.Errorf("unexpected discrepancies => %v, err => %v", discrepancies, err)
+	}
+}
+
+func TestService_Reject_concurrentRefundsOnce(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	svc := w.Service
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := svc.Reject(payment.ID)
+			if err != nil && !errors.Is(err, ErrIllegalTransition) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	checkBalance(t, svc, account.ID, 100)
+}
+
+func TestService_Confirm_transfer(t *testing.T) {
+	w := newTestWallet(t)
+	from, to := w.account("+992000000001", 100), w.account("+992000000002", 0)
+	svc := w.Service
+
+	outgoing, err := svc.Transfer(from.ID, to.ID, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Confirm(outgoing.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, svc, outgoing.ID, types.PaymentStatusOk)
+	checkStatus(t, svc, outgoing.LinkedPaymentID, types.PaymentStatusOk)
+	checkBalance(t, svc, from.ID, 60)
+	checkBalance(t, svc, to.ID, 40)
+
+	err = svc.Cancel(outgoing.LinkedPaymentID)
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrIllegalTransition)
+	}
+}
+
+func TestService_Transitions_survivesExportImport(t *testing.T) {
+	w := newTestWallet(t)
+	payment := w.pay(w.account("+992000000001", 100).ID, 30, "auto")
+	svc := w.Service
+
+	err := svc.Confirm(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := svc.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = svc.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := &Service{}
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := imported.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Transitions) != len(want.Transitions) {
+		t.Fatalf("\ngot > %v \nwant > %v", got.Transitions, want.Transitions)
+	}
+	for i := range want.Transitions {
+		if got.Transitions[i].Status != want.Transitions[i].Status || !got.Transitions[i].At.Equal(want.Transitions[i].At) {
+			t.Errorf("\ngot > %v \nwant > %v", got.Transitions[i], want.Transitions[i])
+		}
+	}
+}
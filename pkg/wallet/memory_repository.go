@@ -0,0 +1,706 @@
+package wallet
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// MemoryRepository keeps the wallet in memory. It is the storage used by a
+// zero Service.
+type MemoryRepository struct {
+	mu            sync.RWMutex
+	nextAccountID int64
+	accounts      []*types.Account
+	payments      []*types.Payment
+	favorites     []*types.Favorite
+	entries       []*types.Entry
+	records       []*types.IdempotencyRecord
+	index         index
+}
+
+// index keeps hash lookups over the records stored in MemoryRepository. The
+// slices stay the source of the insertion order; the index only points into
+// them.
+type index struct {
+	accountsByID    map[int64]*types.Account
+	accountsByPhone map[types.Phone]*types.Account
+	paymentsByID    map[string]*types.Payment
+	// paymentsByAccount keeps the payments of every account ordered by
+	// creation time, so that time ranges are found by binary search
+	paymentsByAccount map[int64][]*types.Payment
+	favoritesByID     map[string]*types.Favorite
+	entriesByID       map[string]*types.Entry
+	entriesByLedger   map[types.LedgerAccount][]*types.Entry
+	// entriesByTransaction keeps both entries of every ledger transaction
+	entriesByTransaction map[string][]*types.Entry
+	recordsByKey         map[string]*types.IdempotencyRecord
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		index: index{
+			accountsByID:         make(map[int64]*types.Account),
+			accountsByPhone:      make(map[types.Phone]*types.Account),
+			paymentsByID:         make(map[string]*types.Payment),
+			paymentsByAccount:    make(map[int64][]*types.Payment),
+			favoritesByID:        make(map[string]*types.Favorite),
+			entriesByID:          make(map[string]*types.Entry),
+			entriesByLedger:      make(map[types.LedgerAccount][]*types.Entry),
+			entriesByTransaction: make(map[string][]*types.Entry),
+			recordsByKey:         make(map[string]*types.IdempotencyRecord),
+		},
+	}
+}
+
+func (r *MemoryRepository) FindAccount(accountID int64) (*types.Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.findAccount(accountID)
+}
+
+func (r *MemoryRepository) FindAccountByPhone(phone types.Phone) (*types.Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.findAccountByPhone(phone)
+}
+
+func (r *MemoryRepository) Accounts() ([]types.Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyAccounts(r.accounts), nil
+}
+
+func (r *MemoryRepository) FindPayment(paymentID string) (*types.Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.findPayment(paymentID)
+}
+
+func (r *MemoryRepository) Payments() ([]types.Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyPayments(r.payments), nil
+}
+
+func (r *MemoryRepository) AccountPayments(accountID int64) ([]types.Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyPayments(r.index.paymentsByAccount[accountID]), nil
+}
+
+func (r *MemoryRepository) AccountPaymentsBetween(accountID int64, from time.Time, to time.Time) ([]types.Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	payments := r.index.paymentsByAccount[accountID]
+	start := sort.Search(len(payments), func(i int) bool {
+		return !payments[i].CreatedAt.Before(from)
+	})
+	end := sort.Search(len(payments), func(i int) bool {
+		return !payments[i].CreatedAt.Before(to)
+	})
+	if end < start {
+		end = start
+	}
+	return copyPayments(payments[start:end]), nil
+}
+
+func (r *MemoryRepository) FindFavorite(favoriteID string) (*types.Favorite, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.findFavorite(favoriteID)
+}
+
+func (r *MemoryRepository) Favorites() ([]types.Favorite, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyFavorites(r.favorites), nil
+}
+
+func (r *MemoryRepository) Entries() ([]types.Entry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyEntries(r.entries), nil
+}
+
+func (r *MemoryRepository) LedgerEntries(ledger types.LedgerAccount) ([]types.Entry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyEntries(r.index.entriesByLedger[ledger]), nil
+}
+
+func (r *MemoryRepository) TransactionEntries(transactionID string) ([]types.Entry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyEntries(r.index.entriesByTransaction[transactionID]), nil
+}
+
+func (r *MemoryRepository) FindIdempotencyRecord(key string) (*types.IdempotencyRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.findIdempotencyRecord(key)
+}
+
+func (r *MemoryRepository) IdempotencyRecords() ([]types.IdempotencyRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyRecords(r.records), nil
+}
+
+func (r *MemoryRepository) Update(fn func(tx Tx) error) error {
+	return r.update(fn, nil)
+}
+
+// update runs fn under the write lock and then calls commit, if any, while
+// the lock is still held. If either of them fails, every change made by fn is
+// undone.
+func (r *MemoryRepository) update(fn func(tx Tx) error, commit func(tx *memoryTx) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := &memoryTx{repository: r, changed: make(map[string]bool)}
+	err := fn(tx)
+	if err == nil && commit != nil {
+		err = commit(tx)
+	}
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
+
+// restore stores the given records as they are.
+func (r *MemoryRepository) restore(data *walletData) error {
+	return r.Update(data.save)
+}
+
+// data copies every collection. It must be called with r.mu held.
+func (r *MemoryRepository) data() *walletData {
+	return &walletData{
+		accounts:  copyAccounts(r.accounts),
+		payments:  copyPayments(r.payments),
+		favorites: copyFavorites(r.favorites),
+		entries:   copyEntries(r.entries),
+		records:   copyRecords(r.records),
+	}
+}
+
+func (r *MemoryRepository) findAccount(accountID int64) (*types.Account, error) {
+	account, ok := r.index.accountsByID[accountID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	copyAccount := *account
+	return &copyAccount, nil
+}
+
+func (r *MemoryRepository) findAccountByPhone(phone types.Phone) (*types.Account, error) {
+	account, ok := r.index.accountsByPhone[phone]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	copyAccount := *account
+	return &copyAccount, nil
+}
+
+func (r *MemoryRepository) findIdempotencyRecord(key string) (*types.IdempotencyRecord, error) {
+	record, ok := r.index.recordsByKey[key]
+	if !ok {
+		return nil, ErrIdempotencyRecordNotFound
+	}
+	copyRecord := *record
+	return &copyRecord, nil
+}
+
+func (r *MemoryRepository) findPayment(paymentID string) (*types.Payment, error) {
+	payment, ok := r.index.paymentsByID[paymentID]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	copyPayment := *payment
+	return &copyPayment, nil
+}
+
+func (r *MemoryRepository) findFavorite(favoriteID string) (*types.Favorite, error) {
+	favorite, ok := r.index.favoritesByID[favoriteID]
+	if !ok {
+		return nil, ErrFavoriteNotFound
+	}
+	copyFavorite := *favorite
+	return &copyFavorite, nil
+}
+
+func copyAccounts(accounts []*types.Account) []types.Account {
+	result := make([]types.Account, len(accounts))
+	for i, account := range accounts {
+		result[i] = *account
+	}
+	return result
+}
+
+func copyPayments(payments []*types.Payment) []types.Payment {
+	result := make([]types.Payment, len(payments))
+	for i, payment := range payments {
+		result[i] = *payment
+	}
+	return result
+}
+
+func copyFavorites(favorites []*types.Favorite) []types.Favorite {
+	result := make([]types.Favorite, len(favorites))
+	for i, favorite := range favorites {
+		result[i] = *favorite
+	}
+	return result
+}
+
+func copyEntries(entries []*types.Entry) []types.Entry {
+	result := make([]types.Entry, len(entries))
+	for i, entry := range entries {
+		result[i] = *entry
+	}
+	return result
+}
+
+func copyRecords(records []*types.IdempotencyRecord) []types.IdempotencyRecord {
+	result := make([]types.IdempotencyRecord, len(records))
+	for i, record := range records {
+		result[i] = *record
+	}
+	return result
+}
+
+func insertAccountAt(accounts []*types.Account, position int, account *types.Account) []*types.Account {
+	result := make([]*types.Account, 0, len(accounts)+1)
+	result = append(result, accounts[:position]...)
+	result = append(result, account)
+	return append(result, accounts[position:]...)
+}
+
+func insertPaymentAt(payments []*types.Payment, position int, payment *types.Payment) []*types.Payment {
+	result := make([]*types.Payment, 0, len(payments)+1)
+	result = append(result, payments[:position]...)
+	result = append(result, payment)
+	return append(result, payments[position:]...)
+}
+
+func insertEntryAt(entries []*types.Entry, position int, entry *types.Entry) []*types.Entry {
+	result := make([]*types.Entry, 0, len(entries)+1)
+	result = append(result, entries[:position]...)
+	result = append(result, entry)
+	return append(result, entries[position:]...)
+}
+
+func insertFavoriteAt(favorites []*types.Favorite, position int, favorite *types.Favorite) []*types.Favorite {
+	result := make([]*types.Favorite, 0, len(favorites)+1)
+	result = append(result, favorites[:position]...)
+	result = append(result, favorite)
+	return append(result, favorites[position:]...)
+}
+
+// memoryTx changes MemoryRepository in place and remembers how to undo every
+// change. It is only used while the repository's write lock is held.
+type memoryTx struct {
+	repository *MemoryRepository
+	undo       []func()
+
+	// changed holds the names of the dump files of the changed collections
+	changed map[string]bool
+}
+
+func (tx *memoryTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+}
+
+func (tx *memoryTx) FindAccount(accountID int64) (*types.Account, error) {
+	return tx.repository.findAccount(accountID)
+}
+
+func (tx *memoryTx) FindAccountByPhone(phone types.Phone) (*types.Account, error) {
+	return tx.repository.findAccountByPhone(phone)
+}
+
+func (tx *memoryTx) Accounts() ([]types.Account, error) {
+	return copyAccounts(tx.repository.accounts), nil
+}
+
+func (tx *memoryTx) FindPayment(paymentID string) (*types.Payment, error) {
+	return tx.repository.findPayment(paymentID)
+}
+
+func (tx *memoryTx) Payments() ([]types.Payment, error) {
+	return copyPayments(tx.repository.payments), nil
+}
+
+func (tx *memoryTx) FindFavorite(favoriteID string) (*types.Favorite, error) {
+	return tx.repository.findFavorite(favoriteID)
+}
+
+func (tx *memoryTx) Favorites() ([]types.Favorite, error) {
+	return copyFavorites(tx.repository.favorites), nil
+}
+
+func (tx *memoryTx) FindEntry(entryID string) (*types.Entry, error) {
+	entry, ok := tx.repository.index.entriesByID[entryID]
+	if !ok {
+		return nil, ErrEntryNotFound
+	}
+	copyEntry := *entry
+	return &copyEntry, nil
+}
+
+func (tx *memoryTx) Entries() ([]types.Entry, error) {
+	return copyEntries(tx.repository.entries), nil
+}
+
+func (tx *memoryTx) LedgerEntries(ledger types.LedgerAccount) ([]types.Entry, error) {
+	return copyEntries(tx.repository.index.entriesByLedger[ledger]), nil
+}
+
+func (tx *memoryTx) TransactionEntries(transactionID string) ([]types.Entry, error) {
+	return copyEntries(tx.repository.index.entriesByTransaction[transactionID]), nil
+}
+
+func (tx *memoryTx) FindIdempotencyRecord(key string) (*types.IdempotencyRecord, error) {
+	return tx.repository.findIdempotencyRecord(key)
+}
+
+func (tx *memoryTx) IdempotencyRecords() ([]types.IdempotencyRecord, error) {
+	return copyRecords(tx.repository.records), nil
+}
+
+func (tx *memoryTx) NextAccountID() int64 {
+	r := tx.repository
+	previous := r.nextAccountID
+	tx.undo = append(tx.undo, func() { r.nextAccountID = previous })
+
+	r.nextAccountID++
+	return r.nextAccountID
+}
+
+func (tx *memoryTx) SaveAccount(account types.Account) error {
+	r := tx.repository
+	if owner, ok := r.index.accountsByPhone[account.Phone]; ok && owner.ID != account.ID {
+		return ErrPhoneRegistered
+	}
+	tx.changed[accountsDump] = true
+
+	if stored, ok := r.index.accountsByID[account.ID]; ok {
+		previous := *stored
+		tx.undo = append(tx.undo, func() {
+			delete(r.index.accountsByPhone, stored.Phone)
+			*stored = previous
+			r.index.accountsByPhone[stored.Phone] = stored
+		})
+
+		delete(r.index.accountsByPhone, stored.Phone)
+		*stored = account
+		r.index.accountsByPhone[stored.Phone] = stored
+		return nil
+	}
+
+	stored := &account
+	previousNextID := r.nextAccountID
+	tx.undo = append(tx.undo, func() {
+		r.accounts = r.accounts[:len(r.accounts)-1]
+		delete(r.index.accountsByID, stored.ID)
+		delete(r.index.accountsByPhone, stored.Phone)
+		r.nextAccountID = previousNextID
+	})
+
+	r.accounts = append(r.accounts, stored)
+	r.index.accountsByID[stored.ID] = stored
+	r.index.accountsByPhone[stored.Phone] = stored
+	if stored.ID > r.nextAccountID {
+		r.nextAccountID = stored.ID
+	}
+	return nil
+}
+
+func (tx *memoryTx) DeleteAccount(accountID int64) error {
+	r := tx.repository
+	stored, ok := r.index.accountsByID[accountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	tx.changed[accountsDump] = true
+
+	position := 0
+	for i, account := range r.accounts {
+		if account == stored {
+			position = i
+			break
+		}
+	}
+	tx.undo = append(tx.undo, func() {
+		r.accounts = insertAccountAt(r.accounts, position, stored)
+		r.index.accountsByID[stored.ID] = stored
+		r.index.accountsByPhone[stored.Phone] = stored
+	})
+
+	r.accounts = append(r.accounts[:position:position], r.accounts[position+1:]...)
+	delete(r.index.accountsByID, stored.ID)
+	delete(r.index.accountsByPhone, stored.Phone)
+	return nil
+}
+
+func (tx *memoryTx) SavePayment(payment types.Payment) error {
+	r := tx.repository
+	tx.changed[paymentsDump] = true
+
+	// the caller keeps its slice, the stored payment gets its own
+	transitions := make([]types.PaymentTransition, len(payment.Transitions))
+	copy(transitions, payment.Transitions)
+	payment.Transitions = transitions
+
+	if stored, ok := r.index.paymentsByID[payment.ID]; ok {
+		previous := *stored
+		moved := previous.AccountID != payment.AccountID || !previous.CreatedAt.Equal(payment.CreatedAt)
+		if moved {
+			tx.unlinkPayment(stored)
+		}
+		tx.undo = append(tx.undo, func() { *stored = previous })
+		*stored = payment
+		if moved {
+			tx.linkPayment(stored)
+		}
+		return nil
+	}
+
+	stored := &payment
+	tx.undo = append(tx.undo, func() {
+		r.payments = r.payments[:len(r.payments)-1]
+		delete(r.index.paymentsByID, stored.ID)
+	})
+	r.payments = append(r.payments, stored)
+	r.index.paymentsByID[stored.ID] = stored
+	tx.linkPayment(stored)
+	return nil
+}
+
+func (tx *memoryTx) DeletePayment(paymentID string) error {
+	r := tx.repository
+	stored, ok := r.index.paymentsByID[paymentID]
+	if !ok {
+		return ErrPaymentNotFound
+	}
+	tx.changed[paymentsDump] = true
+
+	tx.unlinkPayment(stored)
+	position := 0
+	for i, payment := range r.payments {
+		if payment == stored {
+			position = i
+			break
+		}
+	}
+	tx.undo = append(tx.undo, func() {
+		r.payments = insertPaymentAt(r.payments, position, stored)
+		r.index.paymentsByID[stored.ID] = stored
+	})
+	r.payments = append(r.payments[:position:position], r.payments[position+1:]...)
+	delete(r.index.paymentsByID, stored.ID)
+	return nil
+}
+
+// linkPayment adds the payment to the index of its account, after the
+// payments created at the same time or earlier.
+func (tx *memoryTx) linkPayment(payment *types.Payment) {
+	r := tx.repository
+	accountID := payment.AccountID
+	list := r.index.paymentsByAccount[accountID]
+	position := sort.Search(len(list), func(i int) bool {
+		return list[i].CreatedAt.After(payment.CreatedAt)
+	})
+	tx.undo = append(tx.undo, func() {
+		list := r.index.paymentsByAccount[accountID]
+		r.index.paymentsByAccount[accountID] = append(list[:position:position], list[position+1:]...)
+	})
+	if position == len(list) {
+		r.index.paymentsByAccount[accountID] = append(list, payment)
+		return
+	}
+	r.index.paymentsByAccount[accountID] = insertPaymentAt(list, position, payment)
+}
+
+// unlinkPayment removes the payment from the index of its account.
+func (tx *memoryTx) unlinkPayment(payment *types.Payment) {
+	r := tx.repository
+	accountID := payment.AccountID
+	list := r.index.paymentsByAccount[accountID]
+	for i, linked := range list {
+		if linked == payment {
+			position := i
+			tx.undo = append(tx.undo, func() {
+				r.index.paymentsByAccount[accountID] = insertPaymentAt(r.index.paymentsByAccount[accountID], position, payment)
+			})
+			r.index.paymentsByAccount[accountID] = append(list[:i:i], list[i+1:]...)
+			return
+		}
+	}
+}
+
+func (tx *memoryTx) SaveFavorite(favorite types.Favorite) error {
+	r := tx.repository
+	tx.changed[favoritesDump] = true
+
+	if stored, ok := r.index.favoritesByID[favorite.ID]; ok {
+		previous := *stored
+		tx.undo = append(tx.undo, func() { *stored = previous })
+		*stored = favorite
+		return nil
+	}
+
+	stored := &favorite
+	tx.undo = append(tx.undo, func() {
+		r.favorites = r.favorites[:len(r.favorites)-1]
+		delete(r.index.favoritesByID, stored.ID)
+	})
+	r.favorites = append(r.favorites, stored)
+	r.index.favoritesByID[stored.ID] = stored
+	return nil
+}
+
+func (tx *memoryTx) DeleteFavorite(favoriteID string) error {
+	r := tx.repository
+	stored, ok := r.index.favoritesByID[favoriteID]
+	if !ok {
+		return ErrFavoriteNotFound
+	}
+	tx.changed[favoritesDump] = true
+
+	position := 0
+	for i, favorite := range r.favorites {
+		if favorite == stored {
+			position = i
+			break
+		}
+	}
+	tx.undo = append(tx.undo, func() {
+		r.favorites = insertFavoriteAt(r.favorites, position, stored)
+		r.index.favoritesByID[stored.ID] = stored
+	})
+	r.favorites = append(r.favorites[:position:position], r.favorites[position+1:]...)
+	delete(r.index.favoritesByID, stored.ID)
+	return nil
+}
+
+func (tx *memoryTx) SaveEntry(entry types.Entry) error {
+	r := tx.repository
+	if _, ok := r.index.entriesByID[entry.ID]; ok {
+		return nil
+	}
+	tx.changed[ledgerDump] = true
+
+	stored := &entry
+	tx.undo = append(tx.undo, func() {
+		r.entries = r.entries[:len(r.entries)-1]
+		list := r.index.entriesByLedger[stored.Account]
+		r.index.entriesByLedger[stored.Account] = list[:len(list)-1]
+		transaction := r.index.entriesByTransaction[stored.TransactionID]
+		r.index.entriesByTransaction[stored.TransactionID] = transaction[:len(transaction)-1]
+		if len(transaction) == 1 {
+			delete(r.index.entriesByTransaction, stored.TransactionID)
+		}
+		delete(r.index.entriesByID, stored.ID)
+	})
+	r.entries = append(r.entries, stored)
+	r.index.entriesByLedger[stored.Account] = append(r.index.entriesByLedger[stored.Account], stored)
+	r.index.entriesByTransaction[stored.TransactionID] = append(r.index.entriesByTransaction[stored.TransactionID], stored)
+	r.index.entriesByID[stored.ID] = stored
+	return nil
+}
+
+func (tx *memoryTx) DeleteEntry(entryID string) error {
+	r := tx.repository
+	stored, ok := r.index.entriesByID[entryID]
+	if !ok {
+		return ErrEntryNotFound
+	}
+	tx.changed[ledgerDump] = true
+
+	position := entryPosition(r.entries, stored)
+	ledger := r.index.entriesByLedger[stored.Account]
+	ledgerPosition := entryPosition(ledger, stored)
+	transaction := r.index.entriesByTransaction[stored.TransactionID]
+	transactionPosition := entryPosition(transaction, stored)
+	tx.undo = append(tx.undo, func() {
+		r.entries = insertEntryAt(r.entries, position, stored)
+		r.index.entriesByLedger[stored.Account] = insertEntryAt(r.index.entriesByLedger[stored.Account], ledgerPosition, stored)
+		r.index.entriesByTransaction[stored.TransactionID] = insertEntryAt(r.index.entriesByTransaction[stored.TransactionID], transactionPosition, stored)
+		r.index.entriesByID[stored.ID] = stored
+	})
+	r.entries = append(r.entries[:position:position], r.entries[position+1:]...)
+	r.index.entriesByLedger[stored.Account] = append(ledger[:ledgerPosition:ledgerPosition], ledger[ledgerPosition+1:]...)
+	if len(transaction) == 1 {
+		delete(r.index.entriesByTransaction, stored.TransactionID)
+	} else {
+		r.index.entriesByTransaction[stored.TransactionID] = append(transaction[:transactionPosition:transactionPosition], transaction[transactionPosition+1:]...)
+	}
+	delete(r.index.entriesByID, stored.ID)
+	return nil
+}
+
+func entryPosition(entries []*types.Entry, entry *types.Entry) int {
+	for i, stored := range entries {
+		if stored == entry {
+			return i
+		}
+	}
+	return 0
+}
+
+func (tx *memoryTx) SaveIdempotencyRecord(record types.IdempotencyRecord) error {
+	r := tx.repository
+	tx.changed[idempotencyDump] = true
+
+	if stored, ok := r.index.recordsByKey[record.Key]; ok {
+		previous := *stored
+		tx.undo = append(tx.undo, func() { *stored = previous })
+		*stored = record
+		return nil
+	}
+
+	stored := &record
+	tx.undo = append(tx.undo, func() {
+		r.records = r.records[:len(r.records)-1]
+		delete(r.index.recordsByKey, stored.Key)
+	})
+	r.records = append(r.records, stored)
+	r.index.recordsByKey[stored.Key] = stored
+	return nil
+}
+
+func (tx *memoryTx) DeleteIdempotencyRecord(key string) error {
+	r := tx.repository
+	stored, ok := r.index.recordsByKey[key]
+	if !ok {
+		return ErrIdempotencyRecordNotFound
+	}
+	tx.changed[idempotencyDump] = true
+
+	position := 0
+	for i, record := range r.records {
+		if record == stored {
+			position = i
+			break
+		}
+	}
+	tx.undo = append(tx.undo, func() {
+		records := make([]*types.IdempotencyRecord, 0, len(r.records)+1)
+		records = append(records, r.records[:position]...)
+		records = append(records, stored)
+		r.records = append(records, r.records[position:]...)
+		r.index.recordsByKey[stored.Key] = stored
+	})
+	r.records = append(r.records[:position:position], r.records[position+1:]...)
+	delete(r.index.recordsByKey, stored.Key)
+	return nil
+}
@@ -0,0 +1,535 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+var ErrImportConflict = errors.New("imported records conflict with stored ones")
+
+// ConflictStrategy tells what a merging import does with an imported record
+// that conflicts with a stored one.
+//
+// An imported account conflicts by phone when its phone is registered to a
+// stored account that differs from it, whatever the ID of that account, and
+// by ID when only its ID is taken by a stored account. Other records
+// conflict by ID when a stored record with their ID differs from them.
+type ConflictStrategy int
+
+const (
+	// ConflictFail fails the import without changing the wallet.
+	ConflictFail ConflictStrategy = iota
+	// ConflictSkip keeps the stored record and drops the imported one,
+	// together with the imported records of a dropped account.
+	ConflictSkip
+	// ConflictOverwrite replaces the stored record with the imported one.
+	// An account conflicting by phone replaces the account owning the phone
+	// and its imported records move to that account. The stored ledger
+	// entries of an overwritten account stay; the difference between them
+	// and the imported balance is posted from LedgerOpening.
+	ConflictOverwrite
+	// ConflictRemap stores the imported record under a new ID and updates
+	// the imported records referring to it. A phone cannot be remapped, so
+	// accounts conflicting by phone fail the import; idempotency records
+	// keep the keys the clients sent and are skipped instead.
+	ConflictRemap
+)
+
+// Reasons of an ImportConflict.
+const (
+	ConflictByID    = "id"
+	ConflictByPhone = "phone"
+)
+
+// ImportConflict describes an imported record that conflicts with the
+// stored record StoredID.
+type ImportConflict struct {
+	Collection string
+	ID         string
+	StoredID   string
+	Reason     string
+}
+
+// ImportCounts counts what a merging import did with the imported records
+// of one collection.
+type ImportCounts struct {
+	// Added records were new to the wallet.
+	Added int
+	// Unchanged records were already stored as they are.
+	Unchanged   int
+	Overwritten int
+	Skipped     int
+	Remapped    int
+}
+
+// MergeReport tells what a merging import did.
+type MergeReport struct {
+	Accounts  ImportCounts
+	Payments  ImportCounts
+	Favorites ImportCounts
+	Entries   ImportCounts
+	Records   ImportCounts
+
+	// AccountIDs, PaymentIDs and FavoriteIDs map the imported IDs of
+	// remapped or overwriting records to the IDs they are stored under.
+	AccountIDs  map[int64]int64
+	PaymentIDs  map[string]string
+	FavoriteIDs map[string]string
+
+	Conflicts []ImportConflict
+}
+
+// Merge merges the current snapshot exported to dir into the wallet,
+// resolving conflicts with strategy. On ErrImportConflict the wallet is
+// left as it was and the report lists the conflicts.
+//
+// The ledger of every account the merge stores is made to add up to its
+// Balance, posting the difference from LedgerOpening, so that the merged
+// wallet reconciles.
+func (s *Service) Merge(dir string, strategy ConflictStrategy) (*MergeReport, error) {
+	fsys, err := openSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return s.MergeFrom(fsys, strategy)
+}
+
+// MergeFrom merges the dump files of ExportTo read from fsys into the
+// wallet like Merge.
+func (s *Service) MergeFrom(fsys fs.FS, strategy ConflictStrategy) (*MergeReport, error) {
+	data, err := s.readDumps(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return s.merge(data, strategy)
+}
+
+func (s *Service) merge(data *walletData, strategy ConflictStrategy) (*MergeReport, error) {
+	unlock, err := s.lockAllAccounts()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var report *MergeReport
+	now := s.now()
+	err = s.repository().Update(func(tx Tx) error {
+		m := &merger{
+			tx:       tx,
+			strategy: strategy,
+			report: &MergeReport{
+				AccountIDs:  make(map[int64]int64),
+				PaymentIDs:  make(map[string]string),
+				FavoriteIDs: make(map[string]string),
+			},
+			claimed:         make(map[int64]bool),
+			skippedAccounts: make(map[int64]bool),
+			skippedPayments: make(map[string]bool),
+		}
+		report = m.report
+
+		steps := []func(data *walletData) error{
+			m.mergeAccounts,
+			m.mergeFavorites,
+			m.mergePayments,
+			m.mergeEntries,
+			m.mergeRecords,
+		}
+		for _, step := range steps {
+			err := step(data)
+			if err != nil {
+				return err
+			}
+		}
+		if m.failed > 0 {
+			return fmt.Errorf("%w: %d unresolved of %d", ErrImportConflict, m.failed, len(report.Conflicts))
+		}
+		return balanceLedgers(tx, m.stored, now)
+	})
+	if errors.Is(err, ErrImportConflict) {
+		return &MergeReport{Conflicts: report.Conflicts}, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// merger merges imported records inside one transaction.
+type merger struct {
+	tx       Tx
+	strategy ConflictStrategy
+	report   *MergeReport
+	// failed counts the conflicts the strategy does not resolve
+	failed int
+
+	// claimed holds the IDs of the accounts stored by this import and
+	// stored lists them in order
+	claimed         map[int64]bool
+	stored          []int64
+	skippedAccounts map[int64]bool
+	skippedPayments map[string]bool
+}
+
+// conflict records a conflict and returns the way to resolve it. A
+// strategy that cannot resolve it counts it as failed and returns
+// ConflictSkip, so that the remaining conflicts are found too.
+func (m *merger) conflict(conflict ImportConflict, remappable bool) ConflictStrategy {
+	m.report.Conflicts = append(m.report.Conflicts, conflict)
+	if m.strategy == ConflictFail || (m.strategy == ConflictRemap && !remappable) {
+		m.failed++
+		return ConflictSkip
+	}
+	return m.strategy
+}
+
+func (m *merger) mergeAccounts(data *walletData) error {
+	counts := &m.report.Accounts
+	var remapped []types.Account
+	for _, account := range data.accounts {
+		byPhone, _ := m.tx.FindAccountByPhone(account.Phone)
+		byID, _ := m.tx.FindAccount(account.ID)
+
+		var resolution ConflictStrategy
+		storedID := account.ID
+		switch {
+		case byPhone != nil && *byPhone == account:
+			counts.Unchanged++
+			continue
+		case byPhone != nil:
+			storedID = byPhone.ID
+			resolution = m.conflict(ImportConflict{
+				Collection: "accounts",
+				ID:         strconv.FormatInt(account.ID, 10),
+				StoredID:   strconv.FormatInt(byPhone.ID, 10),
+				Reason:     ConflictByPhone,
+			}, false)
+		case byID != nil:
+			resolution = m.conflict(ImportConflict{
+				Collection: "accounts",
+				ID:         strconv.FormatInt(account.ID, 10),
+				StoredID:   strconv.FormatInt(byID.ID, 10),
+				Reason:     ConflictByID,
+			}, true)
+		default:
+			counts.Added++
+			m.claim(account.ID)
+			err := m.tx.SaveAccount(account)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch resolution {
+		case ConflictSkip:
+			counts.Skipped++
+			m.skippedAccounts[account.ID] = true
+		case ConflictOverwrite:
+			// another imported account already overwrote the stored one
+			if m.claimed[storedID] {
+				m.failed++
+				counts.Skipped++
+				m.skippedAccounts[account.ID] = true
+				continue
+			}
+			counts.Overwritten++
+			if storedID != account.ID {
+				m.report.AccountIDs[account.ID] = storedID
+			}
+			importedID := account.ID
+			account.ID = storedID
+			m.claim(storedID)
+			err := m.tx.SaveAccount(account)
+			if err != nil {
+				return fmt.Errorf("account %d: %w", importedID, err)
+			}
+		case ConflictRemap:
+			counts.Remapped++
+			remapped = append(remapped, account)
+		}
+	}
+
+	// the new IDs follow every imported ID stored above
+	for _, account := range remapped {
+		importedID := account.ID
+		account.ID = m.tx.NextAccountID()
+		m.report.AccountIDs[importedID] = account.ID
+		m.claim(account.ID)
+		err := m.tx.SaveAccount(account)
+		if err != nil {
+			return fmt.Errorf("account %d: %w", importedID, err)
+		}
+	}
+	return nil
+}
+
+// claim notes that the import stores the account.
+func (m *merger) claim(accountID int64) {
+	m.claimed[accountID] = true
+	m.stored = append(m.stored, accountID)
+}
+
+// accountID returns the ID the imported account is stored under.
+func (m *merger) accountID(accountID int64) int64 {
+	if stored, ok := m.report.AccountIDs[accountID]; ok {
+		return stored
+	}
+	return accountID
+}
+
+func (m *merger) mergePayments(data *walletData) error {
+	counts := &m.report.Payments
+	var payments []types.Payment
+	for _, payment := range data.payments {
+		if m.skippedAccounts[payment.AccountID] {
+			counts.Skipped++
+			m.skippedPayments[payment.ID] = true
+			continue
+		}
+		payment.AccountID = m.accountID(payment.AccountID)
+
+		stored, _ := m.tx.FindPayment(payment.ID)
+		if stored == nil {
+			counts.Added++
+			payments = append(payments, payment)
+			continue
+		}
+		if reflect.DeepEqual(utcPayment(*stored), utcPayment(payment)) {
+			counts.Unchanged++
+			continue
+		}
+
+		resolution := m.conflict(ImportConflict{
+			Collection: "payments",
+			ID:         payment.ID,
+			StoredID:   stored.ID,
+			Reason:     ConflictByID,
+		}, true)
+		switch resolution {
+		case ConflictSkip:
+			counts.Skipped++
+			m.skippedPayments[payment.ID] = true
+		case ConflictOverwrite:
+			counts.Overwritten++
+			payments = append(payments, payment)
+		case ConflictRemap:
+			counts.Remapped++
+			m.report.PaymentIDs[payment.ID] = uuid.New().String()
+			payments = append(payments, payment)
+		}
+	}
+
+	// links are rewritten once the new ID of every payment is known
+	for _, payment := range payments {
+		payment.ID = m.paymentID(payment.ID)
+		payment.LinkedPaymentID = m.paymentID(payment.LinkedPaymentID)
+		if id, ok := m.report.FavoriteIDs[payment.FavoriteID]; ok {
+			payment.FavoriteID = id
+		}
+		err := m.tx.SavePayment(payment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paymentID returns the ID the imported payment is stored under.
+func (m *merger) paymentID(paymentID string) string {
+	if stored, ok := m.report.PaymentIDs[paymentID]; ok {
+		return stored
+	}
+	return paymentID
+}
+
+func (m *merger) mergeFavorites(data *walletData) error {
+	counts := &m.report.Favorites
+	for _, favorite := range data.favorites {
+		if m.skippedAccounts[favorite.AccountID] {
+			counts.Skipped++
+			continue
+		}
+		favorite.AccountID = m.accountID(favorite.AccountID)
+
+		stored, _ := m.tx.FindFavorite(favorite.ID)
+		switch {
+		case stored == nil:
+			counts.Added++
+		case reflect.DeepEqual(utcFavorite(*stored), utcFavorite(favorite)):
+			counts.Unchanged++
+			continue
+		default:
+			resolution := m.conflict(ImportConflict{
+				Collection: "favorites",
+				ID:         favorite.ID,
+				StoredID:   stored.ID,
+				Reason:     ConflictByID,
+			}, true)
+			switch resolution {
+			case ConflictSkip:
+				counts.Skipped++
+				continue
+			case ConflictOverwrite:
+				counts.Overwritten++
+			case ConflictRemap:
+				counts.Remapped++
+				id := uuid.New().String()
+				m.report.FavoriteIDs[favorite.ID] = id
+				favorite.ID = id
+			}
+		}
+
+		err := m.tx.SaveFavorite(favorite)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *merger) mergeEntries(data *walletData) error {
+	counts := &m.report.Entries
+	for _, entry := range data.entries {
+		accountID, currency, ok := parseAccountLedger(entry.Account)
+		if (ok && m.skippedAccounts[accountID]) || m.skippedPayments[entry.PaymentID] {
+			counts.Skipped++
+			continue
+		}
+		if ok {
+			entry.Account = AccountLedger(m.accountID(accountID)) + currency
+		}
+		if entry.PaymentID != "" {
+			entry.PaymentID = m.paymentID(entry.PaymentID)
+		}
+
+		stored, err := m.tx.FindEntry(entry.ID)
+		if err != nil && err != ErrEntryNotFound {
+			return err
+		}
+		switch {
+		case stored == nil:
+			counts.Added++
+		case reflect.DeepEqual(utcEntry(*stored), utcEntry(entry)):
+			counts.Unchanged++
+			continue
+		default:
+			resolution := m.conflict(ImportConflict{
+				Collection: "ledger",
+				ID:         entry.ID,
+				StoredID:   stored.ID,
+				Reason:     ConflictByID,
+			}, true)
+			switch resolution {
+			case ConflictSkip:
+				counts.Skipped++
+				continue
+			case ConflictOverwrite:
+				counts.Overwritten++
+				err := m.tx.DeleteEntry(stored.ID)
+				if err != nil {
+					return err
+				}
+			case ConflictRemap:
+				counts.Remapped++
+				entry.ID = uuid.New().String()
+			}
+		}
+
+		err = m.tx.SaveEntry(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *merger) mergeRecords(data *walletData) error {
+	counts := &m.report.Records
+	for _, record := range data.records {
+		if m.skippedPayments[record.PaymentID] {
+			counts.Skipped++
+			continue
+		}
+		if record.PaymentID != "" {
+			record.PaymentID = m.paymentID(record.PaymentID)
+		}
+
+		stored, _ := m.tx.FindIdempotencyRecord(record.Key)
+		switch {
+		case stored == nil:
+			counts.Added++
+		case stored.Request == record.Request && stored.PaymentID == record.PaymentID && stored.CreatedAt.Equal(record.CreatedAt):
+			counts.Unchanged++
+			continue
+		default:
+			resolution := m.conflict(ImportConflict{
+				Collection: "idempotency",
+				ID:         record.Key,
+				StoredID:   stored.Key,
+				Reason:     ConflictByID,
+			}, true)
+			if resolution != ConflictOverwrite {
+				counts.Skipped++
+				continue
+			}
+			counts.Overwritten++
+		}
+
+		err := m.tx.SaveIdempotencyRecord(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAccountLedger returns the ID of the wallet account of the ledger
+// account and the currency suffix of its name, if any.
+func parseAccountLedger(ledger types.LedgerAccount) (int64, types.LedgerAccount, bool) {
+	name := string(ledger)
+	if !strings.HasPrefix(name, "account:") {
+		return 0, "", false
+	}
+	name = strings.TrimPrefix(name, "account:")
+	suffix := ""
+	if at := strings.Index(name, "@"); at >= 0 {
+		name, suffix = name[:at], name[at:]
+	}
+	accountID, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return accountID, types.LedgerAccount(suffix), true
+}
+
+// utcPayment, utcFavorite and utcEntry drop the locations of the times of a record,
+// which differ between stored and imported records for the same instants.
+func utcPayment(payment types.Payment) types.Payment {
+	payment.CreatedAt = payment.CreatedAt.UTC()
+	payment.UpdatedAt = payment.UpdatedAt.UTC()
+	transitions := make([]types.PaymentTransition, len(payment.Transitions))
+	for i, transition := range payment.Transitions {
+		transitions[i] = types.PaymentTransition{Status: transition.Status, At: transition.At.UTC()}
+	}
+	payment.Transitions = transitions
+	return payment
+}
+
+func utcFavorite(favorite types.Favorite) types.Favorite {
+	favorite.CreatedAt = favorite.CreatedAt.UTC()
+	favorite.UpdatedAt = favorite.UpdatedAt.UTC()
+	return favorite
+}
+
+func utcEntry(entry types.Entry) types.Entry {
+	entry.CreatedAt = entry.CreatedAt.UTC()
+	return entry
+}
@@ -0,0 +1,224 @@
+package wallet
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func TestService_MergeFrom_remap(t *testing.T) {
+	sink := memorySink{}
+	err := newExportService(t).ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// account 1 of the export has another phone
+	w := newTestWallet(t)
+	w.account("+992000000009", 50)
+	svc, export := w.Service, fstest.MapFS(sink)
+
+	report, err := svc.MergeFrom(export, ConflictRemap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ImportCounts{Added: 2, Remapped: 1}
+	if report.Accounts != want {
+		t.Errorf("\ngot > %+v \nwant > %+v", report.Accounts, want)
+	}
+	if !reflect.DeepEqual(report.AccountIDs, map[int64]int64{1: 4}) {
+		t.Errorf("wrong remapped IDs => %v", report.AccountIDs)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Reason != ConflictByID {
+		t.Errorf("wrong conflicts => %v", report.Conflicts)
+	}
+
+	account, err := svc.repository().FindAccountByPhone("+992000000001")
+	if err != nil || account.ID != 4 || account.Balance != 80 {
+		t.Errorf("wrong remapped account => %v, err => %v", account, err)
+	}
+	history, err := svc.ExportAccountHistory(4)
+	if err != nil || len(history) != 2 {
+		t.Errorf("payments did not follow the account => %v, err => %v", history, err)
+	}
+	if discrepancies, err := svc.Reconcile(); err != nil || len(discrepancies) != 0 {
+		t.Errorf("ledger disagrees with balances => %v, err => %v", discrepancies, err)
+	}
+
+	registered, err := svc.RegisterAccount("+992000000010")
+	if err != nil || registered.ID != 5 {
+		t.Errorf("wrong next account => %v, err => %v", registered, err)
+	}
+}
+
+func TestService_MergeFrom_fail(t *testing.T) {
+	sink := memorySink{}
+	err := newExportService(t).ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// account 1 of the export has another phone
+	w := newTestWallet(t)
+	w.account("+992000000009", 50)
+	svc, export := w.Service, fstest.MapFS(sink)
+
+	report, err := svc.MergeFrom(export, ConflictFail)
+	if !errors.Is(err, ErrImportConflict) {
+		t.Fatalf("\ngot > %v \nwant > %v", err, ErrImportConflict)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].ID != "1" {
+		t.Errorf("wrong conflicts => %v", report.Conflicts)
+	}
+	if _, err := svc.FindAccountByID(2); err != ErrAccountNotFound {
+		t.Errorf("wallet changed by a failed import, err => %v", err)
+	}
+}
+
+func TestService_MergeFrom_skip(t *testing.T) {
+	sink := memorySink{}
+	err := newExportService(t).ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// account 1 of the export has another phone
+	w := newTestWallet(t)
+	w.account("+992000000009", 50)
+	svc, export := w.Service, fstest.MapFS(sink)
+
+	report, err := svc.MergeFrom(export, ConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accounts.Skipped != 1 || report.Payments.Skipped != 2 || report.Favorites.Skipped != 1 {
+		t.Errorf("wrong report => %+v", report)
+	}
+
+	account, err := svc.FindAccountByID(1)
+	if err != nil || account.Phone != "+992000000009" || account.Balance != 50 {
+		t.Errorf("stored account changed => %v, err => %v", account, err)
+	}
+	if _, err := svc.repository().FindAccountByPhone("+992000000001"); err != ErrAccountNotFound {
+		t.Errorf("skipped account is stored, err => %v", err)
+	}
+	if _, err := svc.FindAccountByID(2); err != nil {
+		t.Errorf("account without conflicts is not merged, err => %v", err)
+	}
+}
+
+func TestService_MergeFrom_phoneConflict(t *testing.T) {
+	sink := memorySink{}
+	err := newExportService(t).ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTarget := func() *Service {
+		svc := &Service{}
+		for _, phone := range []string{"+992000000007", "+992000000008", "+992000000009", "+992000000001"} {
+			_, err := svc.RegisterAccount(types.Phone(phone))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return svc
+	}
+
+	svc := newTarget()
+	report, err := svc.MergeFrom(fstest.MapFS(sink), ConflictRemap)
+	if !errors.Is(err, ErrImportConflict) {
+		t.Fatalf("\ngot > %v \nwant > %v", err, ErrImportConflict)
+	}
+
+	svc = newTarget()
+	report, err = svc.MergeFrom(fstest.MapFS(sink), ConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.AccountIDs[1] != 4 {
+		t.Errorf("wrong account IDs => %v", report.AccountIDs)
+	}
+	account, err := svc.repository().FindAccountByPhone("+992000000001")
+	if err != nil || account.ID != 4 || account.Balance != 80 {
+		t.Errorf("wrong overwritten account => %v, err => %v", account, err)
+	}
+	if _, err := svc.repository().FindAccountByPhone("+992000000007"); err != nil {
+		t.Errorf("account 1 lost its phone, err => %v", err)
+	}
+}
+
+func TestService_MergeFrom_again(t *testing.T) {
+	sink := memorySink{}
+	err := newExportService(t).ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// account 1 of the export has another phone
+	w := newTestWallet(t)
+	w.account("+992000000009", 50)
+	svc, export := w.Service, fstest.MapFS(sink)
+
+	_, err = svc.MergeFrom(export, ConflictRemap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := svc.MergeFrom(export, ConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accounts.Unchanged != 2 || report.Accounts.Added != 0 || report.Payments.Unchanged+report.Payments.Skipped != 3 {
+		t.Errorf("wrong report => %+v", report)
+	}
+}
+
+func TestService_MergeFrom_sameExportTwice(t *testing.T) {
+	sink := memorySink{}
+	err := newExportService(t).ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := &Service{}
+	first, err := svc.MergeFrom(fstest.MapFS(sink), ConflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.MergeFrom(fstest.MapFS(sink), ConflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ImportCounts{Unchanged: first.Entries.Added}
+	if second.Entries != want {
+		t.Errorf("\ngot > %+v \nwant > %+v", second.Entries, want)
+	}
+	entries, err := svc.repository().Entries()
+	if err != nil || len(entries) != first.Entries.Added {
+		t.Errorf("\ngot > %v entries \nwant > %v", len(entries), first.Entries.Added)
+	}
+}
+
+func TestService_MergeFrom_overwriteBalancesLedger(t *testing.T) {
+	svc := newExportService(t)
+	sink := memorySink{}
+	err := svc.ExportTo(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// made after the export, the import overwrites the balance
+	err = svc.Deposit(1, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = svc.MergeFrom(fstest.MapFS(sink), ConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, svc, 1, 80)
+	discrepancies, err := svc.Reconcile()
+	if err != nil || len(discrepancies) != 0 {
+		t.Errorf("\ngot > %v %v \nwant > nil", discrepancies, err)
+	}
+}
@@ -0,0 +1,528 @@
+package wallet
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+var ErrBadCursor = errors.New("bad cursor")
+
+// PaymentFilter is a condition on payments, built with the functions
+// below. The zero PaymentFilter matches every payment.
+type PaymentFilter struct {
+	kind       filterKind
+	accounts   []int64
+	categories []types.PaymentCategory
+	statuses   []types.PaymentStatus
+	min, max   types.Money
+	from, to   time.Time
+	favorites  []string
+	filters    []PaymentFilter
+}
+
+type filterKind int
+
+const (
+	filterAll filterKind = iota
+	filterAccount
+	filterCategory
+	filterStatus
+	filterAmount
+	filterCreated
+	filterFavorite
+	filterAnd
+	filterOr
+	filterNot
+)
+
+// AccountIs matches the payments of the accounts.
+func AccountIs(accountIDs ...int64) PaymentFilter {
+	return PaymentFilter{kind: filterAccount, accounts: append([]int64(nil), accountIDs...)}
+}
+
+// CategoryIs matches the payments of the categories.
+func CategoryIs(categories ...types.PaymentCategory) PaymentFilter {
+	return PaymentFilter{kind: filterCategory, categories: append([]types.PaymentCategory(nil), categories...)}
+}
+
+// StatusIs matches the payments in the statuses.
+func StatusIs(statuses ...types.PaymentStatus) PaymentFilter {
+	return PaymentFilter{kind: filterStatus, statuses: append([]types.PaymentStatus(nil), statuses...)}
+}
+
+// AmountBetween matches the payments of at least min and at most max.
+func AmountBetween(min types.Money, max types.Money) PaymentFilter {
+	return PaymentFilter{kind: filterAmount, min: min, max: max}
+}
+
+// CreatedBetween matches the payments created at or after from and before
+// to. A zero from or to leaves the range open on that side.
+func CreatedBetween(from time.Time, to time.Time) PaymentFilter {
+	return PaymentFilter{kind: filterCreated, from: from, to: to}
+}
+
+// FromFavorite matches the payments made from the favorites, or from any
+// favorite when no favorite is given.
+func FromFavorite(favoriteIDs ...string) PaymentFilter {
+	return PaymentFilter{kind: filterFavorite, favorites: append([]string(nil), favoriteIDs...)}
+}
+
+// And matches the payments every filter matches.
+func And(filters ...PaymentFilter) PaymentFilter {
+	return PaymentFilter{kind: filterAnd, filters: append([]PaymentFilter(nil), filters...)}
+}
+
+// Or matches the payments any of the filters matches.
+func Or(filters ...PaymentFilter) PaymentFilter {
+	return PaymentFilter{kind: filterOr, filters: append([]PaymentFilter(nil), filters...)}
+}
+
+// Not matches the payments filter does not match.
+func Not(filter PaymentFilter) PaymentFilter {
+	return PaymentFilter{kind: filterNot, filters: []PaymentFilter{filter}}
+}
+
+// Match reports whether the filter matches the payment.
+func (f PaymentFilter) Match(payment types.Payment) bool {
+	switch f.kind {
+	case filterAccount:
+		for _, id := range f.accounts {
+			if payment.AccountID == id {
+				return true
+			}
+		}
+		return false
+	case filterCategory:
+		for _, category := range f.categories {
+			if payment.Category == category {
+				return true
+			}
+		}
+		return false
+	case filterStatus:
+		for _, status := range f.statuses {
+			if payment.Status == status {
+				return true
+			}
+		}
+		return false
+	case filterAmount:
+		return payment.Amount >= f.min && payment.Amount <= f.max
+	case filterCreated:
+		if !f.from.IsZero() && payment.CreatedAt.Before(f.from) {
+			return false
+		}
+		return f.to.IsZero() || payment.CreatedAt.Before(f.to)
+	case filterFavorite:
+		if payment.FavoriteID == "" {
+			return false
+		}
+		for _, id := range f.favorites {
+			if payment.FavoriteID == id {
+				return true
+			}
+		}
+		return len(f.favorites) == 0
+	case filterAnd:
+		for _, filter := range f.filters {
+			if !filter.Match(payment) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, filter := range f.filters {
+			if filter.Match(payment) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return !f.filters[0].Match(payment)
+	}
+	return true
+}
+
+// SortField is a field the payments of a query are sorted by.
+type SortField int
+
+const (
+	SortCreatedAt SortField = iota
+	SortAmount
+	SortAccount
+	SortCategory
+	SortStatus
+	SortID
+)
+
+var sortFieldNames = map[SortField]string{
+	SortCreatedAt: "createdAt",
+	SortAmount:    "amount",
+	SortAccount:   "accountId",
+	SortCategory:  "category",
+	SortStatus:    "status",
+	SortID:        "id",
+}
+
+type paymentOrder struct {
+	field      SortField
+	descending bool
+}
+
+// PaymentQuery selects, sorts and pages the payments of the wallet. Its
+// methods return a changed copy of the query, so a query can be extended
+// without changing it. The zero PaymentQuery selects every payment,
+// oldest first.
+//
+// The payments are always sorted by their ID last, so that every page of
+// a query holds the same payments however often it is asked for.
+type PaymentQuery struct {
+	filter PaymentFilter
+	order  []paymentOrder
+	limit  int
+	offset int
+	cursor string
+}
+
+// Where narrows the query to the payments filter matches too.
+func (q PaymentQuery) Where(filter PaymentFilter) PaymentQuery {
+	if q.filter.kind == filterAll {
+		q.filter = filter
+	} else {
+		q.filter = And(q.filter, filter)
+	}
+	return q
+}
+
+// OrderBy sorts the payments by field, in ascending order, after the
+// fields given before.
+func (q PaymentQuery) OrderBy(field SortField) PaymentQuery {
+	q.order = append(q.order[:len(q.order):len(q.order)], paymentOrder{field: field})
+	return q
+}
+
+// OrderByDesc sorts the payments by field, in descending order, after the
+// fields given before.
+func (q PaymentQuery) OrderByDesc(field SortField) PaymentQuery {
+	q.order = append(q.order[:len(q.order):len(q.order)], paymentOrder{field: field, descending: true})
+	return q
+}
+
+// Limit returns at most n payments; 0 means no limit.
+func (q PaymentQuery) Limit(n int) PaymentQuery {
+	if n < 0 {
+		n = 0
+	}
+	q.limit = n
+	return q
+}
+
+// Offset skips the first n payments, counted after the cursor if one is
+// given.
+func (q PaymentQuery) Offset(n int) PaymentQuery {
+	if n < 0 {
+		n = 0
+	}
+	q.offset = n
+	return q
+}
+
+// After returns the payments after the ones of the page the cursor was
+// returned with. The query has to sort the payments as that one did.
+func (q PaymentQuery) After(cursor string) PaymentQuery {
+	q.cursor = cursor
+	return q
+}
+
+// PaymentPage is a page of the result of a PaymentQuery.
+type PaymentPage struct {
+	Payments []types.Payment
+	// Next is the cursor of the next page; it is empty on the last page.
+	Next string
+}
+
+// QueryPayments runs the query. Filters on accounts are answered from the
+// index of the payments by account, narrowed to the creation time range
+// the filter asks for; other filters scan every payment.
+func (s *Service) QueryPayments(ctx context.Context, query PaymentQuery) (*PaymentPage, error) {
+	order := query.sortOrder()
+	var pivot *types.Payment
+	if query.cursor != "" {
+		var err error
+		pivot, err = decodeCursor(query.cursor, order)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	candidates, err := planPayments(query.filter).fetch(s.repository())
+	if err != nil {
+		return nil, err
+	}
+	payments, err := NewEngine(runtime.GOMAXPROCS(0)).Filter(ctx, candidates, query.filter.Match)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(payments, func(i, j int) bool {
+		return comparePayments(payments[i], payments[j], order) < 0
+	})
+	if pivot != nil {
+		start := sort.Search(len(payments), func(i int) bool {
+			return comparePayments(payments[i], *pivot, order) > 0
+		})
+		payments = payments[start:]
+	}
+	if query.offset >= len(payments) {
+		return &PaymentPage{Payments: []types.Payment{}}, nil
+	}
+	payments = payments[query.offset:]
+
+	page := &PaymentPage{Payments: payments}
+	if query.limit > 0 && query.limit < len(payments) {
+		page.Payments = payments[:query.limit]
+		page.Next = encodeCursor(page.Payments[query.limit-1], order)
+	}
+	return page, nil
+}
+
+// sortOrder returns the order of the query ending with the payment ID.
+func (q PaymentQuery) sortOrder() []paymentOrder {
+	order := append([]paymentOrder(nil), q.order...)
+	if len(order) == 0 {
+		order = append(order, paymentOrder{field: SortCreatedAt})
+	}
+	for _, o := range order {
+		if o.field == SortID {
+			return order
+		}
+	}
+	return append(order, paymentOrder{field: SortID})
+}
+
+func comparePayments(a types.Payment, b types.Payment, order []paymentOrder) int {
+	for _, o := range order {
+		c := 0
+		switch o.field {
+		case SortCreatedAt:
+			c = compareTimes(a.CreatedAt, b.CreatedAt)
+		case SortAmount:
+			c = compareInts(int64(a.Amount), int64(b.Amount))
+		case SortAccount:
+			c = compareInts(a.AccountID, b.AccountID)
+		case SortCategory:
+			c = strings.Compare(string(a.Category), string(b.Category))
+		case SortStatus:
+			c = strings.Compare(string(a.Status), string(b.Status))
+		case SortID:
+			c = strings.Compare(a.ID, b.ID)
+		}
+		if o.descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareTimes(a time.Time, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// A cursor holds the order of the query and the values of the sort fields
+// of the last payment of a page.
+type paymentCursor struct {
+	Order string   `json:"o"`
+	Keys  []string `json:"k"`
+}
+
+func orderName(order []paymentOrder) string {
+	names := make([]string, len(order))
+	for i, o := range order {
+		names[i] = sortFieldNames[o.field]
+		if o.descending {
+			names[i] = "-" + names[i]
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func encodeCursor(payment types.Payment, order []paymentOrder) string {
+	cursor := paymentCursor{Order: orderName(order)}
+	for _, o := range order {
+		key := ""
+		switch o.field {
+		case SortCreatedAt:
+			key = payment.CreatedAt.UTC().Format(time.RFC3339Nano)
+		case SortAmount:
+			key = strconv.FormatInt(int64(payment.Amount), 10)
+		case SortAccount:
+			key = strconv.FormatInt(payment.AccountID, 10)
+		case SortCategory:
+			key = string(payment.Category)
+		case SortStatus:
+			key = string(payment.Status)
+		case SortID:
+			key = payment.ID
+		}
+		cursor.Keys = append(cursor.Keys, key)
+	}
+	// marshalling strings never fails
+	content, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// decodeCursor returns a payment with the sort fields of the cursor set.
+func decodeCursor(value string, order []paymentOrder) (*types.Payment, error) {
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	var cursor paymentCursor
+	err = json.Unmarshal(content, &cursor)
+	if err != nil || len(cursor.Keys) != len(order) {
+		return nil, ErrBadCursor
+	}
+	if cursor.Order != orderName(order) {
+		return nil, ErrBadCursor
+	}
+
+	payment := &types.Payment{}
+	for i, o := range order {
+		key := cursor.Keys[i]
+		switch o.field {
+		case SortCreatedAt:
+			payment.CreatedAt, err = time.Parse(time.RFC3339Nano, key)
+		case SortAmount:
+			var amount int64
+			amount, err = strconv.ParseInt(key, 10, 64)
+			payment.Amount = types.Money(amount)
+		case SortAccount:
+			payment.AccountID, err = strconv.ParseInt(key, 10, 64)
+		case SortCategory:
+			payment.Category = types.PaymentCategory(key)
+		case SortStatus:
+			payment.Status = types.PaymentStatus(key)
+		case SortID:
+			payment.ID = key
+		}
+		if err != nil {
+			return nil, ErrBadCursor
+		}
+	}
+	return payment, nil
+}
+
+// paymentPlan tells where the candidates of a filter come from: every
+// payment, or the payments of some accounts, created in the time range
+// when it is not zero. The filter itself is applied to the candidates
+// afterwards.
+type paymentPlan struct {
+	scan     bool
+	accounts []int64
+	from, to time.Time
+}
+
+// planPayments finds the accounts a filter is limited to. A conjunction
+// uses the filter on the fewest accounts and a time range next to it; a
+// disjunction uses the index only when every one of its filters does.
+func planPayments(filter PaymentFilter) paymentPlan {
+	switch filter.kind {
+	case filterAccount:
+		return paymentPlan{accounts: uniqueAccounts(filter.accounts)}
+	case filterAnd:
+		best := paymentPlan{scan: true}
+		for _, f := range filter.filters {
+			plan := planPayments(f)
+			if !plan.scan && (best.scan || len(plan.accounts) < len(best.accounts)) {
+				best = plan
+			}
+		}
+		if best.scan || !best.from.IsZero() || !best.to.IsZero() {
+			return best
+		}
+		for _, f := range filter.filters {
+			if f.kind == filterCreated {
+				best.from, best.to = f.from, f.to
+				break
+			}
+		}
+		return best
+	case filterOr:
+		plan := paymentPlan{}
+		for _, f := range filter.filters {
+			p := planPayments(f)
+			if p.scan {
+				return paymentPlan{scan: true}
+			}
+			plan.accounts = append(plan.accounts, p.accounts...)
+		}
+		plan.accounts = uniqueAccounts(plan.accounts)
+		return plan
+	}
+	return paymentPlan{scan: true}
+}
+
+func uniqueAccounts(accountIDs []int64) []int64 {
+	unique := []int64{}
+	seen := make(map[int64]bool)
+	for _, id := range accountIDs {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i] < unique[j] })
+	return unique
+}
+
+func (plan paymentPlan) fetch(repo Repository) ([]types.Payment, error) {
+	if plan.scan {
+		return repo.Payments()
+	}
+
+	var payments []types.Payment
+	for _, id := range plan.accounts {
+		var (
+			account []types.Payment
+			err     error
+		)
+		if plan.to.IsZero() {
+			account, err = repo.AccountPayments(id)
+		} else {
+			account, err = repo.AccountPaymentsBetween(id, plan.from, plan.to)
+		}
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, account...)
+	}
+	return payments, nil
+}
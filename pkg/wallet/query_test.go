@@ -0,0 +1,202 @@
+package wallet
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// newQueryService returns a wallet with six payments made an hour apart,
+// p3 rejected and p4 made from a favorite of p1, and the IDs of the
+// payments by their names.
+func newQueryService(t *testing.T) (*testWallet, map[string]string, time.Time) {
+	w := newTestWallet(t)
+	start := w.clock.Now()
+	for _, phone := range []types.Phone{"+992000000001", "+992000000002", "+992000000003"} {
+		w.account(phone, 1000)
+	}
+
+	ids := map[string]string{}
+	pay := func(name string, accountID int64, amount types.Money, category types.PaymentCategory) {
+		ids[name] = w.pay(accountID, amount, category).ID
+		w.clock.Add(time.Hour)
+	}
+	pay("p1", 1, 100, "auto")
+	pay("p2", 2, 200, "food")
+	pay("p3", 1, 300, "food")
+	w.check(w.Reject(ids["p3"]))
+	favorite := w.favorite(ids["p1"], "car")
+	payment, err := w.PayFromFavorite(favorite.ID)
+	w.check(err)
+	ids["p4"] = payment.ID
+	ids["favorite"] = favorite.ID
+	w.clock.Add(time.Hour)
+	pay("p5", 3, 50, "auto")
+	pay("p6", 2, 500, "auto")
+	return w, ids, start
+}
+
+func paymentNames(payments []types.Payment, ids map[string]string) []string {
+	names := map[string]string{}
+	for name, id := range ids {
+		names[id] = name
+	}
+	result := []string{}
+	for _, payment := range payments {
+		result = append(result, names[payment.ID])
+	}
+	return result
+}
+
+func TestService_QueryPayments_filters(t *testing.T) {
+	svc, ids, start := newQueryService(t)
+	hour := func(n int) time.Time { return start.Add(time.Duration(n) * time.Hour) }
+
+	tests := []struct {
+		name  string
+		query PaymentQuery
+		want  []string
+	}{
+		{"all", PaymentQuery{}, []string{"p1", "p2", "p3", "p4", "p5", "p6"}},
+		{"account", PaymentQuery{}.Where(AccountIs(1)), []string{"p1", "p3", "p4"}},
+		{"category", PaymentQuery{}.Where(CategoryIs("food")), []string{"p2", "p3"}},
+		{"status", PaymentQuery{}.Where(StatusIs(types.PaymentStatusFail)), []string{"p3"}},
+		{"amount", PaymentQuery{}.Where(AmountBetween(100, 200)), []string{"p1", "p2", "p4"}},
+		{"created", PaymentQuery{}.Where(CreatedBetween(hour(1), hour(3))), []string{"p2", "p3"}},
+		{"any favorite", PaymentQuery{}.Where(FromFavorite()), []string{"p4"}},
+		{"favorite", PaymentQuery{}.Where(FromFavorite(ids["favorite"])), []string{"p4"}},
+		{"other favorite", PaymentQuery{}.Where(FromFavorite("other")), []string{}},
+		{"or", PaymentQuery{}.Where(Or(AccountIs(3), CategoryIs("food"))), []string{"p2", "p3", "p5"}},
+		{"and not", PaymentQuery{}.Where(And(AccountIs(1, 2), Not(StatusIs(types.PaymentStatusFail)), CreatedBetween(hour(1), time.Time{}))), []string{"p2", "p4", "p6"}},
+		{"account and time", PaymentQuery{}.Where(AccountIs(1)).Where(CreatedBetween(hour(1), hour(4))), []string{"p3", "p4"}},
+		{"where twice", PaymentQuery{}.Where(AccountIs(2)).Where(AmountBetween(300, 1000)), []string{"p6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := svc.QueryPayments(context.Background(), tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := paymentNames(page.Payments, ids); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot > %v \nwant > %v", got, tt.want)
+			}
+			if page.Next != "" {
+				t.Errorf("unlimited query has a next page => %q", page.Next)
+			}
+		})
+	}
+}
+
+func TestService_QueryPayments_order(t *testing.T) {
+	svc, ids, _ := newQueryService(t)
+	byAccount := PaymentQuery{}.OrderBy(SortAccount)
+	newestFirst := byAccount.OrderByDesc(SortCreatedAt)
+	_ = byAccount.OrderBy(SortAmount)
+
+	page, err := svc.QueryPayments(context.Background(), newestFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"p4", "p3", "p1", "p6", "p2", "p5"}
+	if got := paymentNames(page.Payments, ids); !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot > %v \nwant > %v", got, want)
+	}
+
+	page, err = svc.QueryPayments(context.Background(), PaymentQuery{}.Where(AccountIs(2, 3)).OrderByDesc(SortAmount))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"p6", "p2", "p5"}
+	if got := paymentNames(page.Payments, ids); !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot > %v \nwant > %v", got, want)
+	}
+}
+
+func TestService_QueryPayments_pages(t *testing.T) {
+	svc, ids, _ := newQueryService(t)
+
+	page, err := svc.QueryPayments(context.Background(), PaymentQuery{}.Offset(1).Limit(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paymentNames(page.Payments, ids); !reflect.DeepEqual(got, []string{"p2", "p3"}) || page.Next == "" {
+		t.Errorf("got => %v, next => %q", got, page.Next)
+	}
+	page, err = svc.QueryPayments(context.Background(), PaymentQuery{}.Offset(10))
+	if err != nil || len(page.Payments) != 0 {
+		t.Errorf("got => %v, err => %v", page, err)
+	}
+
+	query := PaymentQuery{}.OrderByDesc(SortAmount)
+	all, err := svc.QueryPayments(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paged []types.Payment
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(all.Payments) {
+			t.Fatal("pagination does not end")
+		}
+		page, err := svc.QueryPayments(context.Background(), query.Limit(4).After(cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paged = append(paged, page.Payments...)
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	if !reflect.DeepEqual(paymentNames(paged, ids), paymentNames(all.Payments, ids)) {
+		t.Errorf("\ngot > %v \nwant > %v", paymentNames(paged, ids), paymentNames(all.Payments, ids))
+	}
+
+	_, err = svc.QueryPayments(context.Background(), PaymentQuery{}.After(cursor))
+	if err != ErrBadCursor {
+		t.Errorf("cursor of another order\ngot > %v \nwant > %v", err, ErrBadCursor)
+	}
+	_, err = svc.QueryPayments(context.Background(), query.After("not a cursor"))
+	if err != ErrBadCursor {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrBadCursor)
+	}
+}
+
+func TestService_QueryPayments_cancelled(t *testing.T) {
+	svc, _, _ := newQueryService(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := svc.QueryPayments(ctx, PaymentQuery{})
+	if err != context.Canceled {
+		t.Errorf("\ngot > %v \nwant > %v", err, context.Canceled)
+	}
+}
+
+func TestPlanPayments(t *testing.T) {
+	from := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		filter PaymentFilter
+		want   paymentPlan
+	}{
+		{"all", PaymentFilter{}, paymentPlan{scan: true}},
+		{"account", AccountIs(2, 1, 2), paymentPlan{accounts: []int64{1, 2}}},
+		{"category", CategoryIs("auto"), paymentPlan{scan: true}},
+		{"not account", Not(AccountIs(1)), paymentPlan{scan: true}},
+		{"and", And(CategoryIs("auto"), AccountIs(1, 2), AccountIs(3), CreatedBetween(from, to)), paymentPlan{accounts: []int64{3}, from: from, to: to}},
+		{"or", Or(AccountIs(1), And(AccountIs(2), CreatedBetween(from, to))), paymentPlan{accounts: []int64{1, 2}}},
+		{"or with scan", Or(AccountIs(1), CategoryIs("auto")), paymentPlan{scan: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planPayments(tt.filter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot > %+v \nwant > %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package wallet
+
+import (
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// Repository stores accounts, payments and favorites for Service.
+// Implementations must be safe for concurrent use and must return copies,
+// so that callers never share memory with the storage.
+type Repository interface {
+	FindAccount(accountID int64) (*types.Account, error)
+	FindAccountByPhone(phone types.Phone) (*types.Account, error)
+	Accounts() ([]types.Account, error)
+
+	FindPayment(paymentID string) (*types.Payment, error)
+	Payments() ([]types.Payment, error)
+	// AccountPayments returns the payments of the account ordered by
+	// creation time.
+	AccountPayments(accountID int64) ([]types.Payment, error)
+	// AccountPaymentsBetween returns the payments of the account created at
+	// or after from and before to, ordered by creation time.
+	AccountPaymentsBetween(accountID int64, from time.Time, to time.Time) ([]types.Payment, error)
+
+	FindFavorite(favoriteID string) (*types.Favorite, error)
+	Favorites() ([]types.Favorite, error)
+
+	Entries() ([]types.Entry, error)
+	LedgerEntries(ledger types.LedgerAccount) ([]types.Entry, error)
+	// TransactionEntries returns the entries of the ledger transaction.
+	TransactionEntries(transactionID string) ([]types.Entry, error)
+
+	FindIdempotencyRecord(key string) (*types.IdempotencyRecord, error)
+	IdempotencyRecords() ([]types.IdempotencyRecord, error)
+
+	// Update runs fn in a transaction. Either every change made through tx
+	// is stored or, if fn or the commit fails, none of them is.
+	Update(fn func(tx Tx) error) error
+}
+
+// Tx is the view of a Repository inside Update. Reads see the changes made
+// earlier in the same transaction.
+type Tx interface {
+	FindAccount(accountID int64) (*types.Account, error)
+	FindAccountByPhone(phone types.Phone) (*types.Account, error)
+	Accounts() ([]types.Account, error)
+	FindPayment(paymentID string) (*types.Payment, error)
+	Payments() ([]types.Payment, error)
+	FindFavorite(favoriteID string) (*types.Favorite, error)
+	Favorites() ([]types.Favorite, error)
+	FindEntry(entryID string) (*types.Entry, error)
+	Entries() ([]types.Entry, error)
+	LedgerEntries(ledger types.LedgerAccount) ([]types.Entry, error)
+	TransactionEntries(transactionID string) ([]types.Entry, error)
+	FindIdempotencyRecord(key string) (*types.IdempotencyRecord, error)
+	IdempotencyRecords() ([]types.IdempotencyRecord, error)
+
+	// NextAccountID reserves an ID greater than the ID of every stored account.
+	NextAccountID() int64
+
+	// SaveAccount creates the account or replaces the one with the same ID.
+	// It returns ErrPhoneRegistered if another account owns the phone.
+	SaveAccount(account types.Account) error
+	DeleteAccount(accountID int64) error
+
+	SavePayment(payment types.Payment) error
+	DeletePayment(paymentID string) error
+
+	SaveFavorite(favorite types.Favorite) error
+	DeleteFavorite(favoriteID string) error
+
+	// SaveEntry stores a ledger entry; entries are never changed, saving an
+	// entry with a known ID leaves it as it is.
+	SaveEntry(entry types.Entry) error
+	// DeleteEntry removes a ledger entry. Entries are only deleted when an
+	// import replaces the whole wallet.
+	DeleteEntry(entryID string) error
+
+	// SaveIdempotencyRecord creates the record or replaces the one with the
+	// same key.
+	SaveIdempotencyRecord(record types.IdempotencyRecord) error
+	DeleteIdempotencyRecord(key string) error
+}
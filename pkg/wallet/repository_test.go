@@ -0,0 +1,196 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func TestMemoryRepository_Update_rollsBackOnError(t *testing.T) {
+	repo := NewMemoryRepository()
+	svc := NewService(repo)
+
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := svc.Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("failure")
+	err = repo.Update(func(tx Tx) error {
+		if err := tx.SaveAccount(types.Account{ID: tx.NextAccountID(), Phone: "+992000000002"}); err != nil {
+			return err
+		}
+		if err := tx.SaveAccount(types.Account{ID: account.ID, Phone: "+992000000003", Balance: 5}); err != nil {
+			return err
+		}
+		if err := tx.DeletePayment(payment.ID); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("\ngot > %v \nwant > %v", err, failure)
+	}
+
+	accounts, err := repo.Accounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].Phone != "+992000000001" || accounts[0].Balance != 90 {
+		t.Errorf("accounts are not rolled back, got => %v", accounts)
+	}
+	if _, err := repo.FindAccountByPhone("+992000000003"); err != ErrAccountNotFound {
+		t.Errorf("phone index is not rolled back\ngot > %v \nwant > %v", err, ErrAccountNotFound)
+	}
+	history, err := repo.AccountPayments(account.ID)
+	if err != nil || len(history) != 1 {
+		t.Errorf("payments are not rolled back, got => %v, err => %v", history, err)
+	}
+
+	second, err := svc.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != account.ID+1 {
+		t.Errorf("next account ID is not rolled back\ngot > %v \nwant > %v", second.ID, account.ID+1)
+	}
+}
+
+func TestMemoryRepository_SaveAccount_phoneTaken(t *testing.T) {
+	repo := NewMemoryRepository()
+	err := repo.Update(func(tx Tx) error {
+		if err := tx.SaveAccount(types.Account{ID: 1, Phone: "+992000000001"}); err != nil {
+			return err
+		}
+		return tx.SaveAccount(types.Account{ID: 2, Phone: "+992000000001"})
+	})
+	if err != ErrPhoneRegistered {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrPhoneRegistered)
+	}
+}
+
+func TestFileRepository_reopen(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(repo)
+
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := svc.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	favorite, err := svc.FavoritePayment(payment.ID, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc = NewService(reopened)
+
+	got, err := svc.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 100 {
+		t.Errorf("wrong balance\ngot > %v \nwant > %v", got.Balance, 100)
+	}
+	gotPayment, err := svc.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPayment.Status != types.PaymentStatusFail {
+		t.Errorf("wrong status\ngot > %v \nwant > %v", gotPayment.Status, types.PaymentStatusFail)
+	}
+	if _, err := svc.PayFromFavorite(favorite.ID); err != nil {
+		t.Error(err)
+	}
+	next, err := svc.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID != account.ID+1 {
+		t.Errorf("wrong next account ID\ngot > %v \nwant > %v", next.ID, account.ID+1)
+	}
+}
+
+func TestFileRepository_export(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	dir := t.TempDir()
+	w.check(w.Export(dir))
+
+	repo, err := NewFileRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(repo)
+	checkBalance(t, svc, account.ID, 70)
+	if _, err := svc.FindPaymentByID(payment.ID); err != nil {
+		t.Error(err)
+	}
+
+	// the commits of the repository stay readable as an export
+	err = svc.Deposit(account.ID, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imported Service
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, &imported, account.ID, 75)
+}
+
+func TestFileRepository_Update_keepsMemoryOnWriteError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wallet")
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := NewFileRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(repo)
+
+	err = os.Remove(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.RegisterAccount("+992000000001"); err == nil {
+		t.Fatal("RegisterAccount must fail when the repository can't be written")
+	}
+	if _, err := svc.FindAccountByID(1); err != ErrAccountNotFound {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrAccountNotFound)
+	}
+}
@@ -1,13 +1,15 @@
 package wallet
 
 import (
-	"fmt"
+	"context"
 	"io"
+	"io/fs"
 	"log"
 	"os"
-	"strconv"
-	"strings"
+	"runtime"
+	"sort"
 	"sync"
+	"time"
 	"errors"
 	"github.com/shFarrukh/wallet/pkg/types"
 	"github.com/google/uuid"
@@ -21,135 +23,277 @@ var (
 	ErrPaymentNotFound      = errors.New("payment not found")
 	ErrFavoriteNotFound     = errors.New("favorite not found")
 	ErrFileNotFound         = errors.New("file not found")
+	ErrSameAccount          = errors.New("can't transfer to the same account")
+	ErrRepeatIncoming       = errors.New("can't repeat an incoming transfer")
 )
 
+// Service is safe for concurrent use. Balance changes of one account are
+// serialized by that account's own lock, so operations on different
+// accounts only wait for each other while the repository commits.
 type Service struct {
-	nextAccountID int64
-	accounts      []*types.Account
-	payments      []*types.Payment
-	favorites     []*types.Favorite
+	repo         Repository
+	repoOnce     sync.Once
+	mu           sync.Mutex
+	accountLocks map[int64]*sync.Mutex
+
+	clock             Clock
+	rates             ExchangeRateProvider
+	idempotencyWindow time.Duration
+	encoding          ExportEncoding
+	keyLocks          map[string]*keyLock
 }
 
+// NewService returns a Service that keeps its state in repo.
+func NewService(repo Repository) *Service {
+	return &Service{repo: repo}
+}
+
+// repository returns the storage of the service; a zero Service keeps its
+// state in a MemoryRepository.
+func (s *Service) repository() Repository {
+	s.repoOnce.Do(func() {
+		if s.repo == nil {
+			s.repo = NewMemoryRepository()
+		}
+	})
+	return s.repo
+}
+
+// RegisterAccount registers an account denominated in DefaultCurrency.
 func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
-	for _, account := range s.accounts {
-		if account.Phone == phone {
-			return nil, ErrPhoneRegistered
+	return s.registerAccount(phone, DefaultCurrency)
+}
+
+func (s *Service) registerAccount(phone types.Phone, currency types.Currency) (*types.Account, error) {
+	var account types.Account
+	err := s.repository().Update(func(tx Tx) error {
+		_, err := tx.FindAccountByPhone(phone)
+		if err == nil {
+			return ErrPhoneRegistered
 		}
+		if err != ErrAccountNotFound {
+			return err
+		}
+
+		account = types.Account{
+			ID:       tx.NextAccountID(),
+			Phone:    phone,
+			Balance:  0,
+			Currency: currency,
+		}
+		return tx.SaveAccount(account)
+	})
+	if err != nil {
+		return nil, err
 	}
-	s.nextAccountID++
-	account := &types.Account{
-		ID:      s.nextAccountID,
-		Phone:   phone,
-		Balance: 0,
-	}
-	s.accounts = append(s.accounts, account)
-	return account, nil
+	return &account, nil
 }
 
 func (s *Service) Deposit(accountID int64, amount types.Money) error {
-	if amount <= 0 {
+	return s.deposit(accountID, inAccountCurrency(amount), nil)
+}
+
+// deposit credits the account and, unless record is nil, saves the
+// idempotency record in the same transaction.
+func (s *Service) deposit(accountID int64, amount types.Amount, record *types.IdempotencyRecord) error {
+	if amount.Value <= 0 {
 		return ErrAmountMustBePositive
 	}
 
-	var account *types.Account
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-			break
-		}
+	unlock, err := s.lockAccount(accountID)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	if account == nil {
-		return ErrAccountNotFound
+	account, err := s.repository().FindAccount(accountID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkCurrency(account, amount); err != nil {
+		return err
 	}
 
-	account.Balance += amount
-	return nil
+	account.Balance += amount.Value
+	now := s.now()
+	return s.repository().Update(func(tx Tx) error {
+		if err := tx.SaveAccount(*account); err != nil {
+			return err
+		}
+		if err := saveIdempotencyRecord(tx, record, ""); err != nil {
+			return err
+		}
+		cashIn := currencyLedger(LedgerCashIn, currencyOf(account))
+		return postLedger(tx, cashIn, AccountLedger(accountID), amount.Value, "", now)
+	})
 }
 
 func (s *Service) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
-	if amount <= 0 {
+	return s.pay(accountID, inAccountCurrency(amount), category, nil)
+}
+
+// pay makes the payment and, unless record is nil, saves the idempotency
+// record in the same transaction.
+func (s *Service) pay(accountID int64, amount types.Amount, category types.PaymentCategory, record *types.IdempotencyRecord) (*types.Payment, error) {
+	return s.payFrom(accountID, amount, category, "", record)
+}
+
+// payFrom makes the payment as pay does, noting the favorite it is made
+// from unless favoriteID is empty.
+func (s *Service) payFrom(accountID int64, amount types.Amount, category types.PaymentCategory, favoriteID string, record *types.IdempotencyRecord) (*types.Payment, error) {
+	if amount.Value <= 0 {
 		return nil, ErrAmountMustBePositive
 	}
 
-	var account *types.Account
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-			break
-		}
-	}
-	if account == nil {
-		return nil, ErrAccountNotFound
+	unlock, err := s.lockAccount(accountID)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
-	if account.Balance < amount {
+	// the account lock is held, so nobody else can change the balance
+	account, err := s.repository().FindAccount(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCurrency(account, amount); err != nil {
+		return nil, err
+	}
+	if account.Balance < amount.Value {
 		return nil, ErrNotEnoughBalance
 	}
 
-	account.Balance -= amount
+	account.Balance -= amount.Value
 	paymentID := uuid.New().String()
+	now := s.now()
 	payment := &types.Payment{
-		ID:        paymentID,
-		AccountID: accountID,
-		Amount:    amount,
-		Category:  category,
-		Status:    types.PaymentStatusInProgress,
+		ID:         paymentID,
+		AccountID:  accountID,
+		Amount:     amount.Value,
+		Category:   category,
+		Status:     types.PaymentStatusInProgress,
+		FavoriteID: favoriteID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	err = s.repository().Update(func(tx Tx) error {
+		if err := tx.SaveAccount(*account); err != nil {
+			return err
+		}
+		if err := tx.SavePayment(*payment); err != nil {
+			return err
+		}
+		if err := saveIdempotencyRecord(tx, record, paymentID); err != nil {
+			return err
+		}
+		merchant := currencyLedger(MerchantLedger(category), currencyOf(account))
+		return postLedger(tx, AccountLedger(accountID), merchant, amount.Value, paymentID, now)
+	})
+	if err != nil {
+		return nil, err
 	}
-	s.payments = append(s.payments, payment)
 	return payment, nil
 }
 
+// FindAccountByID returns a snapshot of the account; later balance changes
+// are not reflected in it.
 func (s *Service) FindAccountByID(accountID int64) (*types.Account, error) {
-	var account *types.Account
-	for _, accounts := range s.accounts {
-		if accounts.ID == accountID {
-			account = accounts
-			break
-		}
-	}
+	return s.repository().FindAccount(accountID)
+}
 
-	if account == nil {
-		return nil, ErrAccountNotFound
-	}
+// FindPaymentByID returns a snapshot of the payment.
+func (s *Service) FindPaymentByID(paymentID string) (*types.Payment, error) {
+	return s.repository().FindPayment(paymentID)
+}
 
-	return account, nil
+// lockAccount acquires the per-account lock that serializes balance changes
+// of accountID and returns the function releasing it.
+func (s *Service) lockAccount(accountID int64) (func(), error) {
+	return s.lockAccounts(accountID)
 }
 
+// lockAccounts acquires the locks of several accounts. The locks are always
+// taken in the order of account IDs, so two callers locking the same
+// accounts can't deadlock.
+func (s *Service) lockAccounts(accountIDs ...int64) (func(), error) {
+	ids := append([]int64(nil), accountIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 
-func (s *Service) FindPaymentByID(paymentID string) (*types.Payment, error) {
-	for _, payment := range s.payments {
-		if payment.ID == paymentID {
-			return payment, nil
+	var locks []*sync.Mutex
+	s.mu.Lock()
+	for i, accountID := range ids {
+		if i > 0 && ids[i-1] == accountID {
+			continue
+		}
+		_, err := s.repository().FindAccount(accountID)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		if s.accountLocks == nil {
+			s.accountLocks = make(map[int64]*sync.Mutex)
+		}
+		lock, ok := s.accountLocks[accountID]
+		if !ok {
+			lock = &sync.Mutex{}
+			s.accountLocks[accountID] = lock
 		}
+		locks = append(locks, lock)
 	}
-	return nil, ErrPaymentNotFound
-}
+	s.mu.Unlock()
 
-func (s *Service) Reject(paymentID string) error {
-	payment, err := s.FindPaymentByID(paymentID)
-	if err != nil {
-		return err
+	for _, lock := range locks {
+		lock.Lock()
 	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}, nil
+}
 
-	account, err := s.FindAccountByID(payment.AccountID)
-
-	if err != nil {
-		return err
+// lockAllAccounts acquires the locks of every stored account, for the
+// imports that may change the balance of any of them.
+func (s *Service) lockAllAccounts() (func(), error) {
+	for {
+		accounts, err := s.repository().Accounts()
+		if err != nil {
+			return nil, err
+		}
+		accountIDs := make([]int64, len(accounts))
+		for i, account := range accounts {
+			accountIDs[i] = account.ID
+		}
+		unlock, err := s.lockAccounts(accountIDs...)
+		// another import may have removed an account in the meantime
+		if err != ErrAccountNotFound {
+			return unlock, err
+		}
 	}
+}
 
-	payment.Status = types.PaymentStatusFail
-	account.Balance += payment.Amount
-	return nil
+// Reject fails the payment and returns the money to the account. Both
+// INPROGRESS and confirmed payments can be rejected.
+func (s *Service) Reject(paymentID string) error {
+	return s.changeStatus(paymentID, types.PaymentStatusFail)
 }
 
 func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
+	return s.repeat(paymentID, nil)
+}
+
+func (s *Service) repeat(paymentID string, record *types.IdempotencyRecord) (*types.Payment, error) {
 	pay, err := s.FindPaymentByID(paymentID)
 	if err != nil {
 		return nil, err
 	}
+	if pay.LinkedPaymentID != "" {
+		return s.repeatTransfer(pay, record)
+	}
 
-	payment, err := s.Pay(pay.AccountID, pay.Amount, pay.Category)
+	payment, err := s.pay(pay.AccountID, inAccountCurrency(pay.Amount), pay.Category, record)
 	if err != nil {
 		return nil, err
 	}
@@ -172,34 +316,39 @@ func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorit
 	}
 
 	favoriteID := uuid.New().String()
+	now := s.now()
 	favorite := &types.Favorite{
 		ID:        favoriteID,
 		AccountID: pay.AccountID,
 		Amount:    pay.Amount,
 		Category:  pay.Category,
 		Name:      name,
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
 
-	s.favorites = append(s.favorites, favorite)
-	return favorite, err
+	err = s.repository().Update(func(tx Tx) error {
+		return tx.SaveFavorite(*favorite)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return favorite, nil
 
 }
 
 //PayFromFavorite
 func (s *Service) PayFromFavorite(favoriteID string) (*types.Payment, error) {
-	var favorite *types.Favorite
-	for _, favorites := range s.favorites {
-		if favorites.ID == favoriteID {
-			favorite = favorites
-			break
-		}
-	}
+	return s.payFromFavorite(favoriteID, nil)
+}
 
-	if favorite == nil {
-		return nil, ErrFavoriteNotFound
+func (s *Service) payFromFavorite(favoriteID string, record *types.IdempotencyRecord) (*types.Payment, error) {
+	favorite, err := s.repository().FindFavorite(favoriteID)
+	if err != nil {
+		return nil, err
 	}
 
-	pay, err := s.Pay(favorite.AccountID, favorite.Amount, favorite.Category)
+	pay, err := s.payFrom(favorite.AccountID, inAccountCurrency(favorite.Amount), favorite.Category, favorite.ID, record)
 	if err != nil {
 		return nil, err
 	}
@@ -208,654 +357,280 @@ func (s *Service) PayFromFavorite(favoriteID string) (*types.Payment, error) {
 }
 
 func (s *Service) ExportToFile(path string) error {
-	file, err := os.Create(path)
+	file, err := createFile(path)
 	if err != nil {
-		log.Print(err)
-		return ErrFileNotFound
-	}
-
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			log.Print(cerr)
-		}
-	}()
-	data := ""
-	for _, account := range s.accounts {
-		id := strconv.Itoa(int(account.ID)) + ";"
-		phone := string(account.Phone) + ";"
-		balance := strconv.Itoa(int(account.Balance))
-
-		data += id
-		data += phone
-		data += balance + "|"
+		return err
 	}
-
-	_, err = file.Write([]byte(data))
-	if err != nil {
-		log.Print(err)
-		return ErrFileNotFound
+	err = s.WriteAccounts(file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
 	}
-	return nil
+	return err
 }
 
 func (s *Service) ImportFromFile(path string) error {
 	file, err := os.Open(path)
-
-	if err != nil {
-		log.Print(err)
+	if os.IsNotExist(err) {
 		return ErrFileNotFound
 	}
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			log.Print(cerr)
-		}
-	}()
-
-	content := make([]byte, 0)
-	buf := make([]byte, 4)
-	for {
-		read, err := file.Read(buf)
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			log.Print(err)
-			return ErrFileNotFound
-		}
-		content = append(content, buf[:read]...)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	data := string(content)
-
-	accounts := strings.Split(data, "|")
-	accounts = accounts[:len(accounts)-1]
-	// if accounts == nil {
-	// 	return ErrAccountNotFound
-	// }
-	for _, account := range accounts {
-
-		value := strings.Split(account, ";")
-		id, err := strconv.Atoi(value[0])
-		if err != nil {
-			return err
-		}
-		phone := types.Phone(value[1])
-		balance, err := strconv.Atoi(value[2])
-		if err != nil {
-			return err
-		}
-		editAccount := &types.Account{
-			ID:      int64(id),
-			Phone:   phone,
-			Balance: types.Money(balance),
-		}
-
-		s.accounts = append(s.accounts, editAccount)
-		log.Print(account)
-	}
-	return nil
+	return s.ReadAccounts(file)
 }
 
-//Export(dir string) error
-func (s *Service) Export(dir string) error {
-	lenAccounts := len(s.accounts)
-
-	if lenAccounts != 0 {
-		fileDir := dir + "/accounts.dump"
-		file, err := os.Create(fileDir)
-		if err != nil {
-			log.Print(err)
-			return ErrFileNotFound
-		}
-
-		defer func() {
-			if cerr := file.Close(); cerr != nil {
-				log.Print(cerr)
-			}
-		}()
-		data := ""
-		for _, account := range s.accounts {
-			id := strconv.Itoa(int(account.ID)) + ";"
-			phone := string(account.Phone) + ";"
-			balance := strconv.Itoa(int(account.Balance))
-
-			data += id
-			data += phone
-			data += balance + "|"
-		}
-
-		_, err = file.Write([]byte(data))
-		if err != nil {
-			log.Print(err)
-			return ErrFileNotFound
-		}
+// WriteAccounts writes the dump of the accounts, as ExportToFile does, to
+// w, encoded as the export encoding of the service says.
+func (s *Service) WriteAccounts(w io.Writer) (err error) {
+	accounts, err := s.repository().Accounts()
+	if err != nil {
+		return err
 	}
 
-	lenPayments := len(s.payments)
-
-	if lenPayments != 0 {
-		fileDir := dir + "/payments.dump"
-
-		file, err := os.Create(fileDir)
-		if err != nil {
-			log.Print(err)
-			return ErrFileNotFound
-		}
-
-		defer func() {
-			if cerr := file.Close(); cerr != nil {
-				log.Print(cerr)
-			}
-		}()
-		data := ""
-		for _, payment := range s.payments {
-			idPayment := string(payment.ID) + ";"
-			idPaymnetAccountId := strconv.Itoa(int(payment.AccountID)) + ";"
-			amountPayment := strconv.Itoa(int(payment.Amount)) + ";"
-			categoryPayment := string(payment.Category) + ";"
-			statusPayment := string(payment.Status)
-
-			data += idPayment
-			data += idPaymnetAccountId
-			data += amountPayment
-			data += categoryPayment
-			data += statusPayment + "|"
-		}
-
-		_, err = file.Write([]byte(data))
-		if err != nil {
-			log.Print(err)
-			return ErrFileNotFound
-		}
+	encoder, err := s.encoder(w, accountsFile.name)
+	if err != nil {
+		return err
 	}
-
-	lenFavorites := len(s.favorites)
-
-	if lenFavorites != 0 {
-		fileDir := dir + "/favorites.dump"
-		file, err := os.Create(fileDir)
-		if err != nil {
-			log.Print(err)
-			return ErrFileNotFound
-		}
-
-		defer func() {
-			if cerr := file.Close(); cerr != nil {
-				log.Print(cerr)
-			}
-		}()
-		data := ""
-		for _, favorite := range s.favorites {
-			idFavorite := string(favorite.ID) + ";"
-			idFavoriteAccountId := strconv.Itoa(int(favorite.AccountID)) + ";"
-			nameFavorite := string(favorite.Name) + ";"
-			amountFavorite := strconv.Itoa(int(favorite.Amount)) + ";"
-			categoryFavorite := string(favorite.Category)
-
-			data += idFavorite
-			data += idFavoriteAccountId
-			data += nameFavorite
-			data += amountFavorite
-			data += categoryFavorite + "|"
-		}
-		_, err = file.Write([]byte(data))
-		if err != nil {
-			log.Print(err)
-			return ErrFileNotFound
+	defer func() {
+		if cerr := encoder.Close(); err == nil {
+			err = cerr
 		}
-	}
-	return nil
+	}()
+	return accountsFile.write(encoder, &walletData{accounts: accounts})
 }
 
-// Import(dir string) error
-func (s *Service) Import(dir string) error {
-	dirAccount := dir + "/accounts.dump"
-	file, err := os.Open(dirAccount)
-
+// ReadAccounts reads a dump of accounts from r into the wallet, decoding
+// it when it is compressed or encrypted.
+func (s *Service) ReadAccounts(r io.Reader) error {
+	decoder, err := s.decoder(r, accountsFile.name)
 	if err != nil {
-		log.Print(err)
-		// return ErrFileNotFound
-		err = ErrFileNotFound
+		return err
 	}
-	if err != ErrFileNotFound {
-		defer func() {
-			if cerr := file.Close(); cerr != nil {
-				log.Print(cerr)
-			}
-		}()
-
-		content := make([]byte, 0)
-		buf := make([]byte, 4)
-		for {
-			read, err := file.Read(buf)
-			if err == io.EOF {
-				break
-			}
-
-			if err != nil {
-				log.Print(err)
-				//log.Print(dirAccount, " 3333")
-				return ErrFileNotFound
-			}
-			content = append(content, buf[:read]...)
-		}
-
-		data := string(content)
-
-		accounts := strings.Split(data, "|")
-		accounts = accounts[:len(accounts)-1]
-		// if accounts == nil {
-		// 	return ErrAccountNotFound
-		// }
-
-		for _, account := range accounts {
+	defer decoder.Close()
 
-			value := strings.Split(account, ";")
-
-			id, err := strconv.Atoi(value[0])
-			if err != nil {
-				return err
-			}
-			phone := types.Phone(value[1])
-			balance, err := strconv.Atoi(value[2])
-			if err != nil {
-				return err
-			}
-			editAccount := &types.Account{
-				ID:      int64(id),
-				Phone:   phone,
-				Balance: types.Money(balance),
-			}
-			//log.Print(editAccount, " read")
-
-			s.accounts = append(s.accounts, editAccount)
-		}
+	data := &walletData{}
+	err = accountsFile.read(decoder, data)
+	if err != nil {
+		return err
 	}
 
-	dirPaymnet := dir + "/payments.dump"
-	filePayment, err := os.Open(dirPaymnet)
-
+	unlock, err := s.lockAllAccounts()
 	if err != nil {
-		log.Print(err)
-		// return ErrFileNotFound
-		err = ErrFileNotFound
+		return err
 	}
-	if err != ErrFileNotFound {
-		defer func() {
-			if cerr := filePayment.Close(); cerr != nil {
-				log.Print(cerr)
-			}
-		}()
-
-		contentPayment := make([]byte, 0)
-		buf := make([]byte, 4)
-		for {
-			readPayment, err := filePayment.Read(buf)
-			if err == io.EOF {
-				break
-			}
-
-			if err != nil {
-				log.Print(err)
-				return ErrFileNotFound
-			}
-			contentPayment = append(contentPayment, buf[:readPayment]...)
-		}
-
-		data := string(contentPayment)
-
-		payments := strings.Split(data, "|")
-		payments = payments[:len(payments)-1]
-		//log.Print(favorites, " fav")
-		for _, payment := range payments {
-
-			value := strings.Split(payment, ";")
-			idPayment := string(value[0])
-
-			accountIdPeyment, err := strconv.Atoi(value[1])
-			if err != nil {
-				return err
-			}
+	defer unlock()
 
-			amountPayment, err := strconv.Atoi(value[2])
-			if err != nil {
+	return s.repository().Update(func(tx Tx) error {
+		for _, account := range data.accounts {
+			if err := tx.SaveAccount(account); err != nil {
 				return err
 			}
-			categoryPayment := types.PaymentCategory(value[3])
-
-			statusPayment := types.PaymentStatus(value[4])
-			newPayment := &types.Payment{
-				ID:        idPayment,
-				AccountID: int64(accountIdPeyment),
-				Amount:    types.Money(amountPayment),
-				Category:  categoryPayment,
-				Status:    statusPayment,
-			}
-
-			s.payments = append(s.payments, newPayment)
-			//log.Print(payment)
-
 		}
-	}
+		return nil
+	})
+}
 
-	dirfavorite := dir + "/favorites.dump"
-	fileFavorite, err := os.Open(dirfavorite)
+//Export(dir string) error
+func (s *Service) Export(dir string) error {
+	_, err := exportSnapshot(dir, s.ExportTo)
+	return err
+}
 
+// ExportTo writes a dump file of every collection that is not empty to
+// sink, followed by the manifest of the export.
+func (s *Service) ExportTo(sink FileSink) error {
+	data, err := fetchWalletData(s.repository())
 	if err != nil {
-		log.Print(err)
-		// return ErrFileNotFound
-		err = ErrFileNotFound
+		return err
 	}
-	if err != ErrFileNotFound {
-		defer func() {
-			if cerr := fileFavorite.Close(); cerr != nil {
-				log.Print(cerr)
-			}
-		}()
-
-		contentFavorite := make([]byte, 0)
-		buf := make([]byte, 4)
-		for {
-			readFavorite, err := fileFavorite.Read(buf)
-			if err == io.EOF {
-				break
-			}
-
-			if err != nil {
-				log.Print(err)
-				return ErrFileNotFound
-			}
-			contentFavorite = append(contentFavorite, buf[:readFavorite]...)
-		}
-
-		data := string(contentFavorite)
-		//log.Print(dirfavorite, " fav ", data)
-		favorites := strings.Split(data, "|")
-		favorites = favorites[:len(favorites)-1]
 
-		for _, favorite := range favorites {
+	files := newManifestSink(sink, formatDump, s.now(), s.exportEncoding().Keys)
+	err = writeDumps(s.encodingSink(files), data)
+	if err != nil {
+		return err
+	}
+	return files.writeManifest()
+}
 
-			valueFavorite := strings.Split(favorite, ";")
-			idFavorite := string(valueFavorite[0])
-			accountIdFavorite, err := strconv.Atoi(valueFavorite[1])
-			if err != nil {
-				return err
-			}
-			nameFavorite := string(valueFavorite[2])
+// Import(dir string) error
+func (s *Service) Import(dir string) error {
+	return s.ImportWithMode(dir, ImportMerge)
+}
 
-			amountFavorite, err := strconv.Atoi(valueFavorite[3])
-			if err != nil {
-				return err
-			}
-			categoryPayment := types.PaymentCategory(valueFavorite[4])
-
-			newFavorite := &types.Favorite{
-				ID:        idFavorite,
-				AccountID: int64(accountIdFavorite),
-				Name:      nameFavorite,
-				Amount:    types.Money(amountFavorite),
-				Category:  categoryPayment,
-			}
+// ImportWithMode reads the current snapshot exported to dir into the
+// wallet, merging it with the stored records or replacing them as mode
+// says.
+func (s *Service) ImportWithMode(dir string, mode ImportMode) error {
+	fsys, err := openSnapshot(dir)
+	if err != nil {
+		return err
+	}
+	return s.ImportFrom(fsys, mode)
+}
 
-			s.favorites = append(s.favorites, newFavorite)
-			//log.Print(favorite)
-		}
+// ImportFrom reads the dump files of ExportTo from fsys into the wallet.
+// Missing files are skipped; files that do not match the manifest fail the
+// import with ErrCorruptedExport before the wallet is changed.
+func (s *Service) ImportFrom(fsys fs.FS, mode ImportMode) error {
+	data, err := s.readDumps(fsys)
+	if err != nil {
+		return err
 	}
+	return s.load(data, mode)
+}
 
-	return nil
+// readDumps reads the dump files of ExportTo from fsys.
+func (s *Service) readDumps(fsys fs.FS) (*walletData, error) {
+	return readDumps(fsys, s.exportEncoding().Keys)
 }
 
 //ExportAccountHistory
 func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error) {
-	var paymentFound []types.Payment
-
-	for _, payment := range s.payments {
-		if payment.AccountID == accountID {
-			paymentFound = append(paymentFound, *payment)
-		}
+	paymentFound, err := s.repository().AccountPayments(accountID)
+	if err != nil {
+		return nil, err
 	}
-	if paymentFound == nil {
+	if len(paymentFound) == 0 {
 		return nil, ErrAccountNotFound
 	}
 	return paymentFound, nil
 }
 
+// PaymentsBetween returns the payments of the account created at or after
+// from and before to, oldest first.
+func (s *Service) PaymentsBetween(accountID int64, from time.Time, to time.Time) ([]types.Payment, error) {
+	_, err := s.repository().FindAccount(accountID)
+	if err != nil {
+		return nil, err
+	}
+	return s.repository().AccountPaymentsBetween(accountID, from, to)
+}
+
 //HistoryToFiles
 func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
-	if len(payments) > 0 {
-		if len(payments) <= records {
-			file, _ := os.OpenFile(dir+"/payments.dump", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-			defer func() {
-				if cerr := file.Close(); cerr != nil {
-					log.Print(cerr)
-				}
-			}()
-
-			var str string
-			for _, payment := range payments {
-				// str += fmt.Sprint(payment.ID) + ";" + fmt.Sprint(payment.AccountID) + ";" + fmt.Sprint(payment.Amount) + ";" + fmt.Sprint(payment.Category) + ";" + fmt.Sprint(payment.Status) + "\n"
-				idPayment := string(payment.ID) + ";"
-				idPaymnetAccountId := strconv.Itoa(int(payment.AccountID)) + ";"
-				amountPayment := strconv.Itoa(int(payment.Amount)) + ";"
-				categoryPayment := string(payment.Category) + ";"
-				statusPayment := string(payment.Status)
-
-				str += idPayment
-				str += idPaymnetAccountId
-				str += amountPayment
-				str += categoryPayment
-				str += statusPayment + "\n"
-			}
-			_, err := file.WriteString(str)
-			if err != nil {
-				log.Print(err)
-			}
-		} else {
-			var str string
-			k := 0
-			t := 1
-			var file *os.File
-			for _, payment := range payments {
-				if k == 0 {
-					file, _ = os.OpenFile(dir+"/payments"+fmt.Sprint(t)+".dump", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-				}
-				k++
-				str = string(payment.ID) + ";" + strconv.Itoa(int(payment.AccountID)) + ";" + strconv.Itoa(int(payment.Amount)) + ";" + string(payment.Category) + ";" + string(payment.Status) + "\n"
-				_, err := file.WriteString(str)
-				if err != nil {
-					log.Print(err)
-				}
-				if k == records {
-					str = ""
-					t++
-					k = 0
-					fmt.Println(t, " = t")
-					file.Close()
-				}
-			}
-		}
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
 	}
-	return nil
+	return s.HistoryTo(payments, DirSink(dir), HistoryOptions{MaxRecords: records})
 }
 
-//SumPayments ...
-func (s *Service) SumPayments(goroutines int) types.Money {
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	sum := int64(0)
-	kol := 0
-	i := 0
-	if goroutines == 0 {
-		kol = len(s.payments)
-	} else {
-		kol = int(len(s.payments) / goroutines)
-	}
-	for i = 0; i < goroutines-1; i++ {
-		wg.Add(1)
-		go func(index int) {
-			defer wg.Done()
-			val := int64(0)
-			payments := s.payments[index*kol : (index+1)*kol]
-			for _, payment := range payments {
-				val += int64(payment.Amount)
-			}
-			mu.Lock()
-			sum += val
-			mu.Unlock()
+// HistoryFromFiles reads the payment history written by HistoryToFiles
+// from dir.
+func (s *Service) HistoryFromFiles(dir string) ([]types.Payment, error) {
+	return s.HistoryFrom(os.DirFS(dir))
+}
 
-		}(i)
+// paymentsSnapshot copies the payments so that they can be processed by
+// several goroutines.
+func (s *Service) paymentsSnapshot() []types.Payment {
+	payments, err := s.repository().Payments()
+	if err != nil {
+		log.Print(err)
 	}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		val := int64(0)
-		payments := s.payments[i*kol:]
-		for _, payment := range payments {
-			val += int64(payment.Amount)
-		}
-		mu.Lock()
-		sum += val
-		mu.Unlock()
+	return payments
+}
 
-	}()
-	wg.Wait()
-	return types.Money(sum)
+//SumPayments ...
+func (s *Service) SumPayments(goroutines int) types.Money {
+	sum, err := NewEngine(goroutines).Reduce(context.Background(), s.paymentsSnapshot(),
+		func() interface{} { return types.Money(0) },
+		func(acc interface{}, payment types.Payment) interface{} { return acc.(types.Money) + payment.Amount },
+		func(a interface{}, b interface{}) interface{} { return a.(types.Money) + b.(types.Money) },
+	)
+	if err != nil {
+		log.Print(err)
+		return 0
+	}
+	return sum.(types.Money)
 }
 
 //FilterPayments
-func (s Service) FilterPayments(accountID int64, goroutines int) (newPayment []types.Payment, err error) {
-	if goroutines < 2 {
-		for _, value := range s.payments {
-			if value.AccountID == accountID {
-				newPayment = append(newPayment, *value)
-			}
-		}
-		if newPayment == nil {
-			return nil, ErrAccountNotFound
-		}
-		return
-	}
-	wg := sync.WaitGroup{}
-	mutex := sync.Mutex{}
-	max := 0
-	count := len(s.payments) / goroutines
-	for i := 1; i < goroutines; i++ {
-		max += count
-		wg.Add(1)
-		go func(val int) {
-			defer wg.Done()
-			sum := []types.Payment{}
-			for _, value := range s.payments[val-count : val] {
-				if value.AccountID == accountID {
-					sum = append(sum, *value)
-				}
-			}
-			mutex.Lock()
-			newPayment = append(newPayment, sum...)
-			mutex.Unlock()
-		}(max)
-	}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		sum := []types.Payment{}
-		for _, value := range s.payments[max:] {
-			if value.AccountID == accountID {
-				sum = append(sum, *value)
-			}
-		}
-		mutex.Lock()
-		newPayment = append(newPayment, sum...)
-		mutex.Unlock()
-	}()
-	wg.Wait()
-	if newPayment == nil {
-		return nil, ErrAccountNotFound
+func (s *Service) FilterPayments(accountID int64, goroutines int) (newPayment []types.Payment, err error) {
+	payments, err := s.repository().AccountPayments(accountID)
+	if err != nil {
+		return nil, err
 	}
-	return
+	return filterPayments(payments, func(payment types.Payment) bool {
+		return payment.AccountID == accountID
+	}, goroutines)
 }
 
 //FilterPaymentsByFn
-func (s Service) FilterPaymentsByFn(filter func(payment types.Payment) bool, goroutines int) (newPayment []types.Payment, err error) {
-	if goroutines < 2 {
-		for _, value := range s.payments {
-			if filter(*value) {
-				newPayment = append(newPayment, *value)
-			}
-		}
-		if newPayment == nil {
-			return nil, ErrAccountNotFound
-		}
-		return
-	}
-	wg := sync.WaitGroup{}
-	mutex := sync.Mutex{}
-	max := 0
-	count := len(s.payments) / goroutines
-	for i := 1; i < goroutines; i++ {
-		max += count
-		wg.Add(1)
-		go func(val int) {
-			defer wg.Done()
-			sum := []types.Payment{}
-			for _, value := range s.payments[val-count : val] {
-				if filter(*value) {
-					sum = append(sum, *value)
-				}
-			}
-			mutex.Lock()
-			newPayment = append(newPayment, sum...)
-			mutex.Unlock()
-		}(max)
+func (s *Service) FilterPaymentsByFn(filter func(payment types.Payment) bool, goroutines int) (newPayment []types.Payment, err error) {
+	payments, err := s.repository().Payments()
+	if err != nil {
+		return nil, err
 	}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		sum := []types.Payment{}
-		for _, value := range s.payments[max:] {
-			if filter(*value) {
-				sum = append(sum, *value)
-			}
-		}
-		mutex.Lock()
-		newPayment = append(newPayment, sum...)
-		mutex.Unlock()
-	}()
-	wg.Wait()
-	if newPayment == nil {
+	return filterPayments(payments, filter, goroutines)
+}
+
+// filterPayments keeps the payments filter reports true for, in their
+// order. Keeping none is reported as ErrAccountNotFound.
+func filterPayments(payments []types.Payment, filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
+	kept, err := NewEngine(goroutines).Filter(context.Background(), payments, filter)
+	if err != nil {
+		return nil, err
+	}
+	if kept == nil {
 		return nil, ErrAccountNotFound
 	}
-	return
+	return kept, nil
 }
+
+// Progress is the sum of the payments of one part.
 type Progress struct {
+	// Part is the number of the part, counted from 0.
 	Part   int
 	Result types.Money
 }
-func (s *Service) SumPaymentsWithProgress() <-chan Progress { 
 
-	ch := make(chan Progress,1)
-	defer close(ch)
-	
-	if s.payments == nil {
-		return ch
-	}
-	
+// minProgressPartSize is the fewest payments SumPaymentsWithProgress sums
+// in one part.
+const minProgressPartSize = 100
 
-	wg := sync.WaitGroup{}	
-	wg.Add(1)
-	
-		go func(ch chan Progress){
-				defer wg.Done()
-				sum:=Progress{}
+// progressPartSize returns the number of payments SumPaymentsWithProgress
+// sums in one part, so that n payments are shared out evenly between the
+// workers.
+func progressPartSize(n int, workers int) int {
+	size := (n + workers - 1) / workers
+	if size < minProgressPartSize {
+		return minProgressPartSize
+	}
+	return size
+}
 
-				for _, value := range s.payments{
-					sum.Result+=value.Amount
-				}	
-					ch<- sum
-				
-		}(ch)
+// SumPaymentsWithProgress sums the payments as
+// SumPaymentsWithProgressContext does, without a way to stop it.
+func (s *Service) SumPaymentsWithProgress() <-chan Progress {
+	return s.SumPaymentsWithProgressContext(context.Background())
+}
 
-	wg.Wait()
+// SumPaymentsWithProgressContext sums the payments in a part per worker,
+// or in parts of minProgressPartSize payments when there are few, and
+// sends the sum of every part on the returned channel as soon as the part
+// is done. The parts may finish in any order. The channel is closed once
+// every part is reported, or once the summing stops because ctx is done.
+func (s *Service) SumPaymentsWithProgressContext(ctx context.Context) <-chan Progress {
+	payments := s.paymentsSnapshot()
+	workers := runtime.GOMAXPROCS(0)
+	engine := &Engine{workers: workers, chunkSize: progressPartSize(len(payments), workers)}
+
+	ch := make(chan Progress)
+	go func() {
+		defer close(ch)
+		engine.run(ctx, len(payments), func(part int, from int, to int) {
+			progress := Progress{Part: part}
+			for _, payment := range payments[from:to] {
+				progress.Result += payment.Amount
+			}
+			select {
+			case ch <- progress:
+			case <-ctx.Done():
+			}
+		})
+	}()
 	return ch
- }
+}
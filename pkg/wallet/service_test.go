@@ -1,14 +1,90 @@
 package wallet
 
 import (
+	"fmt"
 	"log"
-	"os"
+	"strconv"
 	"testing"
 
 	"github.com/shFarrukh/wallet/pkg/types"
 )
 
+// testWallet builds the wallet a test starts from. The wallet runs on a
+// test clock, and every step fails the test on error.
+type testWallet struct {
+	*Service
+	t     *testing.T
+	clock *testClock
+}
+
+func newTestWallet(t *testing.T) *testWallet {
+	clock := newTestClock()
+	svc := &Service{}
+	svc.SetClock(clock.Now)
+	return &testWallet{Service: svc, t: t, clock: clock}
+}
+
+func (w *testWallet) check(err error) {
+	w.t.Helper()
+	if err != nil {
+		w.t.Fatal(err)
+	}
+}
 
+// account registers an account with the phone and deposits balance on it.
+func (w *testWallet) account(phone types.Phone, balance types.Money) *types.Account {
+	w.t.Helper()
+	return w.accountIn(phone, DefaultCurrency, balance)
+}
+
+// accountIn registers an account in the currency and deposits balance on
+// it.
+func (w *testWallet) accountIn(phone types.Phone, currency types.Currency, balance types.Money) *types.Account {
+	w.t.Helper()
+	account, err := w.RegisterAccountIn(phone, currency)
+	w.check(err)
+	if balance > 0 {
+		w.check(w.DepositAmount(account.ID, types.Amount{Value: balance, Currency: currency}))
+		account.Balance = balance
+	}
+	return account
+}
+
+func (w *testWallet) pay(accountID int64, amount types.Money, category types.PaymentCategory) *types.Payment {
+	w.t.Helper()
+	payment, err := w.Pay(accountID, amount, category)
+	w.check(err)
+	return payment
+}
+
+func (w *testWallet) transfer(fromAccountID int64, toAccountID int64, amount types.Money) *types.Payment {
+	w.t.Helper()
+	payment, err := w.Transfer(fromAccountID, toAccountID, amount)
+	w.check(err)
+	return payment
+}
+
+func (w *testWallet) favorite(paymentID string, name string) *types.Favorite {
+	w.t.Helper()
+	favorite, err := w.FavoritePayment(paymentID, name)
+	w.check(err)
+	return favorite
+}
+
+// storePayments stores the payments of amount 1 to count of account 1
+// directly in the repository.
+func (w *testWallet) storePayments(count int) {
+	w.t.Helper()
+	w.check(w.repository().Update(func(tx Tx) error {
+		for i := 1; i <= count; i++ {
+			err := tx.SavePayment(types.Payment{ID: strconv.Itoa(i), AccountID: 1, Amount: types.Money(i), Status: types.PaymentStatusOk})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
 
 func TestService_FindAccoundById_Method_NotFound(t *testing.T) {
 	svc := Service{}
@@ -133,7 +209,7 @@ func TestService_ExportImport_success_user(t *testing.T) {
 	svc.RegisterAccount("+992000000003")
 	svc.RegisterAccount("+992000000004")
 
-	wd,_:= os.Getwd()
+	wd := t.TempDir()
 	err := svc.Export(wd)
 	if err != nil {
 		t.Errorf("method Export returned not nil error, err => %v", err)
@@ -144,6 +220,55 @@ func TestService_ExportImport_success_user(t *testing.T) {
 	}
 }
 
+func TestService_Import_indexesRecords(t *testing.T) {
+	var svc Service
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := svc.Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	favorite, err := svc.FavoritePayment(payment.ID, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = svc.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var imported Service
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := imported.FindAccountByID(account.ID); err != nil {
+		t.Errorf("imported account is not indexed, err => %v", err)
+	}
+	if _, err := imported.RegisterAccount(account.Phone); err != ErrPhoneRegistered {
+		t.Errorf("imported phone is not indexed\ngot > %v \nwant > %v", err, ErrPhoneRegistered)
+	}
+	if _, err := imported.FindPaymentByID(payment.ID); err != nil {
+		t.Errorf("imported payment is not indexed, err => %v", err)
+	}
+	history, err := imported.ExportAccountHistory(account.ID)
+	if err != nil || len(history) != 1 {
+		t.Errorf("imported payment is not indexed by account, got => %v, err => %v", history, err)
+	}
+	if _, err := imported.PayFromFavorite(favorite.ID); err != nil {
+		t.Errorf("imported favorite is not indexed, err => %v", err)
+	}
+}
+
 func TestService_ExportHistory_success_user(t *testing.T) {
 	var svc Service
 
@@ -315,15 +440,103 @@ func BenchmarkFilterPayments(b *testing.B) {
 	log.Println(len(a))
 }
 
+var benchmarkSizes = []int{1_000, 100_000, 1_000_000}
+
+// newBenchmarkService spreads payments over ten accounts.
+func newBenchmarkService(b *testing.B, payments int) *Service {
+	svc := &Service{}
+	for i := 0; i < 10; i++ {
+		account, err := svc.RegisterAccount(types.Phone(fmt.Sprintf("+99200000000%d", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = svc.Deposit(account.ID, types.Money(payments))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 0; i < payments; i++ {
+		_, err := svc.Pay(int64(i%10+1), 1, "auto")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return svc
+}
+
+func BenchmarkFilterPayments_large(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			svc := newBenchmarkService(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := svc.FilterPayments(1, 4)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFindPaymentByID_large(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			svc := newBenchmarkService(b, size)
+			payments := svc.paymentsSnapshot()
+			last := payments[len(payments)-1].ID
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := svc.FindPaymentByID(last)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExportAccountHistory_large(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			svc := newBenchmarkService(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := svc.ExportAccountHistory(10)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRegisterAccount_large(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			svc := &Service{}
+			for i := 0; i < size; i++ {
+				_, err := svc.RegisterAccount(types.Phone(fmt.Sprint(i)))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := svc.RegisterAccount("0")
+				if err != ErrPhoneRegistered {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkService_FilterPaymentsByFn(b *testing.B) {
 	svc := &Service{}
 	filter := func(payment types.Payment) bool {
-		for _, value := range svc.payments {
-			if payment.ID == value.ID {
-				return true
-			}
-		}
-		return false
+		_, err := svc.FindPaymentByID(payment.ID)
+		return err == nil
 	}
 	account, err := svc.RegisterAccount("+992000000000")
 	account1, err := svc.RegisterAccount("+992000000001")
@@ -0,0 +1,290 @@
+package wallet
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+var ErrStatementMismatch = errors.New("statement does not match the balance")
+
+// StatementKind tells what moved the money of a statement line.
+type StatementKind string
+
+const (
+	StatementDeposit     StatementKind = "deposit"
+	StatementPayment     StatementKind = "payment"
+	StatementRefund      StatementKind = "refund"
+	StatementTransferIn  StatementKind = "transfer-in"
+	StatementTransferOut StatementKind = "transfer-out"
+	// StatementReversal is a transfer the account received going back to
+	// the sender.
+	StatementReversal StatementKind = "reversal"
+	// StatementAdjustment is money moved by any other ledger account.
+	StatementAdjustment StatementKind = "adjustment"
+)
+
+// StatementLine is one change of the balance in a statement.
+type StatementLine struct {
+	Time time.Time
+	Kind StatementKind
+	// Description is the category of a payment or a refund, or the other
+	// account of a transfer.
+	Description string
+	PaymentID   string
+	// Amount is positive for money coming in and negative for money going
+	// out.
+	Amount types.Money
+	// Balance is the balance after the line.
+	Balance types.Money
+}
+
+// Statement lists the changes of the balance of an account in a month,
+// from the opening balance at its beginning to the closing balance at its
+// end.
+type Statement struct {
+	AccountID int64
+	Phone     types.Phone
+	Currency  types.Currency
+	// From is the beginning of the month and To the beginning of the next
+	// one.
+	From           time.Time
+	To             time.Time
+	OpeningBalance types.Money
+	Lines          []StatementLine
+	ClosingBalance types.Money
+
+	// Totals of the lines by kind; the money going out is positive too.
+	Deposits     types.Money
+	Payments     types.Money
+	Refunds      types.Money
+	TransfersIn  types.Money
+	TransfersOut types.Money
+	Reversals    types.Money
+}
+
+// LastDay returns the last day of the month of the statement.
+func (st *Statement) LastDay() time.Time {
+	return st.To.AddDate(0, 0, -1)
+}
+
+// MonthlyStatement returns the statement of the account for the month of
+// the year, with the month beginning and ending in location; nil means
+// UTC. The statement is built from the ledger entries of the account in
+// time order, read under the lock of the account; they have to add up to
+// its current Balance: otherwise the statement is returned with
+// ErrStatementMismatch.
+func (s *Service) MonthlyStatement(accountID int64, year int, month time.Month, location *time.Location) (*Statement, error) {
+	if location == nil {
+		location = time.UTC
+	}
+	unlock, err := s.lockAccounts(accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	account, err := s.repository().FindAccount(accountID)
+	if err != nil {
+		return nil, err
+	}
+	ledger := AccountLedger(accountID)
+	entries, err := s.repository().LedgerEntries(ledger)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	counterparts := make(map[string]types.LedgerAccount)
+	for _, entry := range entries {
+		transaction, err := s.repository().TransactionEntries(entry.TransactionID)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range transaction {
+			if other.Account != ledger {
+				counterparts[entry.TransactionID] = other.Account
+			}
+		}
+	}
+
+	from := time.Date(year, month, 1, 0, 0, 0, 0, location)
+	st := &Statement{
+		AccountID: account.ID,
+		Phone:     account.Phone,
+		Currency:  currencyOf(account),
+		From:      from,
+		To:        from.AddDate(0, 1, 0),
+	}
+	balance := types.Money(0)
+	for _, entry := range entries {
+		amount := entry.Amount
+		if entry.Side == types.EntrySideDebit {
+			amount = -amount
+		}
+		balance += amount
+
+		switch {
+		case entry.CreatedAt.Before(st.From):
+			st.OpeningBalance += amount
+			continue
+		case !entry.CreatedAt.Before(st.To):
+			continue
+		}
+
+		line, err := s.statementLine(entry, amount, counterparts[entry.TransactionID], accountID)
+		if err != nil {
+			return nil, err
+		}
+		line.Time = entry.CreatedAt.In(location)
+		st.add(line)
+	}
+	st.ClosingBalance = st.OpeningBalance
+	if len(st.Lines) > 0 {
+		st.ClosingBalance = st.Lines[len(st.Lines)-1].Balance
+	}
+
+	if balance != account.Balance {
+		return st, fmt.Errorf("%w: ledger of account %d adds up to %d, balance is %d", ErrStatementMismatch, accountID, balance, account.Balance)
+	}
+	return st, nil
+}
+
+// statementLine tells what moved amount to or from the account by the
+// other account of the transaction.
+func (s *Service) statementLine(entry types.Entry, amount types.Money, counterpart types.LedgerAccount, accountID int64) (StatementLine, error) {
+	line := StatementLine{PaymentID: entry.PaymentID, Amount: amount}
+	name := string(counterpart)
+	if at := strings.Index(name, "@"); at >= 0 {
+		name = name[:at]
+	}
+
+	var payment *types.Payment
+	if entry.PaymentID != "" {
+		var err error
+		payment, err = s.repository().FindPayment(entry.PaymentID)
+		if err != nil && err != ErrPaymentNotFound {
+			return StatementLine{}, err
+		}
+		if payment != nil {
+			line.Description = string(payment.Category)
+		}
+	}
+
+	otherID, _, isAccount := parseAccountLedger(counterpart)
+	switch {
+	case name == string(LedgerCashIn):
+		line.Kind = StatementDeposit
+	case strings.HasPrefix(name, "merchant:"):
+		line.Kind = StatementPayment
+		line.Description = strings.TrimPrefix(name, "merchant:")
+	case name == string(LedgerRefunds):
+		line.Kind = StatementRefund
+	case isAccount && amount > 0 && payment != nil && payment.AccountID == accountID:
+		// the transfer the account made came back
+		line.Kind = StatementRefund
+	case isAccount && amount < 0 && payment != nil && payment.AccountID != accountID:
+		// the transfer the account received went back
+		line.Kind = StatementReversal
+		line.Description = "account " + strconv.FormatInt(otherID, 10)
+	case isAccount:
+		line.Kind = StatementTransferIn
+		if amount < 0 {
+			line.Kind = StatementTransferOut
+		}
+		line.Description = "account " + strconv.FormatInt(otherID, 10)
+	default:
+		line.Kind = StatementAdjustment
+		line.Description = string(counterpart)
+	}
+	return line, nil
+}
+
+// add appends the line with the balance after it and counts it in the
+// totals.
+func (st *Statement) add(line StatementLine) {
+	line.Balance = st.OpeningBalance + line.Amount
+	if len(st.Lines) > 0 {
+		line.Balance = st.Lines[len(st.Lines)-1].Balance + line.Amount
+	}
+	st.Lines = append(st.Lines, line)
+
+	switch line.Kind {
+	case StatementDeposit:
+		st.Deposits += line.Amount
+	case StatementPayment:
+		st.Payments -= line.Amount
+	case StatementRefund:
+		st.Refunds += line.Amount
+	case StatementTransferIn:
+		st.TransfersIn += line.Amount
+	case StatementTransferOut:
+		st.TransfersOut -= line.Amount
+	case StatementReversal:
+		st.Reversals -= line.Amount
+	}
+}
+
+var (
+	//go:embed templates/statement.txt.tmpl
+	statementText string
+	//go:embed templates/statement.html.tmpl
+	statementHTML string
+
+	statementTextTemplate = template.Must(template.New("statement.txt").Parse(statementText))
+	statementHTMLTemplate = htmltemplate.Must(htmltemplate.New("statement.html").Parse(statementHTML))
+)
+
+// WriteText writes the statement as a plain text table.
+func (st *Statement) WriteText(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	err := statementTextTemplate.Execute(table, st)
+	if err != nil {
+		return err
+	}
+	return table.Flush()
+}
+
+// WriteHTML writes the statement as an HTML page.
+func (st *Statement) WriteHTML(w io.Writer) error {
+	return statementHTMLTemplate.Execute(w, st)
+}
+
+// WriteCSV writes the statement as CSV: a row per line between the rows of
+// the opening and the closing balance.
+func (st *Statement) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	rows := [][]string{
+		{"time", "kind", "description", "paymentId", "amount", "balance"},
+		{encodeTime(st.From), "opening", "", "", "", strconv.FormatInt(int64(st.OpeningBalance), 10)},
+	}
+	for _, line := range st.Lines {
+		rows = append(rows, []string{
+			encodeTime(line.Time),
+			string(line.Kind),
+			line.Description,
+			line.PaymentID,
+			strconv.FormatInt(int64(line.Amount), 10),
+			strconv.FormatInt(int64(line.Balance), 10),
+		})
+	}
+	rows = append(rows, []string{encodeTime(st.To), "closing", "", "", "", strconv.FormatInt(int64(st.ClosingBalance), 10)})
+
+	err := writer.WriteAll(rows)
+	if err != nil {
+		return err
+	}
+	return writer.Error()
+}
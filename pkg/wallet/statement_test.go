@@ -0,0 +1,253 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// newStatementService returns a wallet whose account 1 has a payment in
+// January 2020; a deposit, a rejected payment and a transfer each way in
+// February; and a payment in March.
+func newStatementService(t *testing.T) *Service {
+	w := newTestWallet(t)
+	at := func(month time.Month, day int) {
+		w.clock.Set(time.Date(2020, month, day, 12, 0, 0, 0, time.UTC))
+	}
+
+	w.account("+992000000001", 0)
+	w.account("+992000000002", 0)
+	at(time.January, 10)
+	w.check(w.Deposit(1, 1000))
+	w.check(w.Deposit(2, 1000))
+	at(time.January, 15)
+	w.pay(1, 100, "auto")
+
+	at(time.February, 1)
+	w.check(w.Deposit(1, 500))
+	at(time.February, 3)
+	payment := w.pay(1, 200, "<food>")
+	at(time.February, 5)
+	w.check(w.Reject(payment.ID))
+	at(time.February, 7)
+	w.transfer(1, 2, 300)
+	at(time.February, 9)
+	w.transfer(2, 1, 50)
+
+	at(time.March, 2)
+	w.pay(1, 10, "auto")
+	return w.Service
+}
+
+func TestService_MonthlyStatement(t *testing.T) {
+	svc := newStatementService(t)
+	st, err := svc.MonthlyStatement(1, 2020, time.February, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type line struct {
+		Kind        StatementKind
+		Description string
+		Amount      types.Money
+		Balance     types.Money
+	}
+	got := []line{}
+	for _, l := range st.Lines {
+		got = append(got, line{l.Kind, l.Description, l.Amount, l.Balance})
+	}
+	want := []line{
+		{StatementDeposit, "", 500, 1400},
+		{StatementPayment, "<food>", -200, 1200},
+		{StatementRefund, "<food>", 200, 1400},
+		{StatementTransferOut, "account 2", -300, 1100},
+		{StatementTransferIn, "account 2", 50, 1150},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot > %v \nwant > %v", got, want)
+	}
+	if st.OpeningBalance != 900 || st.ClosingBalance != 1150 {
+		t.Errorf("opening => %v closing => %v", st.OpeningBalance, st.ClosingBalance)
+	}
+	if st.Deposits != 500 || st.Payments != 200 || st.Refunds != 200 || st.TransfersIn != 50 || st.TransfersOut != 300 {
+		t.Errorf("wrong totals => %+v", st)
+	}
+
+	march, err := svc.MonthlyStatement(1, 2020, time.March, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := svc.FindAccountByID(1)
+	if err != nil || march.ClosingBalance != account.Balance {
+		t.Errorf("closing balance => %v, account => %v, err => %v", march.ClosingBalance, account, err)
+	}
+
+	empty, err := svc.MonthlyStatement(1, 2019, time.December, nil)
+	if err != nil || len(empty.Lines) != 0 || empty.OpeningBalance != 0 || empty.ClosingBalance != 0 {
+		t.Errorf("got => %+v, err => %v", empty, err)
+	}
+}
+
+func TestService_MonthlyStatement_location(t *testing.T) {
+	svc := newStatementService(t)
+	// in UTC+5 February begins at 2020-01-31 19:00 UTC
+	location := time.FixedZone("UTC+5", 5*60*60)
+	st, err := svc.MonthlyStatement(1, 2020, time.February, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Lines) != 5 || st.Lines[0].Time.Location() != location || !st.From.Equal(time.Date(2020, time.January, 31, 19, 0, 0, 0, time.UTC)) {
+		t.Errorf("got => %+v", st)
+	}
+}
+
+func TestService_MonthlyStatement_reversal(t *testing.T) {
+	svc := newStatementService(t)
+	payments, err := svc.ExportAccountHistory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payment := range payments {
+		if payment.Category == types.PaymentCategoryTransferOut {
+			err = svc.Cancel(payment.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sender, err := svc.MonthlyStatement(1, 2020, time.March, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := sender.Lines[len(sender.Lines)-1]
+	if last.Kind != StatementRefund || last.Amount != 300 || sender.Refunds != 300 {
+		t.Errorf("\ngot > %+v \nwant > refund of 300", last)
+	}
+
+	receiver, err := svc.MonthlyStatement(2, 2020, time.March, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StatementLine{{
+		Time:        time.Date(2020, time.March, 2, 12, 0, 0, 0, time.UTC),
+		Kind:        StatementReversal,
+		Description: "account 1",
+		PaymentID:   last.PaymentID,
+		Amount:      -300,
+		Balance:     950,
+	}}
+	if !reflect.DeepEqual(receiver.Lines, want) {
+		t.Errorf("\ngot > %+v \nwant > %+v", receiver.Lines, want)
+	}
+	if receiver.Reversals != 300 || receiver.TransfersOut != 0 {
+		t.Errorf("\ngot > %+v \nwant > reversals of 300", receiver)
+	}
+}
+
+func TestService_MonthlyStatement_entriesInTimeOrder(t *testing.T) {
+	svc := newStatementService(t)
+	// an entry stored after the others with an earlier time, as a merge
+	// stores the entries of another wallet
+	err := svc.repository().Update(func(tx Tx) error {
+		account, err := tx.FindAccount(1)
+		if err != nil {
+			return err
+		}
+		account.Balance += 25
+		err = tx.SaveAccount(*account)
+		if err != nil {
+			return err
+		}
+		return postLedger(tx, LedgerCashIn, AccountLedger(1), 25, "", time.Date(2020, time.February, 2, 12, 0, 0, 0, time.UTC))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := svc.MonthlyStatement(1, 2020, time.February, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balances := []types.Money{}
+	for _, line := range st.Lines {
+		balances = append(balances, line.Balance)
+	}
+	want := []types.Money{1400, 1425, 1225, 1425, 1125, 1175}
+	if !reflect.DeepEqual(balances, want) {
+		t.Errorf("\ngot > %v \nwant > %v", balances, want)
+	}
+}
+
+func TestService_MonthlyStatement_mismatch(t *testing.T) {
+	svc := newStatementService(t)
+	err := svc.repository().Update(func(tx Tx) error {
+		account, err := tx.FindAccount(1)
+		if err != nil {
+			return err
+		}
+		account.Balance += 5
+		return tx.SaveAccount(*account)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = svc.MonthlyStatement(1, 2020, time.February, nil)
+	if !errors.Is(err, ErrStatementMismatch) {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrStatementMismatch)
+	}
+	_, err = svc.MonthlyStatement(9, 2020, time.February, nil)
+	if err != ErrAccountNotFound {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrAccountNotFound)
+	}
+}
+
+func TestStatement_render(t *testing.T) {
+	svc := newStatementService(t)
+	st, err := svc.MonthlyStatement(1, 2020, time.February, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	err = st.WriteText(&text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Statement of account 1 (+992000000001), February 2020\n",
+		"2020-02-01        opening balance                       900\n",
+		"2020-02-07 12:00  transfer-out     account 2    -300    1100\n",
+		"2020-02-29        closing balance                       1150\n",
+		"Transfers out  300\n",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text has no %q:\n%s", want, text.String())
+		}
+	}
+
+	var csv bytes.Buffer
+	err = st.WriteCSV(&csv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSuffix(csv.String(), "\n"), "\n")
+	if len(rows) != 8 || rows[1] != "2020-02-01T00:00:00Z,opening,,,,900" || rows[7] != "2020-03-01T00:00:00Z,closing,,,,1150" {
+		t.Errorf("wrong CSV:\n%s", csv.String())
+	}
+
+	var html bytes.Buffer
+	err = st.WriteHTML(&html)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html.String(), "<td>&lt;food&gt;</td>") || !strings.Contains(html.String(), `<tr class="closing">`) {
+		t.Errorf("wrong HTML:\n%s", html.String())
+	}
+}
@@ -0,0 +1,181 @@
+package wallet
+
+import (
+	"github.com/google/uuid"
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// Transfer moves amount from one account to another. It creates two linked
+// payments, an outgoing one in the history of the sender and an incoming one
+// in the history of the receiver, and returns the outgoing payment.
+func (s *Service) Transfer(fromAccountID int64, toAccountID int64, amount types.Money) (*types.Payment, error) {
+	return s.transfer(fromAccountID, toAccountID, amount, nil)
+}
+
+// transfer makes the transfer and, unless record is nil, saves the
+// idempotency record in the same transaction.
+func (s *Service) transfer(fromAccountID int64, toAccountID int64, amount types.Money, record *types.IdempotencyRecord) (*types.Payment, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+	if fromAccountID == toAccountID {
+		return nil, ErrSameAccount
+	}
+
+	unlock, err := s.lockAccounts(fromAccountID, toAccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	from, err := s.repository().FindAccount(fromAccountID)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.repository().FindAccount(toAccountID)
+	if err != nil {
+		return nil, err
+	}
+	if currencyOf(from) != currencyOf(to) {
+		return nil, ErrCurrencyMismatch
+	}
+	if from.Balance < amount {
+		return nil, ErrNotEnoughBalance
+	}
+
+	from.Balance -= amount
+	to.Balance += amount
+	now := s.now()
+	outgoing := &types.Payment{
+		ID:        uuid.New().String(),
+		AccountID: fromAccountID,
+		Amount:    amount,
+		Category:  types.PaymentCategoryTransferOut,
+		Status:    types.PaymentStatusInProgress,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	incoming := &types.Payment{
+		ID:              uuid.New().String(),
+		AccountID:       toAccountID,
+		Amount:          amount,
+		Category:        types.PaymentCategoryTransferIn,
+		Status:          types.PaymentStatusInProgress,
+		LinkedPaymentID: outgoing.ID,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	outgoing.LinkedPaymentID = incoming.ID
+
+	err = s.repository().Update(func(tx Tx) error {
+		if err := tx.SaveAccount(*from); err != nil {
+			return err
+		}
+		if err := tx.SaveAccount(*to); err != nil {
+			return err
+		}
+		if err := tx.SavePayment(*outgoing); err != nil {
+			return err
+		}
+		if err := tx.SavePayment(*incoming); err != nil {
+			return err
+		}
+		if err := saveIdempotencyRecord(tx, record, outgoing.ID); err != nil {
+			return err
+		}
+		return postLedger(tx, AccountLedger(fromAccountID), AccountLedger(toAccountID), amount, outgoing.ID, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return outgoing, nil
+}
+
+// transferPayments returns the outgoing and the incoming payment of the
+// transfer that payment belongs to.
+func (s *Service) transferPayments(payment *types.Payment) (outgoing *types.Payment, incoming *types.Payment, err error) {
+	linked, err := s.repository().FindPayment(payment.LinkedPaymentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if payment.Category == types.PaymentCategoryTransferIn {
+		return linked, payment, nil
+	}
+	return payment, linked, nil
+}
+
+// changeTransferStatus moves both payments of a transfer to the status. A
+// refunding status moves the money back to the sender.
+func (s *Service) changeTransferStatus(payment *types.Payment, status types.PaymentStatus) error {
+	outgoing, incoming, err := s.transferPayments(payment)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lockAccounts(outgoing.AccountID, incoming.AccountID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// read the payments again, another call may have changed them meanwhile
+	outgoing, incoming, err = s.transferPayments(outgoing)
+	if err != nil {
+		return err
+	}
+	if !canTransition(outgoing.Status, status) {
+		return &TransitionError{PaymentID: payment.ID, From: outgoing.Status, To: status}
+	}
+
+	from, err := s.repository().FindAccount(outgoing.AccountID)
+	if err != nil {
+		return err
+	}
+	to, err := s.repository().FindAccount(incoming.AccountID)
+	if err != nil {
+		return err
+	}
+	if refunds(status) {
+		if to.Balance < incoming.Amount {
+			return ErrNotEnoughBalance
+		}
+		from.Balance += outgoing.Amount
+		to.Balance -= incoming.Amount
+	}
+
+	now := s.now()
+	setStatus(outgoing, status, now)
+	setStatus(incoming, status, now)
+	return s.repository().Update(func(tx Tx) error {
+		if err := tx.SavePayment(*outgoing); err != nil {
+			return err
+		}
+		if err := tx.SavePayment(*incoming); err != nil {
+			return err
+		}
+		if !refunds(status) {
+			return nil
+		}
+		if err := tx.SaveAccount(*from); err != nil {
+			return err
+		}
+		if err := tx.SaveAccount(*to); err != nil {
+			return err
+		}
+		return postLedger(tx, AccountLedger(to.ID), AccountLedger(from.ID), outgoing.Amount, outgoing.ID, now)
+	})
+}
+
+// repeatTransfer makes the transfer that payment belongs to once more. Only
+// the sender repeats a transfer: repeating the incoming payment fails with
+// ErrRepeatIncoming, as it would take the money from the other account.
+func (s *Service) repeatTransfer(payment *types.Payment, record *types.IdempotencyRecord) (*types.Payment, error) {
+	if payment.Category == types.PaymentCategoryTransferIn {
+		return nil, ErrRepeatIncoming
+	}
+	outgoing, incoming, err := s.transferPayments(payment)
+	if err != nil {
+		return nil, err
+	}
+	return s.transfer(outgoing.AccountID, incoming.AccountID, outgoing.Amount, record)
+}
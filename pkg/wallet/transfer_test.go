@@ -0,0 +1,207 @@
+package wallet
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+func checkBalance(t *testing.T, svc *Service, accountID int64, want types.Money) {
+	t.Helper()
+	account, err := svc.FindAccountByID(accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != want {
+		t.Errorf("wrong balance of account %v\ngot > %v \nwant > %v", accountID, account.Balance, want)
+	}
+}
+
+func TestService_Transfer_success(t *testing.T) {
+	w := newTestWallet(t)
+	from, to := w.account("+992000000001", 100), w.account("+992000000002", 0)
+	svc := w.Service
+
+	outgoing, err := svc.Transfer(from.ID, to.ID, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, svc, from.ID, 60)
+	checkBalance(t, svc, to.ID, 40)
+
+	fromHistory, err := svc.ExportAccountHistory(from.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toHistory, err := svc.ExportAccountHistory(to.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fromHistory) != 1 || fromHistory[0].ID != outgoing.ID || fromHistory[0].Category != types.PaymentCategoryTransferOut {
+		t.Fatalf("wrong history of the sender => %v", fromHistory)
+	}
+	if len(toHistory) != 1 || toHistory[0].Category != types.PaymentCategoryTransferIn {
+		t.Fatalf("wrong history of the receiver => %v", toHistory)
+	}
+	if fromHistory[0].LinkedPaymentID != toHistory[0].ID || toHistory[0].LinkedPaymentID != fromHistory[0].ID {
+		t.Errorf("payments are not linked, outgoing => %v incoming => %v", fromHistory[0], toHistory[0])
+	}
+
+	discrepancies, err := svc.Reconcile()
+	if err != nil || len(discrepancies) != 0 {
+		t.Errorf("unexpected discrepancies => %v, err => %v", discrepancies, err)
+	}
+}
+
+func TestService_Transfer_notEnoughBalance(t *testing.T) {
+	w := newTestWallet(t)
+	from, to := w.account("+992000000001", 100), w.account("+992000000002", 0)
+	svc := w.Service
+
+	_, err := svc.Transfer(from.ID, to.ID, 101)
+	if err != ErrNotEnoughBalance {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrNotEnoughBalance)
+	}
+	checkBalance(t, svc, from.ID, 100)
+	checkBalance(t, svc, to.ID, 0)
+
+	if _, err := svc.ExportAccountHistory(to.ID); err != ErrAccountNotFound {
+		t.Errorf("failed transfer left a payment, err => %v", err)
+	}
+}
+
+func TestService_Transfer_invalid(t *testing.T) {
+	w := newTestWallet(t)
+	from := w.account("+992000000001", 100)
+	w.account("+992000000002", 0)
+	svc := w.Service
+
+	if _, err := svc.Transfer(from.ID, from.ID, 10); err != ErrSameAccount {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrSameAccount)
+	}
+	if _, err := svc.Transfer(from.ID, 42, 10); err != ErrAccountNotFound {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrAccountNotFound)
+	}
+	if _, err := svc.Transfer(from.ID, 2, 0); err != ErrAmountMustBePositive {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrAmountMustBePositive)
+	}
+}
+
+func TestService_Transfer_reject(t *testing.T) {
+	w := newTestWallet(t)
+	from, to := w.account("+992000000001", 100), w.account("+992000000002", 0)
+	svc := w.Service
+
+	outgoing, err := svc.Transfer(from.ID, to.ID, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rejecting through the incoming payment reverses the whole transfer
+	err = svc.Reject(outgoing.LinkedPaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, svc, from.ID, 100)
+	checkBalance(t, svc, to.ID, 0)
+
+	for _, id := range []string{outgoing.ID, outgoing.LinkedPaymentID} {
+		payment, err := svc.FindPaymentByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payment.Status != types.PaymentStatusFail {
+			t.Errorf("wrong status of %v\ngot > %v \nwant > %v", id, payment.Status, types.PaymentStatusFail)
+		}
+	}
+
+	discrepancies, err := svc.Reconcile()
+	if err != nil || len(discrepancies) != 0 {
+		t.Errorf("unexpected discrepancies => %v, err => %v", discrepancies, err)
+	}
+}
+
+func TestService_Transfer_rejectSpentMoney(t *testing.T) {
+	w := newTestWallet(t)
+	from, to := w.account("+992000000001", 100), w.account("+992000000002", 0)
+	svc := w.Service
+
+	outgoing, err := svc.Transfer(from.ID, to.ID, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Pay(to.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.Reject(outgoing.ID)
+	if err != ErrNotEnoughBalance {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrNotEnoughBalance)
+	}
+	checkBalance(t, svc, from.ID, 60)
+	checkBalance(t, svc, to.ID, 10)
+}
+
+func TestService_Transfer_repeat(t *testing.T) {
+	w := newTestWallet(t)
+	from, to := w.account("+992000000001", 100), w.account("+992000000002", 0)
+	svc := w.Service
+
+	outgoing, err := svc.Transfer(from.ID, to.ID, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Repeat(outgoing.LinkedPaymentID)
+	if err != ErrRepeatIncoming {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrRepeatIncoming)
+	}
+	checkBalance(t, svc, from.ID, 60)
+
+	repeated, err := svc.Repeat(outgoing.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repeated.AccountID != from.ID || repeated.Category != types.PaymentCategoryTransferOut {
+		t.Errorf("repeat made a wrong payment => %v", repeated)
+	}
+	checkBalance(t, svc, from.ID, 20)
+	checkBalance(t, svc, to.ID, 80)
+}
+
+func TestService_Transfer_concurrentOppositeDirections(t *testing.T) {
+	w := newTestWallet(t)
+	first, second := w.account("+992000000001", 100), w.account("+992000000002", 100)
+	svc := w.Service
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := svc.Transfer(first.ID, second.ID, 1); err != nil && err != ErrNotEnoughBalance {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := svc.Transfer(second.ID, first.ID, 1); err != nil && err != ErrNotEnoughBalance {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	a, err := svc.FindAccountByID(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := svc.FindAccountByID(second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Balance+b.Balance != 200 {
+		t.Errorf("money is lost\ngot > %v \nwant > %v", a.Balance+b.Balance, 200)
+	}
+}
@@ -0,0 +1,406 @@
+package wallet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+var ErrCorruptedLog = errors.New("write-ahead log is corrupted")
+
+const walFileName = "wallet.wal"
+
+// walHeaderSize is the size of the record header: the payload length, the
+// CRC-32 of the payload and the CRC-32 of the first two, all big endian
+// uint32. The checksum of the header tells a record whose length was
+// damaged from one cut short by a crash.
+const walHeaderSize = 12
+
+// WALRepository keeps the wallet in memory and appends every committed
+// transaction to a write-ahead log, fsyncing it before the transaction is
+// applied. The log is replayed on top of the current snapshot, which is
+// laid out as the snapshots of Export. Every snapshot holds the log of the
+// transactions committed after it; before the first snapshot the log is
+// kept in the directory itself.
+//
+// The log fields are guarded by the lock of the memory repository.
+type WALRepository struct {
+	*MemoryRepository
+	dir           string
+	snapshotEvery int
+
+	log     *os.File
+	size    int64
+	records int
+}
+
+// walChange is one change of a logged transaction.
+type walChange struct {
+	Op         string                   `json:"op"`
+	Account    *types.Account           `json:"account,omitempty"`
+	Payment    *types.Payment           `json:"payment,omitempty"`
+	Favorite   *types.Favorite          `json:"favorite,omitempty"`
+	Entry      *types.Entry             `json:"entry,omitempty"`
+	Record     *types.IdempotencyRecord `json:"record,omitempty"`
+	AccountID  int64                    `json:"accountId,omitempty"`
+	PaymentID  string                   `json:"paymentId,omitempty"`
+	FavoriteID string                   `json:"favoriteId,omitempty"`
+	EntryID    string                   `json:"entryId,omitempty"`
+	Key        string                   `json:"key,omitempty"`
+}
+
+const (
+	walSaveAccount    = "saveAccount"
+	walDeleteAccount  = "deleteAccount"
+	walSavePayment    = "savePayment"
+	walDeletePayment  = "deletePayment"
+	walSaveFavorite   = "saveFavorite"
+	walDeleteFavorite = "deleteFavorite"
+	walSaveEntry      = "saveEntry"
+	walDeleteEntry    = "deleteEntry"
+
+	walSaveIdempotencyRecord   = "saveIdempotencyRecord"
+	walDeleteIdempotencyRecord = "deleteIdempotencyRecord"
+)
+
+// OpenService opens the wallet stored in dir with a WALRepository. A
+// snapshot is taken after every snapshotEvery logged transactions; zero
+// disables periodic snapshots.
+func OpenService(dir string, snapshotEvery int) (*Service, error) {
+	repo, err := OpenWALRepository(dir, snapshotEvery)
+	if err != nil {
+		return nil, err
+	}
+	return NewService(repo), nil
+}
+
+// OpenWALRepository loads the current snapshot of dir and replays its log.
+// A torn last record, left by a crash in the middle of an append, is
+// dropped; a damaged record anywhere else fails with ErrCorruptedLog.
+func OpenWALRepository(dir string, snapshotEvery int) (*WALRepository, error) {
+	r := &WALRepository{
+		MemoryRepository: NewMemoryRepository(),
+		dir:              dir,
+		snapshotEvery:    snapshotEvery,
+	}
+
+	snapshot, err := snapshotDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readDumps(os.DirFS(snapshot), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = r.MemoryRepository.restore(data)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(snapshot, walFileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r.log = file
+	err = r.replay()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close releases the storage of the service if it holds any, such as the log
+// file of a WALRepository.
+func (s *Service) Close() error {
+	if closer, ok := s.repository().(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (r *WALRepository) Update(fn func(tx Tx) error) error {
+	var changes []walChange
+	return r.MemoryRepository.update(func(tx Tx) error {
+		recorder := &walTx{Tx: tx}
+		err := fn(recorder)
+		changes = recorder.changes
+		return err
+	}, func(tx *memoryTx) error {
+		return r.commit(changes)
+	})
+}
+
+// Snapshot writes the current state as a new snapshot with an empty log.
+func (r *WALRepository) Snapshot() error {
+	r.MemoryRepository.mu.Lock()
+	defer r.MemoryRepository.mu.Unlock()
+	return r.snapshot()
+}
+
+// Close closes the log file.
+func (r *WALRepository) Close() error {
+	r.MemoryRepository.mu.Lock()
+	defer r.MemoryRepository.mu.Unlock()
+	return r.log.Close()
+}
+
+// commit is called with the lock of the memory repository held.
+func (r *WALRepository) commit(changes []walChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(record[8:12], crc32.ChecksumIEEE(record[0:8]))
+	copy(record[walHeaderSize:], payload)
+
+	_, err = r.log.Write(record)
+	if err == nil {
+		err = r.log.Sync()
+	}
+	if err != nil {
+		// cut off what was written, so that the next record does not
+		// follow a broken one
+		r.truncate(r.size)
+		return err
+	}
+
+	r.size += int64(len(record))
+	r.records++
+	if r.snapshotEvery > 0 && r.records >= r.snapshotEvery {
+		// the transaction is already durable, a failed snapshot only means
+		// a longer replay
+		r.snapshot()
+	}
+	return nil
+}
+
+// snapshot is called with the lock of the memory repository held. The log
+// of the new snapshot is created and opened before the snapshot becomes
+// current, so that switching to it moves the dump files and the log at
+// once: a crash leaves either the old snapshot with its full log or the new
+// one with an empty log, and no record is ever replayed over a snapshot
+// that already holds it.
+func (r *WALRepository) snapshot() error {
+	data := r.MemoryRepository.data()
+	var log *os.File
+	_, err := createSnapshot(r.dir, func(tmp string) error {
+		err := writeSnapshot(dirSink{dir: tmp, sync: true}, data)
+		if err != nil {
+			return err
+		}
+		log, err = os.OpenFile(filepath.Join(tmp, walFileName), os.O_CREATE|os.O_RDWR, 0600)
+		return err
+	})
+	if err != nil {
+		if log != nil {
+			log.Close()
+		}
+		return err
+	}
+
+	r.log.Close()
+	r.log = log
+	r.size = 0
+	r.records = 0
+	// the log kept before the first snapshot is not read any more
+	os.Remove(filepath.Join(r.dir, walFileName))
+	return nil
+}
+
+// truncate cuts the log to size and moves the write position to its end.
+func (r *WALRepository) truncate(size int64) error {
+	err := r.log.Truncate(size)
+	if err != nil {
+		return err
+	}
+	_, err = r.log.Seek(size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	r.size = size
+	return nil
+}
+
+func (r *WALRepository) replay() error {
+	content, err := io.ReadAll(r.log)
+	if err != nil {
+		return err
+	}
+
+	offset := 0
+	for offset < len(content) {
+		rest := content[offset:]
+		if len(rest) < walHeaderSize {
+			break
+		}
+		if crc32.ChecksumIEEE(rest[0:8]) != binary.BigEndian.Uint32(rest[8:12]) {
+			return ErrCorruptedLog
+		}
+		// with the header intact, only the last record can run past the
+		// end of the log
+		size := int(binary.BigEndian.Uint32(rest[0:4]))
+		if len(rest) < walHeaderSize+size {
+			break
+		}
+		payload := rest[walHeaderSize : walHeaderSize+size]
+		last := len(rest) == walHeaderSize+size
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(rest[4:8]) {
+			if last {
+				break
+			}
+			return ErrCorruptedLog
+		}
+
+		var changes []walChange
+		err := json.Unmarshal(payload, &changes)
+		if err != nil {
+			return ErrCorruptedLog
+		}
+		err = r.MemoryRepository.Update(func(tx Tx) error {
+			return applyWALChanges(tx, changes)
+		})
+		if err != nil {
+			return err
+		}
+
+		offset += walHeaderSize + size
+		r.records++
+	}
+
+	// drop the torn tail so that new records follow the last complete one
+	return r.truncate(int64(offset))
+}
+
+func applyWALChanges(tx Tx, changes []walChange) error {
+	for _, change := range changes {
+		var err error
+		switch change.Op {
+		case walSaveAccount:
+			err = tx.SaveAccount(*change.Account)
+		case walDeleteAccount:
+			err = tx.DeleteAccount(change.AccountID)
+		case walSavePayment:
+			err = tx.SavePayment(*change.Payment)
+		case walDeletePayment:
+			err = tx.DeletePayment(change.PaymentID)
+		case walSaveFavorite:
+			err = tx.SaveFavorite(*change.Favorite)
+		case walDeleteFavorite:
+			err = tx.DeleteFavorite(change.FavoriteID)
+		case walSaveEntry:
+			err = tx.SaveEntry(*change.Entry)
+		case walDeleteEntry:
+			err = tx.DeleteEntry(change.EntryID)
+		case walSaveIdempotencyRecord:
+			err = tx.SaveIdempotencyRecord(*change.Record)
+		case walDeleteIdempotencyRecord:
+			err = tx.DeleteIdempotencyRecord(change.Key)
+		default:
+			return ErrCorruptedLog
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walTx records the changes made through the wrapped Tx.
+type walTx struct {
+	Tx
+	changes []walChange
+}
+
+func (tx *walTx) SaveAccount(account types.Account) error {
+	err := tx.Tx.SaveAccount(account)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walSaveAccount, Account: &account})
+	}
+	return err
+}
+
+func (tx *walTx) DeleteAccount(accountID int64) error {
+	err := tx.Tx.DeleteAccount(accountID)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walDeleteAccount, AccountID: accountID})
+	}
+	return err
+}
+
+func (tx *walTx) SavePayment(payment types.Payment) error {
+	err := tx.Tx.SavePayment(payment)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walSavePayment, Payment: &payment})
+	}
+	return err
+}
+
+func (tx *walTx) DeletePayment(paymentID string) error {
+	err := tx.Tx.DeletePayment(paymentID)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walDeletePayment, PaymentID: paymentID})
+	}
+	return err
+}
+
+func (tx *walTx) SaveFavorite(favorite types.Favorite) error {
+	err := tx.Tx.SaveFavorite(favorite)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walSaveFavorite, Favorite: &favorite})
+	}
+	return err
+}
+
+func (tx *walTx) DeleteFavorite(favoriteID string) error {
+	err := tx.Tx.DeleteFavorite(favoriteID)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walDeleteFavorite, FavoriteID: favoriteID})
+	}
+	return err
+}
+
+func (tx *walTx) SaveEntry(entry types.Entry) error {
+	err := tx.Tx.SaveEntry(entry)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walSaveEntry, Entry: &entry})
+	}
+	return err
+}
+
+func (tx *walTx) DeleteEntry(entryID string) error {
+	err := tx.Tx.DeleteEntry(entryID)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walDeleteEntry, EntryID: entryID})
+	}
+	return err
+}
+
+func (tx *walTx) SaveIdempotencyRecord(record types.IdempotencyRecord) error {
+	err := tx.Tx.SaveIdempotencyRecord(record)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walSaveIdempotencyRecord, Record: &record})
+	}
+	return err
+}
+
+func (tx *walTx) DeleteIdempotencyRecord(key string) error {
+	err := tx.Tx.DeleteIdempotencyRecord(key)
+	if err == nil {
+		tx.changes = append(tx.changes, walChange{Op: walDeleteIdempotencyRecord, Key: key})
+	}
+	return err
+}
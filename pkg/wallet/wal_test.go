@@ -0,0 +1,359 @@
+package wallet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+)
+
+// fillWAL makes every kind of logged change and returns the IDs it created.
+func fillWAL(t *testing.T, svc *Service) (accountID int64, paymentID string, favoriteID string) {
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := svc.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	favorite, err := svc.FavoritePayment(payment.ID, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.PayFromFavoriteWithKey("key-1", favorite.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account.ID, payment.ID, favorite.ID
+}
+
+func checkWALState(t *testing.T, svc *Service, accountID int64, paymentID string, favoriteID string) {
+	account, err := svc.FindAccountByID(accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 70 {
+		t.Errorf("wrong balance\ngot > %v \nwant > %v", account.Balance, 70)
+	}
+	payment, err := svc.FindPaymentByID(paymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != types.PaymentStatusFail {
+		t.Errorf("wrong status\ngot > %v \nwant > %v", payment.Status, types.PaymentStatusFail)
+	}
+	history, err := svc.ExportAccountHistory(accountID)
+	if err != nil || len(history) != 2 {
+		t.Errorf("wrong history, got => %v, err => %v", history, err)
+	}
+	if _, err := svc.repository().FindFavorite(favoriteID); err != nil {
+		t.Error(err)
+	}
+	if _, err := svc.repository().FindIdempotencyRecord(hash("key-1")); err != nil {
+		t.Error(err)
+	}
+	discrepancies, err := svc.Reconcile()
+	if err != nil || len(discrepancies) != 0 {
+		t.Errorf("ledger is not restored, discrepancies => %v, err => %v", discrepancies, err)
+	}
+}
+
+func TestOpenService_replaysLog(t *testing.T) {
+	dir := t.TempDir()
+	svc, err := OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID, paymentID, favoriteID := fillWAL(t, svc)
+	err = svc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err = OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	checkWALState(t, svc, accountID, paymentID, favoriteID)
+
+	next, err := svc.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID != accountID+1 {
+		t.Errorf("wrong next account ID\ngot > %v \nwant > %v", next.ID, accountID+1)
+	}
+}
+
+func TestOpenService_tornLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	svc, err := OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID, paymentID, favoriteID := fillWAL(t, svc)
+	err = svc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, walFileName)
+	complete, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, '[', '{'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	svc, err = OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWALState(t, svc, accountID, paymentID, favoriteID)
+
+	truncated, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated.Size() != complete.Size() {
+		t.Errorf("torn record is not dropped, got size => %v want => %v", truncated.Size(), complete.Size())
+	}
+
+	// the next record must be readable after the dropped one
+	err = svc.Deposit(accountID, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.Close()
+	svc, err = OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	account, err := svc.FindAccountByID(accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 75 {
+		t.Errorf("wrong balance\ngot > %v \nwant > %v", account.Balance, 75)
+	}
+}
+
+func TestOpenService_corruptedRecord(t *testing.T) {
+	dir := t.TempDir()
+	svc, err := OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillWAL(t, svc)
+	svc.Close()
+
+	path := filepath.Join(dir, walFileName)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[walHeaderSize+1] ^= 0xff
+	err = os.WriteFile(path, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenService(dir, 0)
+	if err != ErrCorruptedLog {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrCorruptedLog)
+	}
+}
+
+func TestOpenService_corruptedLength(t *testing.T) {
+	dir := t.TempDir()
+	svc, err := OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillWAL(t, svc)
+	svc.Close()
+
+	// a length running past the end of the log must not pass for a torn
+	// last record
+	path := filepath.Join(dir, walFileName)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0] ^= 0x01
+	err = os.WriteFile(path, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenService(dir, 0)
+	if err != ErrCorruptedLog {
+		t.Errorf("\ngot > %v \nwant > %v", err, ErrCorruptedLog)
+	}
+}
+
+func TestOpenService_snapshots(t *testing.T) {
+	dir := t.TempDir()
+	svc, err := OpenService(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID, paymentID, favoriteID := fillWAL(t, svc)
+	svc.Close()
+
+	snapshot, err := snapshotDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(snapshot, accountsDump)); err != nil {
+		t.Errorf("snapshot is not written, err => %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, walFileName)); !os.IsNotExist(err) {
+		t.Errorf("log of the directory is not removed, err => %v", err)
+	}
+	info, err := os.Stat(filepath.Join(snapshot, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 {
+		t.Error("changes after the snapshot must stay in the log")
+	}
+
+	svc, err = OpenService(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	checkWALState(t, svc, accountID, paymentID, favoriteID)
+
+	repo := svc.repository().(*WALRepository)
+	err = repo.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err = snapshotDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(filepath.Join(snapshot, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("log of a new snapshot is not empty, got size => %v", info.Size())
+	}
+
+	// the snapshot is an export
+	var imported Service
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWALState(t, &imported, accountID, paymentID, favoriteID)
+}
+
+func TestOpenService_snapshotAfterReplace(t *testing.T) {
+	dir := t.TempDir()
+	svc, err := OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := svc.repository().(*WALRepository)
+	err = repo.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := currentSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the import gives the phone of the account to another account
+	w := newTestWallet(t)
+	other := w.account("+992000000002", 50)
+	moved := w.account("+992000000001", 100)
+	if moved.ID == account.ID {
+		t.Fatalf("the phone must move to another account ID, got => %v", moved.ID)
+	}
+	sink := memorySink{}
+	w.check(w.ExportTo(sink))
+	err = svc.ImportFrom(fstest.MapFS(sink), ImportReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Pay(moved.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.Close()
+
+	check := func() {
+		t.Helper()
+		svc, err := OpenService(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer svc.Close()
+		checkBalance(t, svc, other.ID, 50)
+		checkBalance(t, svc, moved.ID, 70)
+		found, err := svc.repository().FindAccountByPhone("+992000000001")
+		if err != nil || found.ID != moved.ID {
+			t.Errorf("wrong account of the phone => %v, err => %v", found, err)
+		}
+	}
+	check()
+
+	// a crash before the new snapshot became current leaves the previous
+	// one with its full log
+	err = os.WriteFile(filepath.Join(dir, currentName), []byte(previous+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestOpenService_export(t *testing.T) {
+	w := newTestWallet(t)
+	account := w.account("+992000000001", 100)
+	payment := w.pay(account.ID, 30, "auto")
+	dir := t.TempDir()
+	w.check(w.Export(dir))
+
+	svc, err := OpenService(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	checkBalance(t, svc, account.ID, 70)
+	if _, err := svc.FindPaymentByID(payment.ID); err != nil {
+		t.Error(err)
+	}
+}
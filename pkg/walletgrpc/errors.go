@@ -0,0 +1,77 @@
+package walletgrpc
+
+import (
+	"errors"
+
+	"github.com/shFarrukh/wallet/pkg/wallet"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorDomain is the domain of the ErrorInfo details of the server's
+// errors.
+const ErrorDomain = "wallet"
+
+// walletErrors maps the errors of the wallet package to status codes and to
+// the reasons put in the ErrorInfo detail.
+var walletErrors = []struct {
+	err    error
+	code   codes.Code
+	reason string
+}{
+	{wallet.ErrAccountNotFound, codes.NotFound, "ACCOUNT_NOT_FOUND"},
+	{wallet.ErrPaymentNotFound, codes.NotFound, "PAYMENT_NOT_FOUND"},
+	{wallet.ErrFavoriteNotFound, codes.NotFound, "FAVORITE_NOT_FOUND"},
+	{wallet.ErrPhoneRegistered, codes.AlreadyExists, "PHONE_REGISTERED"},
+	{wallet.ErrIdempotencyConflict, codes.AlreadyExists, "IDEMPOTENCY_CONFLICT"},
+	{wallet.ErrIllegalTransition, codes.FailedPrecondition, "ILLEGAL_TRANSITION"},
+	{wallet.ErrNotEnoughBalance, codes.FailedPrecondition, "NOT_ENOUGH_BALANCE"},
+	{wallet.ErrCurrencyMismatch, codes.FailedPrecondition, "CURRENCY_MISMATCH"},
+	{wallet.ErrAmountMustBePositive, codes.InvalidArgument, "AMOUNT_MUST_BE_POSITIVE"},
+	{wallet.ErrUnknownCurrency, codes.InvalidArgument, "UNKNOWN_CURRENCY"},
+	{wallet.ErrSameAccount, codes.InvalidArgument, "SAME_ACCOUNT"},
+	{wallet.ErrRepeatIncoming, codes.FailedPrecondition, "REPEAT_INCOMING_TRANSFER"},
+}
+
+// toStatus converts an error of the wallet package into a status error with
+// an ErrorInfo detail. Other errors become Internal errors.
+func toStatus(err error) error {
+	for _, known := range walletErrors {
+		if !errors.Is(err, known.err) {
+			continue
+		}
+		st := status.New(known.code, err.Error())
+		detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{
+			Reason: known.reason,
+			Domain: ErrorDomain,
+		})
+		if detailErr != nil {
+			return st.Err()
+		}
+		return detailed.Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// FromError returns the error of the wallet package carried by the status
+// error err, so that clients can compare it with errors.Is. Errors without
+// a known ErrorInfo detail are returned as they are.
+func FromError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != ErrorDomain {
+			continue
+		}
+		for _, known := range walletErrors {
+			if known.reason == info.Reason {
+				return known.err
+			}
+		}
+	}
+	return err
+}
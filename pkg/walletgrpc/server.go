@@ -0,0 +1,167 @@
+// Package walletgrpc serves a wallet.Service over gRPC with the contract of
+// proto/wallet/v1/wallet.proto.
+package walletgrpc
+
+import (
+	"context"
+
+	"github.com/shFarrukh/wallet/pkg/types"
+	"github.com/shFarrukh/wallet/pkg/wallet"
+	"github.com/shFarrukh/wallet/pkg/walletpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Server implements walletpb.WalletServer on top of a wallet.Service.
+type Server struct {
+	walletpb.UnimplementedWalletServer
+	svc *wallet.Service
+}
+
+func NewServer(svc *wallet.Service) *Server {
+	return &Server{svc: svc}
+}
+
+func (s *Server) RegisterAccount(ctx context.Context, request *walletpb.RegisterAccountRequest) (*walletpb.Account, error) {
+	currency := types.Currency(request.GetCurrency())
+	if currency == "" {
+		currency = wallet.DefaultCurrency
+	}
+	account, err := s.svc.RegisterAccountIn(types.Phone(request.GetPhone()), currency)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return accountMessage(account), nil
+}
+
+func (s *Server) GetAccount(ctx context.Context, request *walletpb.GetAccountRequest) (*walletpb.Account, error) {
+	account, err := s.svc.FindAccountByID(request.GetAccountId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return accountMessage(account), nil
+}
+
+func (s *Server) Deposit(ctx context.Context, request *walletpb.DepositRequest) (*walletpb.Account, error) {
+	err := s.svc.DepositWithKey(request.GetIdempotencyKey(), request.GetAccountId(), types.Money(request.GetAmount()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return s.GetAccount(ctx, &walletpb.GetAccountRequest{AccountId: request.GetAccountId()})
+}
+
+func (s *Server) Pay(ctx context.Context, request *walletpb.PayRequest) (*walletpb.Payment, error) {
+	payment, err := s.svc.PayWithKey(
+		request.GetIdempotencyKey(),
+		request.GetAccountId(),
+		types.Money(request.GetAmount()),
+		types.PaymentCategory(request.GetCategory()),
+	)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return paymentMessage(payment), nil
+}
+
+func (s *Server) GetPayment(ctx context.Context, request *walletpb.GetPaymentRequest) (*walletpb.Payment, error) {
+	payment, err := s.svc.FindPaymentByID(request.GetPaymentId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return paymentMessage(payment), nil
+}
+
+func (s *Server) Reject(ctx context.Context, request *walletpb.RejectRequest) (*walletpb.Payment, error) {
+	err := s.svc.Reject(request.GetPaymentId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return s.GetPayment(ctx, &walletpb.GetPaymentRequest{PaymentId: request.GetPaymentId()})
+}
+
+func (s *Server) Repeat(ctx context.Context, request *walletpb.RepeatRequest) (*walletpb.Payment, error) {
+	payment, err := s.svc.RepeatWithKey(request.GetIdempotencyKey(), request.GetPaymentId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return paymentMessage(payment), nil
+}
+
+func (s *Server) FavoritePayment(ctx context.Context, request *walletpb.FavoritePaymentRequest) (*walletpb.Favorite, error) {
+	favorite, err := s.svc.FavoritePayment(request.GetPaymentId(), request.GetName())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &walletpb.Favorite{
+		Id:        favorite.ID,
+		AccountId: favorite.AccountID,
+		Name:      favorite.Name,
+		Amount:    int64(favorite.Amount),
+		Category:  string(favorite.Category),
+	}, nil
+}
+
+func (s *Server) PayFromFavorite(ctx context.Context, request *walletpb.PayFromFavoriteRequest) (*walletpb.Payment, error) {
+	payment, err := s.svc.PayFromFavoriteWithKey(request.GetIdempotencyKey(), request.GetFavoriteId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return paymentMessage(payment), nil
+}
+
+// ExportAccountHistory streams the payments of the account. An account
+// without payments has an empty history rather than a NotFound error.
+func (s *Server) ExportAccountHistory(request *walletpb.ExportAccountHistoryRequest, stream walletpb.Wallet_ExportAccountHistoryServer) error {
+	_, err := s.svc.FindAccountByID(request.GetAccountId())
+	if err != nil {
+		return toStatus(err)
+	}
+	payments, err := s.svc.ExportAccountHistory(request.GetAccountId())
+	if err != nil && err != wallet.ErrAccountNotFound {
+		return toStatus(err)
+	}
+
+	for i := range payments {
+		if err := stream.Context().Err(); err != nil {
+			return err
+		}
+		if err := stream.Send(paymentMessage(&payments[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var paymentStatuses = map[types.PaymentStatus]walletpb.PaymentStatus{
+	types.PaymentStatusInProgress: walletpb.PaymentStatus_PAYMENT_STATUS_INPROGRESS,
+	types.PaymentStatusOk:         walletpb.PaymentStatus_PAYMENT_STATUS_OK,
+	types.PaymentStatusFail:       walletpb.PaymentStatus_PAYMENT_STATUS_FAIL,
+	types.PaymentStatusCancelled:  walletpb.PaymentStatus_PAYMENT_STATUS_CANCELLED,
+	types.PaymentStatusExpired:    walletpb.PaymentStatus_PAYMENT_STATUS_EXPIRED,
+}
+
+func accountMessage(account *types.Account) *walletpb.Account {
+	return &walletpb.Account{
+		Id:       account.ID,
+		Phone:    string(account.Phone),
+		Balance:  int64(account.Balance),
+		Currency: string(account.Currency),
+	}
+}
+
+func paymentMessage(payment *types.Payment) *walletpb.Payment {
+	message := &walletpb.Payment{
+		Id:              payment.ID,
+		AccountId:       payment.AccountID,
+		Amount:          int64(payment.Amount),
+		Category:        string(payment.Category),
+		Status:          paymentStatuses[payment.Status],
+		LinkedPaymentId: payment.LinkedPaymentID,
+	}
+	if !payment.CreatedAt.IsZero() {
+		message.CreatedAt = timestamppb.New(payment.CreatedAt)
+	}
+	if !payment.UpdatedAt.IsZero() {
+		message.UpdatedAt = timestamppb.New(payment.UpdatedAt)
+	}
+	return message
+}
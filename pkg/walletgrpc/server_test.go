@@ -0,0 +1,193 @@
+package walletgrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/shFarrukh/wallet/pkg/wallet"
+	"github.com/shFarrukh/wallet/pkg/walletpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient serves a new wallet over an in-process connection and
+// returns a client of it.
+func newTestClient(t *testing.T) walletpb.WalletClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	walletpb.RegisterWalletServer(server, NewServer(&wallet.Service{}))
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return walletpb.NewWalletClient(conn)
+}
+
+func TestServer_paymentFlow(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	account, err := client.RegisterAccount(ctx, &walletpb.RegisterAccountRequest{Phone: "+992000000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Currency != string(wallet.DefaultCurrency) {
+		t.Errorf("wrong currency => %v", account.Currency)
+	}
+	account, err = client.Deposit(ctx, &walletpb.DepositRequest{AccountId: account.Id, Amount: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := client.Pay(ctx, &walletpb.PayRequest{AccountId: account.Id, Amount: 30, Category: "auto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != walletpb.PaymentStatus_PAYMENT_STATUS_INPROGRESS || payment.CreatedAt == nil {
+		t.Errorf("wrong payment => %v", payment)
+	}
+	favorite, err := client.FavoritePayment(ctx, &walletpb.FavoritePaymentRequest{PaymentId: payment.Id, Name: "car"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.PayFromFavorite(ctx, &walletpb.PayFromFavoriteRequest{FavoriteId: favorite.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Repeat(ctx, &walletpb.RepeatRequest{PaymentId: payment.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, err := client.Reject(ctx, &walletpb.RejectRequest{PaymentId: payment.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected.Status != walletpb.PaymentStatus_PAYMENT_STATUS_FAIL {
+		t.Errorf("wrong status => %v", rejected.Status)
+	}
+
+	stream, err := client.ExportAccountHistory(ctx, &walletpb.ExportAccountHistoryRequest{AccountId: account.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history []*walletpb.Payment
+	for {
+		payment, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, payment)
+	}
+	if len(history) != 3 || history[0].Id != payment.Id {
+		t.Errorf("wrong history => %v", history)
+	}
+
+	account, err = client.GetAccount(ctx, &walletpb.GetAccountRequest{AccountId: account.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 40 {
+		t.Errorf("wrong balance\ngot > %v \nwant > %v", account.Balance, 40)
+	}
+}
+
+func TestServer_errorDetails(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	account, err := client.RegisterAccount(ctx, &walletpb.RegisterAccountRequest{Phone: "+992000000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		call   func() error
+		code   codes.Code
+		reason string
+		err    error
+	}{
+		{"phone registered", func() error {
+			_, err := client.RegisterAccount(ctx, &walletpb.RegisterAccountRequest{Phone: "+992000000001"})
+			return err
+		}, codes.AlreadyExists, "PHONE_REGISTERED", wallet.ErrPhoneRegistered},
+		{"not enough balance", func() error {
+			_, err := client.Pay(ctx, &walletpb.PayRequest{AccountId: account.Id, Amount: 10, Category: "auto"})
+			return err
+		}, codes.FailedPrecondition, "NOT_ENOUGH_BALANCE", wallet.ErrNotEnoughBalance},
+		{"amount not positive", func() error {
+			_, err := client.Deposit(ctx, &walletpb.DepositRequest{AccountId: account.Id})
+			return err
+		}, codes.InvalidArgument, "AMOUNT_MUST_BE_POSITIVE", wallet.ErrAmountMustBePositive},
+		{"payment not found", func() error {
+			_, err := client.Reject(ctx, &walletpb.RejectRequest{PaymentId: "nope"})
+			return err
+		}, codes.NotFound, "PAYMENT_NOT_FOUND", wallet.ErrPaymentNotFound},
+		{"history of unknown account", func() error {
+			stream, err := client.ExportAccountHistory(ctx, &walletpb.ExportAccountHistoryRequest{AccountId: 42})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}, codes.NotFound, "ACCOUNT_NOT_FOUND", wallet.ErrAccountNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			st := status.Convert(err)
+			if st.Code() != test.code {
+				t.Errorf("wrong code\ngot > %v \nwant > %v", st.Code(), test.code)
+			}
+			if len(st.Details()) != 1 {
+				t.Fatalf("wrong details => %v", st.Details())
+			}
+			info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+			if !ok || info.Reason != test.reason || info.Domain != ErrorDomain {
+				t.Errorf("wrong detail => %v", st.Details()[0])
+			}
+			if !errors.Is(FromError(err), test.err) {
+				t.Errorf("\ngot > %v \nwant > %v", FromError(err), test.err)
+			}
+		})
+	}
+}
+
+func TestServer_emptyHistory(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	account, err := client.RegisterAccount(ctx, &walletpb.RegisterAccountRequest{Phone: "+992000000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.ExportAccountHistory(ctx, &walletpb.ExportAccountHistoryRequest{AccountId: account.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("\ngot > %v \nwant > %v", err, io.EOF)
+	}
+}
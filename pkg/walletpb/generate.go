@@ -0,0 +1,5 @@
+// Package walletpb holds the Go code generated from
+// proto/wallet/v1/wallet.proto.
+package walletpb
+
+//go:generate protoc -I ../../proto --go_out=. --go_opt=module=github.com/shFarrukh/wallet/pkg/walletpb --go-grpc_out=. --go-grpc_opt=module=github.com/shFarrukh/wallet/pkg/walletpb wallet/v1/wallet.proto
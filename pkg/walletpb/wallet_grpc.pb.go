@@ -0,0 +1,459 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: wallet/v1/wallet.proto
+
+package walletpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// WalletClient is the client API for Wallet service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type WalletClient interface {
+	RegisterAccount(ctx context.Context, in *RegisterAccountRequest, opts ...grpc.CallOption) (*Account, error)
+	GetAccount(ctx context.Context, in *GetAccountRequest, opts ...grpc.CallOption) (*Account, error)
+	Deposit(ctx context.Context, in *DepositRequest, opts ...grpc.CallOption) (*Account, error)
+	Pay(ctx context.Context, in *PayRequest, opts ...grpc.CallOption) (*Payment, error)
+	GetPayment(ctx context.Context, in *GetPaymentRequest, opts ...grpc.CallOption) (*Payment, error)
+	Reject(ctx context.Context, in *RejectRequest, opts ...grpc.CallOption) (*Payment, error)
+	Repeat(ctx context.Context, in *RepeatRequest, opts ...grpc.CallOption) (*Payment, error)
+	FavoritePayment(ctx context.Context, in *FavoritePaymentRequest, opts ...grpc.CallOption) (*Favorite, error)
+	PayFromFavorite(ctx context.Context, in *PayFromFavoriteRequest, opts ...grpc.CallOption) (*Payment, error)
+	// ExportAccountHistory streams the payments of the account, oldest first.
+	ExportAccountHistory(ctx context.Context, in *ExportAccountHistoryRequest, opts ...grpc.CallOption) (Wallet_ExportAccountHistoryClient, error)
+}
+
+type walletClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewWalletClient(cc grpc.ClientConnInterface) WalletClient {
+	return &walletClient{cc}
+}
+
+func (c *walletClient) RegisterAccount(ctx context.Context, in *RegisterAccountRequest, opts ...grpc.CallOption) (*Account, error) {
+	out := new(Account)
+	err := c.cc.Invoke(ctx, "/wallet.v1.Wallet/RegisterAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *walletClient) GetAccount(ctx context.Context, in *GetAccountRequest, opts ...grpc.CallOption) (*Account, error) {
+	out := new(Account)
+	err := c.cc.Invoke(ctx, "/wallet.v1.Wallet/GetAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *walletClient) Deposit(ctx context.Context, in *DepositRequest, opts ...grpc.CallOption) (*Account, error) {
+	out := new(Account)
+	err := c.cc.Invoke(ctx, "/wallet.v1.Wallet/Deposit", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *walletClient) Pay(ctx context.Context, in *PayRequest, opts ...grpc.CallOption) (*Payment, error) {
+	out := new(Payment)
+	err := c.cc.Invoke(ctx, "/wallet.v1.Wallet/Pay", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *walletClient) GetPayment(ctx context.Context, in *GetPaymentRequest, opts ...grpc.CallOption) (*Payment, error) {
+	out := new(Payment)
+	err := c.cc.Invoke(ctx, "/wallet.v1.Wallet/GetPayment", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *walletClient) Reject(ctx context.Context, in *RejectRequest, opts ...grpc.CallOption) (*Payment, error) {
+	out := new(Payment)
+	err := c.cc.Invoke(ctx, "/wallet.v1.Wallet/Reject", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *walletClient) Repeat(ctx context.Context, in *RepeatRequest, opts ...grpc.CallOption) (*Payment, error) {
+	out := new(Payment)
+	err := c.cc.Invoke(ctx, "/wallet.v1.Wallet/Repeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *walletClient) FavoritePayment(ctx context.Context, in *FavoritePaymentRequest, opts ...grpc.CallOption) (*Favorite, error) {
+	out := new(Favorite)
+	err := c.cc.Invoke(ctx, "/wallet.v1.Wallet/FavoritePayment", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *walletClient) PayFromFavorite(ctx context.Context, in *PayFromFavoriteRequest, opts ...grpc.CallOption) (*Payment, error) {
+	out := new(Payment)
+	err := c.cc.Invoke(ctx, "/wallet.v1.Wallet/PayFromFavorite", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *walletClient) ExportAccountHistory(ctx context.Context, in *ExportAccountHistoryRequest, opts ...grpc.CallOption) (Wallet_ExportAccountHistoryClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Wallet_ServiceDesc.Streams[0], "/wallet.v1.Wallet/ExportAccountHistory", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &walletExportAccountHistoryClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Wallet_ExportAccountHistoryClient interface {
+	Recv() (*Payment, error)
+	grpc.ClientStream
+}
+
+type walletExportAccountHistoryClient struct {
+	grpc.ClientStream
+}
+
+func (x *walletExportAccountHistoryClient) Recv() (*Payment, error) {
+	m := new(Payment)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WalletServer is the server API for Wallet service.
+// All implementations must embed UnimplementedWalletServer
+// for forward compatibility
+type WalletServer interface {
+	RegisterAccount(context.Context, *RegisterAccountRequest) (*Account, error)
+	GetAccount(context.Context, *GetAccountRequest) (*Account, error)
+	Deposit(context.Context, *DepositRequest) (*Account, error)
+	Pay(context.Context, *PayRequest) (*Payment, error)
+	GetPayment(context.Context, *GetPaymentRequest) (*Payment, error)
+	Reject(context.Context, *RejectRequest) (*Payment, error)
+	Repeat(context.Context, *RepeatRequest) (*Payment, error)
+	FavoritePayment(context.Context, *FavoritePaymentRequest) (*Favorite, error)
+	PayFromFavorite(context.Context, *PayFromFavoriteRequest) (*Payment, error)
+	// ExportAccountHistory streams the payments of the account, oldest first.
+	ExportAccountHistory(*ExportAccountHistoryRequest, Wallet_ExportAccountHistoryServer) error
+	mustEmbedUnimplementedWalletServer()
+}
+
+// UnimplementedWalletServer must be embedded to have forward compatible implementations.
+type UnimplementedWalletServer struct {
+}
+
+func (UnimplementedWalletServer) RegisterAccount(context.Context, *RegisterAccountRequest) (*Account, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterAccount not implemented")
+}
+func (UnimplementedWalletServer) GetAccount(context.Context, *GetAccountRequest) (*Account, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAccount not implemented")
+}
+func (UnimplementedWalletServer) Deposit(context.Context, *DepositRequest) (*Account, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Deposit not implemented")
+}
+func (UnimplementedWalletServer) Pay(context.Context, *PayRequest) (*Payment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Pay not implemented")
+}
+func (UnimplementedWalletServer) GetPayment(context.Context, *GetPaymentRequest) (*Payment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPayment not implemented")
+}
+func (UnimplementedWalletServer) Reject(context.Context, *RejectRequest) (*Payment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reject not implemented")
+}
+func (UnimplementedWalletServer) Repeat(context.Context, *RepeatRequest) (*Payment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Repeat not implemented")
+}
+func (UnimplementedWalletServer) FavoritePayment(context.Context, *FavoritePaymentRequest) (*Favorite, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FavoritePayment not implemented")
+}
+func (UnimplementedWalletServer) PayFromFavorite(context.Context, *PayFromFavoriteRequest) (*Payment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PayFromFavorite not implemented")
+}
+func (UnimplementedWalletServer) ExportAccountHistory(*ExportAccountHistoryRequest, Wallet_ExportAccountHistoryServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportAccountHistory not implemented")
+}
+func (UnimplementedWalletServer) mustEmbedUnimplementedWalletServer() {}
+
+// UnsafeWalletServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to WalletServer will
+// result in compilation errors.
+type UnsafeWalletServer interface {
+	mustEmbedUnimplementedWalletServer()
+}
+
+func RegisterWalletServer(s grpc.ServiceRegistrar, srv WalletServer) {
+	s.RegisterService(&Wallet_ServiceDesc, srv)
+}
+
+func _Wallet_RegisterAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WalletServer).RegisterAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wallet.v1.Wallet/RegisterAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WalletServer).RegisterAccount(ctx, req.(*RegisterAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Wallet_GetAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WalletServer).GetAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wallet.v1.Wallet/GetAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WalletServer).GetAccount(ctx, req.(*GetAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Wallet_Deposit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DepositRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WalletServer).Deposit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wallet.v1.Wallet/Deposit",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WalletServer).Deposit(ctx, req.(*DepositRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Wallet_Pay_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PayRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WalletServer).Pay(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wallet.v1.Wallet/Pay",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WalletServer).Pay(ctx, req.(*PayRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Wallet_GetPayment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPaymentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WalletServer).GetPayment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wallet.v1.Wallet/GetPayment",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WalletServer).GetPayment(ctx, req.(*GetPaymentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Wallet_Reject_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RejectRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WalletServer).Reject(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wallet.v1.Wallet/Reject",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WalletServer).Reject(ctx, req.(*RejectRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Wallet_Repeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RepeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WalletServer).Repeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wallet.v1.Wallet/Repeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WalletServer).Repeat(ctx, req.(*RepeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Wallet_FavoritePayment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FavoritePaymentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WalletServer).FavoritePayment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wallet.v1.Wallet/FavoritePayment",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WalletServer).FavoritePayment(ctx, req.(*FavoritePaymentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Wallet_PayFromFavorite_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PayFromFavoriteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WalletServer).PayFromFavorite(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wallet.v1.Wallet/PayFromFavorite",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WalletServer).PayFromFavorite(ctx, req.(*PayFromFavoriteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Wallet_ExportAccountHistory_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportAccountHistoryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(WalletServer).ExportAccountHistory(m, &walletExportAccountHistoryServer{stream})
+}
+
+type Wallet_ExportAccountHistoryServer interface {
+	Send(*Payment) error
+	grpc.ServerStream
+}
+
+type walletExportAccountHistoryServer struct {
+	grpc.ServerStream
+}
+
+func (x *walletExportAccountHistoryServer) Send(m *Payment) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Wallet_ServiceDesc is the grpc.ServiceDesc for Wallet service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Wallet_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "wallet.v1.Wallet",
+	HandlerType: (*WalletServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RegisterAccount",
+			Handler:    _Wallet_RegisterAccount_Handler,
+		},
+		{
+			MethodName: "GetAccount",
+			Handler:    _Wallet_GetAccount_Handler,
+		},
+		{
+			MethodName: "Deposit",
+			Handler:    _Wallet_Deposit_Handler,
+		},
+		{
+			MethodName: "Pay",
+			Handler:    _Wallet_Pay_Handler,
+		},
+		{
+			MethodName: "GetPayment",
+			Handler:    _Wallet_GetPayment_Handler,
+		},
+		{
+			MethodName: "Reject",
+			Handler:    _Wallet_Reject_Handler,
+		},
+		{
+			MethodName: "Repeat",
+			Handler:    _Wallet_Repeat_Handler,
+		},
+		{
+			MethodName: "FavoritePayment",
+			Handler:    _Wallet_FavoritePayment_Handler,
+		},
+		{
+			MethodName: "PayFromFavorite",
+			Handler:    _Wallet_PayFromFavorite_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ExportAccountHistory",
+			Handler:       _Wallet_ExportAccountHistory_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "wallet/v1/wallet.proto",
+}